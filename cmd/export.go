@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/kalinink/simple-url-shortener/internal/database"
+	"github.com/kalinink/simple-url-shortener/internal/export"
+	"github.com/kalinink/simple-url-shortener/internal/repository"
+	"github.com/kalinink/simple-url-shortener/internal/shortener"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/rs/zerolog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// runExport writes the same export as GET /statistics/export to a file:
+//
+//	shortener export -kind rollups -format ndjson -from 2020-11-01 -to 2020-12-01 -out rollups.ndjson
+func runExport(log *zerolog.Logger, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	kind := flags.String("kind", shortener.ExportEvents, "events or rollups")
+	format := flags.String("format", export.CSV, "csv or ndjson")
+	from := flags.String("from", "", "beginning of the period, RFC 3339 or a date, a day before the end by default")
+	to := flags.String("to", "", "end of the period, RFC 3339 or a date, now by default")
+	out := flags.String("out", "", "output file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return errors.New("output file is required")
+	}
+
+	q, err := export.Query(*kind, *from, *to)
+	if err != nil {
+		return err
+	}
+
+	var cfg config
+	if err := envconfig.Process("", &cfg); err != nil {
+		return err
+	}
+
+	dbConn, err := database.Connect(cfg.DBConnStr, database.Config{
+		MaxOpenConns:           1,
+		ConnMaxLifetime:        cfg.DBConnMaxLifetime,
+		NumberInitConnectRetry: cfg.DBNumberInitConnRetry,
+	})
+	if err != nil {
+		return fmt.Errorf("db connect err: %s", err.Error())
+	}
+	defer func() { _ = dbConn.Close() }()
+
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+
+	buf := bufio.NewWriter(file)
+	w, err := export.NewWriter(*format, *kind, buf)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	store := repository.NewURL(dbConn, cfg.DBReadTimeout)
+	service := shortener.NewService(store, shortener.Config{}, log)
+	if err := service.Export(ctx, q, w); err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+
+	log.Info().Msgf("%s from %s to %s are exported to %s", q.Kind, q.From, q.Until, *out)
+	return nil
+}
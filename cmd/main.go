@@ -3,10 +3,15 @@ package main
 import (
 	"context"
 	"fmt"
+	"github.com/kalinink/simple-url-shortener/internal/alerting"
+	"github.com/kalinink/simple-url-shortener/internal/clickstream"
 	"github.com/kalinink/simple-url-shortener/internal/database"
+	"github.com/kalinink/simple-url-shortener/internal/geoip"
 	"github.com/kalinink/simple-url-shortener/internal/handler"
+	"github.com/kalinink/simple-url-shortener/internal/healthcheck"
 	"github.com/kalinink/simple-url-shortener/internal/repository"
 	"github.com/kalinink/simple-url-shortener/internal/shortener"
+	"github.com/kalinink/simple-url-shortener/internal/urlfilter"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/rs/zerolog"
 	"net"
@@ -36,6 +41,51 @@ type config struct {
 	HostName    string        `envconfig:"HOST_NAME" default:"example.com"`
 	HTTPScheme  string        `envconfig:"HTTP_SCHEME" default:"http"`
 	URLLifeTime time.Duration `envconfig:"URL_LIFE_TIME" default:"24h"`
+	VisitorSalt string        `envconfig:"VISITOR_SALT"`
+	// BotSignatures overrides the default list of user agent words of bots.
+	BotSignatures []string `envconfig:"BOT_SIGNATURES"`
+	ClickIDParam  string   `envconfig:"CLICK_ID_PARAM" default:"click_id"`
+
+	CanonicalizeURLs bool     `envconfig:"CANONICALIZE_URLS" default:"false"`
+	TrackingParams   []string `envconfig:"TRACKING_PARAMS"`
+	DedupeURLs       bool     `envconfig:"DEDUPE_URLS" default:"false"`
+
+	MixedScriptPolicy string `envconfig:"MIXED_SCRIPT_POLICY" default:"flag"`
+
+	AllowListPath      string        `envconfig:"ALLOW_LIST_PATH"`
+	DenyListPath       string        `envconfig:"DENY_LIST_PATH"`
+	ListReloadInterval time.Duration `envconfig:"LIST_RELOAD_INTERVAL" default:"30s"`
+
+	AllowedSchemes            []string `envconfig:"ALLOWED_SCHEMES" default:"http,https"`
+	AllowInternalDestinations bool     `envconfig:"ALLOW_INTERNAL_DESTINATIONS" default:"false"`
+	ResolveDestinations       bool     `envconfig:"RESOLVE_DESTINATIONS" default:"false"`
+
+	ShortenerDomains []string `envconfig:"SHORTENER_DOMAINS"`
+	MaxChainHops     int      `envconfig:"MAX_CHAIN_HOPS" default:"0"`
+
+	RedirectStatus      int           `envconfig:"REDIRECT_STATUS" default:"302"`
+	RedirectCacheMaxAge time.Duration `envconfig:"REDIRECT_CACHE_MAX_AGE" default:"0s"`
+
+	GeoIPDBPath string `envconfig:"GEOIP_DB_PATH"`
+
+	LiveBuffer     int    `envconfig:"LIVE_BUFFER" default:"64"`
+	LiveDropPolicy string `envconfig:"LIVE_DROP_POLICY" default:"oldest"`
+
+	MissRetention time.Duration `envconfig:"MISS_RETENTION" default:"720h"`
+
+	HealthCheckInterval    time.Duration `envconfig:"HEALTH_CHECK_INTERVAL" default:"1m"`
+	HealthCheckTimeout     time.Duration `envconfig:"HEALTH_CHECK_TIMEOUT" default:"5s"`
+	HealthCheckConcurrency int           `envconfig:"HEALTH_CHECK_CONCURRENCY" default:"10"`
+
+	AlertWebhookURLs    []string      `envconfig:"ALERT_WEBHOOK_URLS"`
+	AlertInterval       time.Duration `envconfig:"ALERT_INTERVAL" default:"1m"`
+	AlertWindow         time.Duration `envconfig:"ALERT_WINDOW" default:"5m"`
+	AlertBaseline       time.Duration `envconfig:"ALERT_BASELINE" default:"24h"`
+	AlertMultiplier     float64       `envconfig:"ALERT_MULTIPLIER" default:"10"`
+	AlertMinClicks      int           `envconfig:"ALERT_MIN_CLICKS" default:"20"`
+	AlertHardThreshold  int           `envconfig:"ALERT_HARD_THRESHOLD" default:"1000"`
+	AlertCooldown       time.Duration `envconfig:"ALERT_COOLDOWN" default:"1h"`
+	AlertRequestTimeout time.Duration `envconfig:"ALERT_REQUEST_TIMEOUT" default:"5s"`
 }
 
 // @title simple-url-shortener API
@@ -44,7 +94,14 @@ func main() {
 	log := zerolog.New(os.Stdout).With().Timestamp().Logger()
 	log.Info().Msgf("Version: %s", serviceVersion)
 
-	if err := run(&log); err != nil {
+	var err error
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		err = runExport(&log, os.Args[2:])
+	} else {
+		err = run(&log)
+	}
+
+	if err != nil {
 		log.Fatal().Err(err).Send()
 	}
 }
@@ -54,6 +111,21 @@ func run(log *zerolog.Logger) error {
 	if err := envconfig.Process("", &cfg); err != nil {
 		return err
 	}
+	if !shortener.ValidRedirectStatus(cfg.RedirectStatus) {
+		return fmt.Errorf("REDIRECT_STATUS must be 301, 302, 307 or 308, got %d", cfg.RedirectStatus)
+	}
+	if !shortener.ValidMixedScriptPolicy(cfg.MixedScriptPolicy) {
+		return fmt.Errorf("MIXED_SCRIPT_POLICY must be allow, flag or reject, got %q", cfg.MixedScriptPolicy)
+	}
+	if len(cfg.AlertWebhookURLs) > 0 && cfg.AlertInterval <= 0 {
+		return fmt.Errorf("ALERT_INTERVAL must be positive, got %s", cfg.AlertInterval)
+	}
+	if cfg.HealthCheckInterval <= 0 {
+		return fmt.Errorf("HEALTH_CHECK_INTERVAL must be positive, got %s", cfg.HealthCheckInterval)
+	}
+	if (cfg.AllowListPath != "" || cfg.DenyListPath != "") && cfg.ListReloadInterval <= 0 {
+		return fmt.Errorf("LIST_RELOAD_INTERVAL must be positive, got %s", cfg.ListReloadInterval)
+	}
 
 	dbConn, err := database.Connect(cfg.DBConnStr, database.Config{
 		MaxOpenConns:           cfg.DBMaxConnections,
@@ -72,8 +144,71 @@ func run(log *zerolog.Logger) error {
 		return fmt.Errorf("make migrations: %s", err.Error())
 	}
 
+	dropPolicy := clickstream.DropOldest
+	if cfg.LiveDropPolicy == "newest" {
+		dropPolicy = clickstream.DropNewest
+	}
+	clicks := clickstream.NewBroker(cfg.LiveBuffer, dropPolicy)
+	defer clicks.Close()
+
+	var geo shortener.GeoLocator
+	if cfg.GeoIPDBPath != "" {
+		geoDB, err := geoip.Open(cfg.GeoIPDBPath)
+		if err != nil {
+			return fmt.Errorf("open geoip database: %s", err.Error())
+		}
+		defer geoDB.Close()
+		geo = geoDB
+	} else {
+		log.Warn().Msg("GEOIP_DB_PATH is not set, country and region routes never match")
+	}
+
+	var filter shortener.DestinationFilter
+	var lists *urlfilter.Filter
+	if cfg.AllowListPath != "" || cfg.DenyListPath != "" {
+		lists, err = urlfilter.New(urlfilter.Config{
+			AllowList:      cfg.AllowListPath,
+			DenyList:       cfg.DenyListPath,
+			ReloadInterval: cfg.ListReloadInterval,
+		}, log)
+		if err != nil {
+			return fmt.Errorf("load destination lists: %s", err.Error())
+		}
+		filter = lists
+	}
+
+	var resolver shortener.Resolver
+	if cfg.ResolveDestinations {
+		resolver = net.DefaultResolver
+	}
+
 	store := repository.NewURL(dbConn, cfg.DBReadTimeout)
-	service := shortener.NewService(store, cfg.HostName, cfg.HTTPScheme, cfg.URLLifeTime, log)
+	service := shortener.NewService(store, shortener.Config{
+		HostName:      cfg.HostName,
+		Scheme:        cfg.HTTPScheme,
+		URLLifeTime:   cfg.URLLifeTime,
+		VisitorSalt:   cfg.VisitorSalt,
+		BotSignatures: cfg.BotSignatures,
+		ClickIDParam:  cfg.ClickIDParam,
+		Clicks:        clicks,
+		MissRetention: cfg.MissRetention,
+		Geo:           geo,
+
+		RedirectStatus:      cfg.RedirectStatus,
+		RedirectCacheMaxAge: cfg.RedirectCacheMaxAge,
+
+		Canonicalize:   cfg.CanonicalizeURLs,
+		TrackingParams: cfg.TrackingParams,
+		Dedupe:         cfg.DedupeURLs,
+
+		MixedScriptPolicy: cfg.MixedScriptPolicy,
+		Filter:            filter,
+		AllowedSchemes:    cfg.AllowedSchemes,
+		AllowInternal:     cfg.AllowInternalDestinations,
+		Resolver:          resolver,
+		ShortenerDomains:  cfg.ShortenerDomains,
+		MaxChainHops:      cfg.MaxChainHops,
+	}, log)
 
 	apiAddr := net.JoinHostPort(cfg.ServerHost, cfg.ServerPort)
 	serverHTTP := http.Server{
@@ -82,7 +217,50 @@ func run(log *zerolog.Logger) error {
 		WriteTimeout: cfg.ServerWriteTimeout,
 	}
 
-	httpHandler := handler.NewHTTPHandler(service, log)
+	httpHandler := handler.NewHTTPHandler(service, clicks, log)
+
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	if len(cfg.AlertWebhookURLs) > 0 {
+		alerter := alerting.NewAlerter(store, alerting.Config{
+			WebhookURLs:    cfg.AlertWebhookURLs,
+			Interval:       cfg.AlertInterval,
+			Window:         cfg.AlertWindow,
+			Baseline:       cfg.AlertBaseline,
+			Multiplier:     cfg.AlertMultiplier,
+			MinClicks:      cfg.AlertMinClicks,
+			HardThreshold:  cfg.AlertHardThreshold,
+			Cooldown:       cfg.AlertCooldown,
+			RequestTimeout: cfg.AlertRequestTimeout,
+		}, log)
+		go alerter.Run(backgroundCtx)
+	}
+
+	checker := healthcheck.NewChecker(store, healthcheck.Config{
+		Interval:      cfg.HealthCheckInterval,
+		Timeout:       cfg.HealthCheckTimeout,
+		Concurrency:   cfg.HealthCheckConcurrency,
+		AllowInternal: cfg.AllowInternalDestinations,
+	}, log)
+	go checker.Run(backgroundCtx)
+
+	if lists != nil {
+		go lists.Run(backgroundCtx)
+	}
+
+	go func() {
+		filled, err := service.BackfillCanonical(backgroundCtx)
+		if err != nil {
+			log.Err(err).Msg("canonical forms backfill")
+		} else if filled > 0 {
+			log.Info().Msgf("canonical forms of %d links are stored", filled)
+		}
+	}()
+
+	if cfg.MissRetention > 0 {
+		go service.RunMissRetention(backgroundCtx, time.Hour)
+	}
 
 	serverErr := make(chan error, 1)
 	go func() {
@@ -100,6 +278,9 @@ func run(log *zerolog.Logger) error {
 		ctx, cancel := context.WithTimeout(context.Background(), cfg.GracefulShutdownPeriod)
 		defer cancel()
 
+		// Live streams never get idle, so they are ended before the shutdown waits for them.
+		clicks.Close()
+
 		if err := serverHTTP.Shutdown(ctx); err != nil {
 			return fmt.Errorf("server graceful shutdown: %w", err)
 		}
@@ -24,23 +24,181 @@ var doc = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
-        "/long": {
+        "/conversions": {
             "post": {
                 "consumes": [
                     "application/json"
                 ],
+                "summary": "Recording a conversion of a click by a server-to-server postback",
+                "parameters": [
+                    {
+                        "description": "Click ID appended to the long URL",
+                        "name": "body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/ConversionRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": ""
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    }
+                }
+            }
+        },
+        "/conversions/pixel.gif": {
+            "get": {
+                "produces": [
+                    "image/gif"
+                ],
+                "summary": "Recording a conversion of a click by a tracking pixel",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Click ID appended to the long URL",
+                        "name": "click_id",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/links": {
+            "get": {
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Get the origin URL by short URL",
+                "summary": "Finding short URLs that point at a destination",
                 "parameters": [
                     {
-                        "description": "Short URL",
+                        "type": "string",
+                        "description": "Destination URL",
+                        "name": "target",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "exact (default) or canonical",
+                        "name": "match",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of links to skip, 0 by default",
+                        "name": "offset",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/TargetLinks"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    }
+                }
+            }
+        },
+        "/links/{key}/languages": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Getting localized destinations of a short URL",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Short URL key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/Languages"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Replacing localized destinations of a short URL",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Short URL key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Destinations by BCP 47 language tags",
                         "name": "body",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/Request"
+                            "$ref": "#/definitions/Languages"
                         }
                     }
                 ],
@@ -48,7 +206,7 @@ var doc = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/Response"
+                            "$ref": "#/definitions/Languages"
                         }
                     },
                     "400": {
@@ -57,6 +215,12 @@ var doc = `{
                             "$ref": "#/definitions/Error"
                         }
                     },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
                     "404": {
                         "description": "Not Found",
                         "schema": {
@@ -72,31 +236,73 @@ var doc = `{
                 }
             }
         },
-        "/short": {
-            "post": {
+        "/links/{key}/routes": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Getting routing rules of a short URL",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Short URL key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/Routes"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    }
+                }
+            },
+            "put": {
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Create a new short URL",
+                "summary": "Replacing routing rules of a short URL",
                 "parameters": [
                     {
-                        "description": "Origin URL",
+                        "type": "string",
+                        "description": "Short URL key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Routes evaluated in order, the first matching one wins",
                         "name": "body",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/Request"
+                            "$ref": "#/definitions/Routes"
                         }
                     }
                 ],
                 "responses": {
-                    "201": {
-                        "description": "Created",
+                    "200": {
+                        "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/Response"
+                            "$ref": "#/definitions/Routes"
                         }
                     },
                     "400": {
@@ -105,6 +311,12 @@ var doc = `{
                             "$ref": "#/definitions/Error"
                         }
                     },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
                     "404": {
                         "description": "Not Found",
                         "schema": {
@@ -120,17 +332,32 @@ var doc = `{
                 }
             }
         },
-        "/statistics": {
+        "/links/{key}/schedule": {
             "get": {
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Getting statistics on URLs",
+                "summary": "Getting the destination schedule of a short URL",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Short URL key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/Statistics"
+                            "$ref": "#/definitions/Schedule"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
                         }
                     },
                     "500": {
@@ -140,47 +367,1073 @@ var doc = `{
                         }
                     }
                 }
-            }
-        }
-    },
-    "definitions": {
-        "CountStatistics": {
-            "type": "object",
-            "properties": {
-                "long": {
-                    "type": "integer",
-                    "example": 10
-                },
-                "short": {
-                    "type": "integer",
-                    "example": 5
-                }
-            }
-        },
-        "Error": {
-            "type": "object",
-            "properties": {
-                "error": {
-                    "type": "string"
-                }
-            }
-        },
-        "Request": {
-            "type": "object",
-            "properties": {
-                "url": {
-                    "type": "string"
+            },
+            "put": {
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Replacing the destination schedule of a short URL",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Short URL key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Entries mustn't overlap",
+                        "name": "body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/Schedule"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/Schedule"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    }
                 }
             }
         },
-        "Response": {
-            "type": "object",
-            "properties": {
+        "/links/{key}/statistics": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Getting click and unique visitor statistics of a short URL",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Short URL key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of last days, 30 by default",
+                        "name": "days",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/LinkStatistics"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    }
+                }
+            }
+        },
+        "/live": {
+            "get": {
+                "produces": [
+                    "text/event-stream"
+                ],
+                "summary": "Streaming clicks of a short URL as Server-Sent Events",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Short URL key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    }
+                }
+            }
+        },
+        "/long": {
+            "post": {
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get the origin URL by short URL",
+                "parameters": [
+                    {
+                        "description": "Short URL",
+                        "name": "body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/Request"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/Response"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    }
+                }
+            }
+        },
+        "/short": {
+            "post": {
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Create a new short URL",
+                "parameters": [
+                    {
+                        "description": "Origin URL",
+                        "name": "body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/CreateRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "An existing link to the origin in the dedupe mode",
+                        "schema": {
+                            "$ref": "#/definitions/CreatedURL"
+                        }
+                    },
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/CreatedURL"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    }
+                }
+            }
+        },
+        "/statistics": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Getting statistics on URLs",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/Statistics"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    }
+                }
+            }
+        },
+        "/statistics/campaigns": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Getting clicks of links grouped by UTM campaign",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Window duration, 168h by default",
+                        "name": "window",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of campaigns, 10 by default",
+                        "name": "limit",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/Campaigns"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    }
+                }
+            }
+        },
+        "/statistics/export": {
+            "get": {
+                "produces": [
+                    "text/csv",
+                    "application/x-ndjson"
+                ],
+                "summary": "Streaming access events or daily rollups of a period",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "events (default) or rollups",
+                        "name": "kind",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "csv (default) or ndjson",
+                        "name": "format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Beginning of the period, RFC 3339 or a date, a day before the end by default",
+                        "name": "from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "End of the period, RFC 3339 or a date, now by default",
+                        "name": "to",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    }
+                }
+            }
+        },
+        "/statistics/misses": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Getting the most requested missing, expired or malformed short URLs",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "not_found (default), expired, bad_request or denied",
+                        "name": "event",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Window duration, 168h by default",
+                        "name": "window",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of keys, 10 by default",
+                        "name": "limit",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/TopMisses"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    }
+                }
+            }
+        },
+        "/statistics/top": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Getting the most clicked or trending links",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Ranking mode: clicks (default) or trending",
+                        "name": "mode",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Window duration, 24h by default",
+                        "name": "window",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of links, 10 by default",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only links with the tag",
+                        "name": "tag",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only links to the domain or its subdomains",
+                        "name": "domain",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/TopLinks"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    }
+                }
+            }
+        },
+        "/tags/{tag}/utm": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Getting the default UTM parameters of links with the tag",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Tag",
+                        "name": "tag",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/UTM"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "consumes": [
+                    "application/json"
+                ],
+                "summary": "Replacing the default UTM parameters of links with the tag",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Tag",
+                        "name": "tag",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "UTM parameters, empty ones delete the template",
+                        "name": "body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/UTM"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": ""
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    }
+                }
+            }
+        },
+        "/v2/statistics": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Getting statistics on URLs with the distribution of clicks",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/StatisticsV2"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    }
+                }
+            }
+        },
+        "/{key}": {
+            "get": {
+                "produces": [
+                    "text/html"
+                ],
+                "summary": "Redirect a browser to the origin URL",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Short URL key, optionally followed by a path to pass through",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "A page that opens the deep link of the matched route",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "301": {
+                        "description": ""
+                    },
+                    "302": {
+                        "description": ""
+                    },
+                    "307": {
+                        "description": ""
+                    },
+                    "308": {
+                        "description": ""
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/Error"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "CampaignStatistics": {
+            "type": "object",
+            "properties": {
+                "campaign": {
+                    "type": "string",
+                    "example": "black_friday"
+                },
+                "clicks": {
+                    "type": "integer",
+                    "example": 120
+                },
+                "links": {
+                    "type": "integer",
+                    "example": 3
+                },
+                "medium": {
+                    "type": "string",
+                    "example": "email"
+                },
+                "source": {
+                    "type": "string",
+                    "example": "newsletter"
+                }
+            }
+        },
+        "Campaigns": {
+            "type": "object",
+            "properties": {
+                "campaigns": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/CampaignStatistics"
+                    }
+                },
+                "window": {
+                    "type": "string",
+                    "example": "168h0m0s"
+                }
+            }
+        },
+        "ClickDistribution": {
+            "type": "object",
+            "properties": {
+                "by_hour": {
+                    "description": "ByHour has 24 items for UTC hours of the day, ByWeekday has 7 items starting from Sunday.",
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                },
+                "by_weekday": {
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                },
+                "inter_click_seconds": {
+                    "$ref": "#/definitions/Percentiles"
+                },
+                "link_age_seconds": {
+                    "$ref": "#/definitions/Percentiles"
+                }
+            }
+        },
+        "ConversionRequest": {
+            "type": "object",
+            "properties": {
+                "click_id": {
+                    "type": "string",
+                    "example": "9f86d081884c7d659a2feaa0c55ad015"
+                }
+            }
+        },
+        "CountStatistics": {
+            "type": "object",
+            "properties": {
+                "long": {
+                    "type": "integer",
+                    "example": 10
+                },
+                "short": {
+                    "type": "integer",
+                    "example": 5
+                }
+            }
+        },
+        "CreateRequest": {
+            "type": "object",
+            "properties": {
+                "cache_max_age": {
+                    "description": "CacheMaxAge is how long browsers may cache the redirect in seconds,\nthe server default if omitted and no caching if 0.",
+                    "type": "integer",
+                    "example": 0
+                },
+                "default_language": {
+                    "description": "Languages are localized destinations negotiated by the Accept-Language header\nalong with DefaultLanguage, the BCP 47 tag of the url. It's required with languages.",
+                    "type": "string",
+                    "example": "en"
+                },
+                "fallbacks": {
+                    "description": "Fallbacks replace the origin in order while it fails health checks.",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    },
+                    "example": [
+                        "https://mirror.example.org/article"
+                    ]
+                },
+                "ignore_bot_access": {
+                    "description": "IgnoreBotAccess keeps bots and prefetches from extending the link life.",
+                    "type": "boolean"
+                },
+                "languages": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/LanguageDestination"
+                    }
+                },
+                "pass_path": {
+                    "description": "PassPath appends the path after the key to the destination, e.g. /{key}/api/v2.",
+                    "type": "boolean"
+                },
+                "pass_query": {
+                    "description": "PassQuery merges the query of the short URL into the destination one.",
+                    "type": "boolean"
+                },
+                "redirect_status": {
+                    "description": "RedirectStatus is 301, 302, 307 or 308, the server default if omitted.",
+                    "type": "integer",
+                    "example": 307
+                },
+                "routes": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/Route"
+                    }
+                },
+                "schedule": {
+                    "description": "Schedule changes the destination over time.",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/ScheduleEntry"
+                    }
+                },
+                "tags": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    },
+                    "example": [
+                        "promo",
+                        "newsletter"
+                    ]
+                },
+                "track_conversions": {
+                    "description": "TrackConversions appends a click ID to the long URL on resolution.",
+                    "type": "boolean"
+                },
+                "url": {
+                    "type": "string"
+                },
+                "utm": {
+                    "description": "UTM parameters are merged into the query of the url, templates of the tags fill the missing ones.",
+                    "$ref": "#/definitions/UTM"
+                },
+                "variants": {
+                    "description": "Variants split visitors that don't match any route across destinations by weight.",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/Variant"
+                    }
+                }
+            }
+        },
+        "CreatedURL": {
+            "type": "object",
+            "properties": {
+                "display_url": {
+                    "description": "DisplayURL is the long URL with an internationalized host in the Unicode form.",
+                    "type": "string",
+                    "example": "https://пример.рф/article"
+                },
+                "mixed_script_host": {
+                    "description": "MixedScriptHost warns that the host of the long URL mixes scripts like a lookalike domain.",
+                    "type": "boolean",
+                    "example": false
+                },
+                "url": {
+                    "type": "string",
+                    "example": "http://example.com/4bd1f2e8a6c3"
+                }
+            }
+        },
+        "DailyStatistics": {
+            "type": "object",
+            "properties": {
+                "bot_clicks": {
+                    "type": "integer",
+                    "example": 1
+                },
+                "clicks": {
+                    "type": "integer",
+                    "example": 3
+                },
+                "conversions": {
+                    "type": "integer",
+                    "example": 1
+                },
+                "day": {
+                    "type": "string",
+                    "example": "2020-11-10"
+                },
+                "uniques": {
+                    "type": "integer",
+                    "example": 2
+                }
+            }
+        },
+        "Error": {
+            "type": "object",
+            "properties": {
+                "code": {
+                    "description": "Code tells apart errors with the same status, e.g. destination_denied.",
+                    "type": "string"
+                },
+                "error": {
+                    "type": "string"
+                }
+            }
+        },
+        "LanguageDestination": {
+            "type": "object",
+            "properties": {
+                "destination": {
+                    "type": "string",
+                    "example": "https://example.org/pt-br/docs"
+                },
+                "tag": {
+                    "description": "Tag is a BCP 47 language tag.",
+                    "type": "string",
+                    "example": "pt-BR"
+                }
+            }
+        },
+        "Languages": {
+            "type": "object",
+            "properties": {
+                "default": {
+                    "description": "Default is the BCP 47 tag of the long URL, it's required with languages.",
+                    "type": "string",
+                    "example": "en"
+                },
+                "languages": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/LanguageDestination"
+                    }
+                }
+            }
+        },
+        "LinkStatistics": {
+            "type": "object",
+            "properties": {
+                "bot_clicks": {
+                    "type": "integer",
+                    "example": 4
+                },
+                "clicks": {
+                    "type": "integer",
+                    "example": 12
+                },
+                "conversion_rate": {
+                    "type": "number",
+                    "example": 0.25
+                },
+                "conversions": {
+                    "type": "integer",
+                    "example": 3
+                },
+                "daily": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/DailyStatistics"
+                    }
+                },
+                "key": {
+                    "type": "string",
+                    "example": "4bd1f2e8a6c3"
+                },
+                "uniques": {
+                    "type": "integer",
+                    "example": 7
+                },
+                "variants": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/VariantStatistics"
+                    }
+                }
+            }
+        },
+        "MissCount": {
+            "type": "object",
+            "properties": {
+                "count": {
+                    "type": "integer",
+                    "example": 17
+                },
+                "key": {
+                    "type": "string",
+                    "example": "4bd1f2e8a6c3"
+                },
+                "last_seen": {
+                    "type": "string",
+                    "example": "2020-11-10 12:00:05"
+                }
+            }
+        },
+        "Percentiles": {
+            "type": "object",
+            "properties": {
+                "p50": {
+                    "type": "number",
+                    "example": 3600
+                },
+                "p90": {
+                    "type": "number",
+                    "example": 43200
+                },
+                "p99": {
+                    "type": "number",
+                    "example": 82800
+                }
+            }
+        },
+        "Request": {
+            "type": "object",
+            "properties": {
+                "url": {
+                    "type": "string"
+                }
+            }
+        },
+        "Response": {
+            "type": "object",
+            "properties": {
+                "deep_link": {
+                    "description": "DeepLink opens the app of the visitor, URL is the fallback if it isn't installed.",
+                    "type": "string"
+                },
                 "url": {
                     "type": "string"
                 }
             }
         },
+        "Route": {
+            "type": "object",
+            "properties": {
+                "deep_link": {
+                    "type": "string",
+                    "example": "example://product/1"
+                },
+                "destination": {
+                    "type": "string",
+                    "example": "https://apps.apple.com/app/id000000000"
+                },
+                "kind": {
+                    "type": "string",
+                    "example": "os"
+                },
+                "match": {
+                    "type": "string",
+                    "example": "ios"
+                }
+            }
+        },
+        "Routes": {
+            "type": "object",
+            "properties": {
+                "routes": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/Route"
+                    }
+                }
+            }
+        },
+        "Schedule": {
+            "type": "object",
+            "properties": {
+                "schedule": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/ScheduleEntry"
+                    }
+                }
+            }
+        },
+        "ScheduleEntry": {
+            "type": "object",
+            "properties": {
+                "destination": {
+                    "type": "string",
+                    "example": "https://example.org/livestream"
+                },
+                "end": {
+                    "type": "string",
+                    "example": "2020-12-01T20:00:00Z"
+                },
+                "start": {
+                    "type": "string",
+                    "example": "2020-12-01T18:00:00Z"
+                }
+            }
+        },
         "Statistics": {
             "type": "object",
             "properties": {
@@ -192,6 +1445,78 @@ var doc = `{
                 }
             }
         },
+        "StatisticsV2": {
+            "type": "object",
+            "properties": {
+                "clicks": {
+                    "$ref": "#/definitions/ClickDistribution"
+                },
+                "counts": {
+                    "$ref": "#/definitions/CountStatistics"
+                },
+                "version": {
+                    "type": "integer",
+                    "example": 2
+                }
+            }
+        },
+        "TargetLink": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string",
+                    "example": "2020-11-10 12:00:05"
+                },
+                "display_url": {
+                    "type": "string",
+                    "example": "https://example.org/article?utm_source=newsletter"
+                },
+                "expired": {
+                    "type": "boolean",
+                    "example": false
+                },
+                "last_access": {
+                    "type": "string",
+                    "example": "2020-11-12 08:30:00"
+                },
+                "short_url": {
+                    "type": "string",
+                    "example": "http://example.com/4bd1f2e8a6c3"
+                },
+                "url": {
+                    "type": "string",
+                    "example": "https://example.org/article?utm_source=newsletter"
+                }
+            }
+        },
+        "TargetLinks": {
+            "type": "object",
+            "properties": {
+                "links": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/TargetLink"
+                    }
+                },
+                "match": {
+                    "type": "string",
+                    "example": "exact"
+                },
+                "offset": {
+                    "type": "integer",
+                    "example": 0
+                },
+                "target": {
+                    "type": "string",
+                    "example": "https://example.org/article"
+                },
+                "truncated": {
+                    "description": "Truncated is set if there are more links, the next page starts at offset plus the number of links.",
+                    "type": "boolean",
+                    "example": false
+                }
+            }
+        },
         "TimingStatistics": {
             "type": "object",
             "properties": {
@@ -204,6 +1529,122 @@ var doc = `{
                     "example": "2020-10-23 01:33:45"
                 }
             }
+        },
+        "TopLink": {
+            "type": "object",
+            "properties": {
+                "clicks": {
+                    "type": "integer",
+                    "example": 40
+                },
+                "growth": {
+                    "type": "number",
+                    "example": 3
+                },
+                "long": {
+                    "type": "string",
+                    "example": "https://example.org/article"
+                },
+                "previous_clicks": {
+                    "type": "integer",
+                    "example": 10
+                },
+                "short": {
+                    "type": "string",
+                    "example": "http://example.com/4bd1f2e8a6c3"
+                }
+            }
+        },
+        "TopLinks": {
+            "type": "object",
+            "properties": {
+                "links": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/TopLink"
+                    }
+                },
+                "mode": {
+                    "type": "string",
+                    "example": "trending"
+                },
+                "window": {
+                    "type": "string",
+                    "example": "24h0m0s"
+                }
+            }
+        },
+        "TopMisses": {
+            "type": "object",
+            "properties": {
+                "event": {
+                    "type": "string",
+                    "example": "not_found"
+                },
+                "keys": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/MissCount"
+                    }
+                },
+                "window": {
+                    "type": "string",
+                    "example": "168h0m0s"
+                }
+            }
+        },
+        "UTM": {
+            "type": "object",
+            "properties": {
+                "campaign": {
+                    "type": "string",
+                    "example": "black_friday"
+                },
+                "content": {
+                    "type": "string"
+                },
+                "medium": {
+                    "type": "string",
+                    "example": "email"
+                },
+                "source": {
+                    "type": "string",
+                    "example": "newsletter"
+                },
+                "term": {
+                    "type": "string"
+                }
+            }
+        },
+        "Variant": {
+            "type": "object",
+            "properties": {
+                "destination": {
+                    "type": "string",
+                    "example": "https://example.org/landing-b"
+                },
+                "weight": {
+                    "type": "integer",
+                    "example": 30
+                }
+            }
+        },
+        "VariantStatistics": {
+            "type": "object",
+            "properties": {
+                "clicks": {
+                    "type": "integer",
+                    "example": 5
+                },
+                "destination": {
+                    "type": "string",
+                    "example": "https://example.org/landing-b"
+                },
+                "variant": {
+                    "type": "integer",
+                    "example": 2
+                }
+            }
         }
     }
 }`
@@ -10,7 +10,10 @@ require (
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/labstack/echo/v4 v4.1.17
 	github.com/lib/pq v1.9.0
+	github.com/oschwald/maxminddb-golang v1.8.0
 	github.com/rs/zerolog v1.20.0
 	github.com/swaggo/echo-swagger v1.1.0
 	github.com/swaggo/swag v1.7.0
+	golang.org/x/net v0.0.0-20201202161906-c7110b5ffcbb
+	golang.org/x/text v0.3.4
 )
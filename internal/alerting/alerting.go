@@ -0,0 +1,234 @@
+// Package alerting watches per-link click rates and notifies webhooks when a
+// link gets much more traffic than usual or crosses a hard threshold.
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/kalinink/simple-url-shortener/internal/shortener"
+	"github.com/rs/zerolog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	SpikeReason     = "spike"
+	ThresholdReason = "threshold"
+
+	deliveryAttempts = 3
+)
+
+// Source provides clicks of links in the current and the baseline windows
+// for links that may need an alert, it is implemented by the repository.
+type Source interface {
+	GrowingLinks(context.Context, *shortener.GrowthFilter) ([]shortener.TopLink, error)
+}
+
+type Config struct {
+	WebhookURLs []string
+	// Interval is how often rates are evaluated.
+	Interval time.Duration
+	// Window is the period of the current rate, Baseline is the period
+	// right before it the usual rate is computed from.
+	Window   time.Duration
+	Baseline time.Duration
+	// Multiplier fires an alert when the current rate exceeds the baseline
+	// rate that many times, MinClicks keeps it quiet for barely used links.
+	Multiplier float64
+	MinClicks  int
+	// HardThreshold fires an alert when a link gets that many clicks
+	// within the window regardless of the baseline, 0 disables it.
+	HardThreshold int
+	// Cooldown is the minimal period between alerts of the same kind for a link.
+	Cooldown       time.Duration
+	RequestTimeout time.Duration
+}
+
+type Alert struct {
+	// ID is the same for repeated deliveries of an alert, receivers can use it to drop duplicates.
+	ID       string    `json:"id"`
+	Key      string    `json:"key"`
+	URL      string    `json:"url"`
+	Reason   string    `json:"reason"`
+	Clicks   int       `json:"clicks"`
+	Expected float64   `json:"expected"`
+	Window   string    `json:"window"`
+	FiredAt  time.Time `json:"fired_at"`
+}
+
+type Alerter struct {
+	cfg    Config
+	source Source
+	client *http.Client
+	log    *zerolog.Logger
+	now    func() time.Time
+
+	mu        sync.Mutex
+	lastFired map[string]time.Time
+}
+
+func NewAlerter(source Source, cfg Config, log *zerolog.Logger) *Alerter {
+	return &Alerter{
+		cfg:       cfg,
+		source:    source,
+		client:    &http.Client{Timeout: cfg.RequestTimeout},
+		log:       log,
+		now:       time.Now,
+		lastFired: make(map[string]time.Time),
+	}
+}
+
+// Run evaluates rates every Interval until ctx is canceled.
+func (a *Alerter) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := a.Evaluate(ctx); err != nil {
+				a.log.Err(err).Msg("traffic alerts evaluation")
+			}
+		}
+	}
+}
+
+// Evaluate checks the rates once and delivers new alerts.
+func (a *Alerter) Evaluate(ctx context.Context) error {
+	now := a.now()
+	links, err := a.source.GrowingLinks(ctx, &shortener.GrowthFilter{
+		PreviousSince: now.Add(-a.cfg.Window - a.cfg.Baseline),
+		Since:         now.Add(-a.cfg.Window),
+		Until:         now,
+		MinClicks:     a.cfg.MinClicks,
+		Ratio:         a.cfg.Multiplier * float64(a.cfg.Window) / float64(a.cfg.Baseline),
+		Threshold:     a.cfg.HardThreshold,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, l := range links {
+		alert := a.check(l, now)
+		if alert == nil || !a.takeCooldown(alert, now) {
+			continue
+		}
+		a.deliver(ctx, alert)
+	}
+
+	return nil
+}
+
+func (a *Alerter) check(l shortener.TopLink, now time.Time) *Alert {
+	expected := float64(l.PreviousClicks) * float64(a.cfg.Window) / float64(a.cfg.Baseline)
+
+	var reason string
+	switch {
+	case a.cfg.HardThreshold > 0 && l.Clicks >= a.cfg.HardThreshold:
+		reason = ThresholdReason
+	case l.Clicks >= a.cfg.MinClicks && float64(l.Clicks) > a.cfg.Multiplier*expected:
+		reason = SpikeReason
+	default:
+		return nil
+	}
+
+	return &Alert{
+		Key:      l.Short,
+		URL:      l.Long,
+		Reason:   reason,
+		Clicks:   l.Clicks,
+		Expected: expected,
+		Window:   a.cfg.Window.String(),
+		FiredAt:  now,
+	}
+}
+
+// takeCooldown reports whether the alert isn't a duplicate of a recent one
+// and starts its cooldown.
+func (a *Alerter) takeCooldown(alert *Alert, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	dedupKey := alert.Key + "/" + alert.Reason
+	if last, ok := a.lastFired[dedupKey]; ok && now.Sub(last) < a.cfg.Cooldown {
+		return false
+	}
+	a.lastFired[dedupKey] = now
+
+	for k, last := range a.lastFired {
+		if now.Sub(last) >= a.cfg.Cooldown {
+			delete(a.lastFired, k)
+		}
+	}
+
+	sum := sha256.Sum256([]byte(dedupKey + "/" + strconv.FormatInt(now.UnixNano(), 10)))
+	alert.ID = hex.EncodeToString(sum[:8])
+	return true
+}
+
+func (a *Alerter) deliver(ctx context.Context, alert *Alert) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		a.log.Err(err).Msg("alert encoding")
+		return
+	}
+
+	for _, u := range a.cfg.WebhookURLs {
+		var err error
+		for attempt := 1; attempt <= deliveryAttempts; attempt++ {
+			if err = a.post(ctx, u, alert.ID, body); err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if attempt < deliveryAttempts && !sleep(ctx, time.Duration(attempt)*100*time.Millisecond) {
+				return
+			}
+		}
+		if err != nil {
+			a.log.Err(err).Msgf("alert %s delivery to %s", alert.ID, u)
+		}
+	}
+}
+
+// sleep waits for d and reports whether ctx is still alive.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (a *Alerter) post(ctx context.Context, url, id string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Alert-ID", id)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("webhook responded with %d", resp.StatusCode)
+	}
+	return nil
+}
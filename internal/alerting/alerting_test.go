@@ -0,0 +1,150 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/kalinink/simple-url-shortener/internal/shortener"
+	"github.com/rs/zerolog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeSource struct {
+	links []shortener.TopLink
+}
+
+func (s *fakeSource) GrowingLinks(ctx context.Context, f *shortener.GrowthFilter) ([]shortener.TopLink, error) {
+	return s.links, nil
+}
+
+type receiver struct {
+	mu       sync.Mutex
+	alerts   []Alert
+	failures int
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	var a Alert
+	if err := json.NewDecoder(req.Body).Decode(&a); err != nil || a.ID != req.Header.Get("X-Alert-ID") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.alerts = append(r.alerts, a)
+}
+
+func (r *receiver) received() []Alert {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Alert(nil), r.alerts...)
+}
+
+func newTestAlerter(t *testing.T, source Source, rcv *receiver) (*Alerter, *time.Time) {
+	srv := httptest.NewServer(rcv)
+	t.Cleanup(srv.Close)
+
+	log := zerolog.New(nil).With().Logger()
+	a := NewAlerter(source, Config{
+		WebhookURLs:    []string{srv.URL},
+		Interval:       time.Minute,
+		Window:         5 * time.Minute,
+		Baseline:       24 * time.Hour,
+		Multiplier:     10,
+		MinClicks:      20,
+		HardThreshold:  1000,
+		Cooldown:       time.Hour,
+		RequestTimeout: time.Second,
+	}, &log)
+
+	now := time.Date(2020, 11, 10, 12, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+	return a, &now
+}
+
+func TestAlerter_Evaluate(t *testing.T) {
+	source := &fakeSource{links: []shortener.TopLink{
+		// 288 five-minute windows in a day, so the usual rate is 1 click per window.
+		{Short: "spike", Long: "https://example.org/spike", Clicks: 30, PreviousClicks: 288},
+		{Short: "usual", Long: "https://example.org/usual", Clicks: 500, PreviousClicks: 288 * 100},
+		{Short: "quiet", Long: "https://example.org/quiet", Clicks: 10},
+		{Short: "huge", Long: "https://example.org/huge", Clicks: 5000, PreviousClicks: 288 * 1000},
+	}}
+	rcv := &receiver{}
+	a, now := newTestAlerter(t, source, rcv)
+	ctx := context.Background()
+
+	if err := a.Evaluate(ctx); err != nil {
+		t.Fatalf("evaluate: %v", err)
+	}
+	got := rcv.received()
+	if len(got) != 2 {
+		t.Fatalf("want 2 alerts, got %+v", got)
+	}
+	if got[0].Key != "spike" || got[0].Reason != SpikeReason {
+		t.Errorf("want a spike of 'spike' link, got %+v", got[0])
+	}
+	if got[1].Key != "huge" || got[1].Reason != ThresholdReason {
+		t.Errorf("want a threshold of 'huge' link, got %+v", got[1])
+	}
+
+	*now = now.Add(30 * time.Minute)
+	if err := a.Evaluate(ctx); err != nil {
+		t.Fatalf("evaluate: %v", err)
+	}
+	if got := rcv.received(); len(got) != 2 {
+		t.Errorf("want no alerts within the cooldown, got %+v", got[2:])
+	}
+
+	*now = now.Add(time.Hour)
+	if err := a.Evaluate(ctx); err != nil {
+		t.Fatalf("evaluate: %v", err)
+	}
+	got = rcv.received()
+	if len(got) != 4 {
+		t.Fatalf("want alerts again after the cooldown, got %+v", got)
+	}
+	if got[2].ID == got[0].ID {
+		t.Errorf("want a new alert id after the cooldown, got %s", got[2].ID)
+	}
+}
+
+func TestAlerter_Retry(t *testing.T) {
+	source := &fakeSource{links: []shortener.TopLink{{Short: "huge", Clicks: 5000}}}
+	rcv := &receiver{failures: deliveryAttempts - 1}
+	a, _ := newTestAlerter(t, source, rcv)
+
+	if err := a.Evaluate(context.Background()); err != nil {
+		t.Fatalf("evaluate: %v", err)
+	}
+	if got := rcv.received(); len(got) != 1 {
+		t.Errorf("want the alert delivered after retries, got %+v", got)
+	}
+}
+
+func TestAlerter_RetryCanceled(t *testing.T) {
+	source := &fakeSource{links: []shortener.TopLink{{Short: "huge", Clicks: 5000}}}
+	rcv := &receiver{failures: deliveryAttempts}
+	a, _ := newTestAlerter(t, source, rcv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := a.Evaluate(ctx); err != nil {
+		t.Fatalf("evaluate: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 250*time.Millisecond {
+		t.Errorf("want retries stopped with the context, took %s", elapsed)
+	}
+}
@@ -0,0 +1,127 @@
+// Package clickstream is an in-process pub/sub of resolved clicks.
+// Publishing never blocks: every subscriber has its own buffer and events
+// that don't fit into it are dropped according to the drop policy.
+package clickstream
+
+import (
+	"errors"
+	"github.com/kalinink/simple-url-shortener/internal/shortener"
+	"sync"
+	"sync/atomic"
+)
+
+type Policy int
+
+const (
+	// DropNewest discards the published event if the buffer is full.
+	DropNewest Policy = iota
+	// DropOldest discards the oldest buffered event to make room for the published one.
+	DropOldest
+)
+
+var ErrClosed = errors.New("clickstream: broker is closed")
+
+type Broker struct {
+	buffer int
+	policy Policy
+
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+func NewBroker(buffer int, policy Policy) *Broker {
+	return &Broker{
+		buffer: buffer,
+		policy: policy,
+		subs:   make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscription receives events of a single short URL key, or of all of them
+// if the key is empty. C is closed on Unsubscribe or when the broker is closed.
+type Subscription struct {
+	Key     string
+	C       <-chan *shortener.ClickEvent
+	ch      chan *shortener.ClickEvent
+	dropped uint64
+}
+
+// Dropped returns the number of events the subscriber missed.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (b *Broker) Subscribe(key string) (*Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrClosed
+	}
+
+	ch := make(chan *shortener.ClickEvent, b.buffer)
+	s := &Subscription{Key: key, C: ch, ch: ch}
+	b.subs[s] = struct{}{}
+	return s, nil
+}
+
+func (b *Broker) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.ch)
+	}
+}
+
+func (b *Broker) Publish(e *shortener.ClickEvent) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for s := range b.subs {
+		if s.Key == "" || s.Key == e.Key {
+			b.send(s, e)
+		}
+	}
+}
+
+func (b *Broker) send(s *Subscription, e *shortener.ClickEvent) {
+	select {
+	case s.ch <- e:
+		return
+	default:
+	}
+
+	if b.policy == DropOldest {
+		select {
+		case <-s.ch:
+			atomic.AddUint64(&s.dropped, 1)
+		default:
+		}
+		select {
+		case s.ch <- e:
+			return
+		default:
+		}
+	}
+
+	atomic.AddUint64(&s.dropped, 1)
+}
+
+// Close ends all subscriptions, so streaming handlers can return before
+// the HTTP server shuts down.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for s := range b.subs {
+		delete(b.subs, s)
+		close(s.ch)
+	}
+}
@@ -0,0 +1,54 @@
+package clickstream
+
+import (
+	"github.com/kalinink/simple-url-shortener/internal/shortener"
+	"testing"
+)
+
+func TestBroker_Publish(t *testing.T) {
+	cases := []struct {
+		policy      Policy
+		wantFirst   int
+		wantDropped uint64
+	}{
+		{policy: DropNewest, wantFirst: 0, wantDropped: 3},
+		{policy: DropOldest, wantFirst: 3, wantDropped: 3},
+	}
+
+	for _, c := range cases {
+		b := NewBroker(2, c.policy)
+		one, err := b.Subscribe("one")
+		if err != nil {
+			t.Fatalf("subscribe: %v", err)
+		}
+		all, _ := b.Subscribe("")
+
+		for i := 0; i < 5; i++ {
+			b.Publish(&shortener.ClickEvent{Key: "one", HitKind: string(rune('0' + i))})
+		}
+		b.Publish(&shortener.ClickEvent{Key: "two"})
+
+		if got := (<-one.C).HitKind; got != string(rune('0'+c.wantFirst)) {
+			t.Errorf("policy %d: want event #%d first, got #%s", c.policy, c.wantFirst, got)
+		}
+		if got := one.Dropped(); got != c.wantDropped {
+			t.Errorf("policy %d: want %d dropped, got %d", c.policy, c.wantDropped, got)
+		}
+		if got := all.Dropped(); got != c.wantDropped+1 {
+			t.Errorf("policy %d: want %d dropped by the global subscriber, got %d", c.policy, c.wantDropped+1, got)
+		}
+
+		b.Unsubscribe(one)
+		b.Close()
+		if _, ok := <-all.C; !ok {
+			t.Errorf("policy %d: want buffered events before the closed channel", c.policy)
+		}
+		<-all.C
+		if _, ok := <-all.C; ok {
+			t.Errorf("policy %d: want the channel closed with the broker", c.policy)
+		}
+		if _, err := b.Subscribe(""); err != ErrClosed {
+			t.Errorf("policy %d: want ErrClosed, got %v", c.policy, err)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS url_fallbacks (
+    short_url VARCHAR(20) NOT NULL REFERENCES urls (short_url) ON DELETE CASCADE,
+    position INT NOT NULL,
+    destination VARCHAR(2000) NOT NULL,
+    PRIMARY KEY (short_url, position)
+);
+
+CREATE TABLE IF NOT EXISTS destination_health (
+    destination VARCHAR(2000) PRIMARY KEY,
+    healthy BOOLEAN NOT NULL,
+    status_code INT NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    checked_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,2 @@
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS pass_path BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS pass_query BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,9 @@
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS default_language VARCHAR(35) NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS url_languages (
+    short_url VARCHAR(20) NOT NULL REFERENCES urls (short_url) ON DELETE CASCADE,
+    position INT NOT NULL,
+    tag VARCHAR(35) NOT NULL,
+    destination VARCHAR(2000) NOT NULL,
+    PRIMARY KEY (short_url, position)
+);
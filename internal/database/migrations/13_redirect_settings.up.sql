@@ -0,0 +1,3 @@
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS redirect_status INT NOT NULL DEFAULT 0;
+-- NULL keeps the default of the service, 0 disables caching.
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS cache_max_age_sec INT;
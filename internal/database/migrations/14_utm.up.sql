@@ -0,0 +1,20 @@
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS raw_origin VARCHAR(2000);
+UPDATE urls SET raw_origin = origin WHERE raw_origin IS NULL;
+ALTER TABLE urls ALTER COLUMN raw_origin SET NOT NULL;
+
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS utm_source VARCHAR(200) NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS utm_medium VARCHAR(200) NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS utm_campaign VARCHAR(200) NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS utm_term VARCHAR(200) NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS utm_content VARCHAR(200) NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS urls_utm_campaign_idx ON urls (utm_campaign) WHERE utm_campaign <> '';
+
+CREATE TABLE IF NOT EXISTS tag_utm_templates (
+    tag VARCHAR(50) PRIMARY KEY,
+    utm_source VARCHAR(200) NOT NULL DEFAULT '',
+    utm_medium VARCHAR(200) NOT NULL DEFAULT '',
+    utm_campaign VARCHAR(200) NOT NULL DEFAULT '',
+    utm_term VARCHAR(200) NOT NULL DEFAULT '',
+    utm_content VARCHAR(200) NOT NULL DEFAULT ''
+);
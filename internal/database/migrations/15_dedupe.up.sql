@@ -0,0 +1,3 @@
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS deduplicated BOOLEAN NOT NULL DEFAULT false;
+
+CREATE UNIQUE INDEX IF NOT EXISTS urls_origin_hash_idx ON urls (md5(origin)) WHERE deduplicated AND NOT is_expired;
@@ -0,0 +1,6 @@
+-- Canonical forms of existing links are filled by the service, it's NULL until then.
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS canonical_origin VARCHAR(2000);
+
+CREATE INDEX IF NOT EXISTS urls_origin_md5_idx ON urls (md5(origin));
+CREATE INDEX IF NOT EXISTS urls_raw_origin_md5_idx ON urls (md5(raw_origin));
+CREATE INDEX IF NOT EXISTS urls_canonical_origin_md5_idx ON urls (md5(canonical_origin));
@@ -0,0 +1 @@
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS mixed_script_host BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,12 @@
+ALTER TABLE long_urls_access ADD COLUMN IF NOT EXISTS short_url VARCHAR(20);
+-- Daily counts are bucketed by UTC days, accesses stored so far are taken as UTC, the zone of the service image.
+ALTER TABLE long_urls_access ALTER COLUMN access_at TYPE TIMESTAMPTZ USING access_at AT TIME ZONE 'UTC';
+
+CREATE INDEX IF NOT EXISTS long_urls_access_short_url_idx ON long_urls_access (short_url, access_at);
+
+CREATE TABLE IF NOT EXISTS url_daily_visitors (
+    short_url VARCHAR(20) NOT NULL,
+    day DATE NOT NULL,
+    sketch BYTEA NOT NULL,
+    PRIMARY KEY (short_url, day)
+);
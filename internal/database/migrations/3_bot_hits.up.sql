@@ -0,0 +1,3 @@
+ALTER TABLE long_urls_access ADD COLUMN IF NOT EXISTS hit_kind VARCHAR(10) NOT NULL DEFAULT 'human';
+
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS ignore_bot_access BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,9 @@
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS domain VARCHAR(255) NOT NULL DEFAULT '';
+
+UPDATE urls SET domain = lower(coalesce(substring(origin FROM '^[^:]+://(?:[^@/]*@)?([^/:?#]+)'), ''))
+WHERE domain = '';
+
+CREATE INDEX IF NOT EXISTS urls_tags_idx ON urls USING GIN (tags);
+CREATE INDEX IF NOT EXISTS urls_domain_idx ON urls (domain);
+CREATE INDEX IF NOT EXISTS long_urls_access_access_at_idx ON long_urls_access (access_at);
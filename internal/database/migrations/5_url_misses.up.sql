@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS url_misses (
+    key VARCHAR(2000) NOT NULL,
+    event VARCHAR(20) NOT NULL,
+    hit_kind VARCHAR(10) NOT NULL,
+    occurred_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS url_misses_event_occurred_at_idx ON url_misses (event, occurred_at);
+
+CREATE INDEX IF NOT EXISTS url_misses_occurred_at_idx ON url_misses (occurred_at);
@@ -0,0 +1,12 @@
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS track_conversions BOOLEAN NOT NULL DEFAULT false;
+
+ALTER TABLE long_urls_access ADD COLUMN IF NOT EXISTS click_id VARCHAR(32);
+CREATE UNIQUE INDEX IF NOT EXISTS long_urls_access_click_id_idx ON long_urls_access (click_id) WHERE click_id IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS url_conversions (
+    click_id VARCHAR(32) PRIMARY KEY,
+    short_url VARCHAR(20) NOT NULL,
+    converted_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS url_conversions_short_url_idx ON url_conversions (short_url, converted_at);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS url_routes (
+    short_url VARCHAR(20) NOT NULL REFERENCES urls (short_url) ON DELETE CASCADE,
+    position INT NOT NULL,
+    kind VARCHAR(20) NOT NULL,
+    match VARCHAR(50) NOT NULL,
+    destination VARCHAR(2000) NOT NULL,
+    deep_link VARCHAR(2000) NOT NULL DEFAULT '',
+    PRIMARY KEY (short_url, position)
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS url_variants (
+    short_url VARCHAR(20) NOT NULL REFERENCES urls (short_url) ON DELETE CASCADE,
+    variant INT NOT NULL,
+    destination VARCHAR(2000) NOT NULL,
+    weight INT NOT NULL,
+    PRIMARY KEY (short_url, variant)
+);
+
+ALTER TABLE long_urls_access ADD COLUMN IF NOT EXISTS variant INT NOT NULL DEFAULT 0;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS url_schedules (
+    short_url VARCHAR(20) NOT NULL REFERENCES urls (short_url) ON DELETE CASCADE,
+    starts_at TIMESTAMP NOT NULL,
+    ends_at TIMESTAMP,
+    destination VARCHAR(2000) NOT NULL,
+    PRIMARY KEY (short_url, starts_at)
+);
@@ -0,0 +1,217 @@
+// Package export encodes exported analytics as CSV or newline delimited JSON.
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/kalinink/simple-url-shortener/internal/shortener"
+	"io"
+	"strconv"
+	"time"
+)
+
+const (
+	CSV    = "csv"
+	NDJSON = "ndjson"
+
+	dayLayout = "2006-01-02"
+	// flushEvery is the number of records after which the output is flushed,
+	// so a client gets the data while the export is still running.
+	flushEvery = 500
+)
+
+// Writer encodes records and implements shortener.ExportWriter.
+type Writer interface {
+	shortener.ExportWriter
+	Flush() error
+}
+
+type flusher interface {
+	Flush()
+}
+
+// NewWriter returns a Writer of records of the export kind. If w implements Flush(),
+// like http.ResponseWriter does, it is flushed along with the encoder.
+func NewWriter(format, kind string, w io.Writer) (Writer, error) {
+	switch format {
+	case CSV:
+		return newCSVWriter(kind, w), nil
+	case NDJSON:
+		return newNDJSONWriter(w), nil
+	default:
+		return nil, shortener.NewBadParamsError(fmt.Sprintf("format must be %q or %q", CSV, NDJSON), nil)
+	}
+}
+
+// parseTime accepts RFC 3339 timestamps and dates like 2020-11-10.
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation(dayLayout, s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// Query builds an export query, the last day is exported by default.
+func Query(kind, from, until string) (shortener.ExportQuery, error) {
+	q := shortener.ExportQuery{Kind: kind, Until: time.Now()}
+
+	var err error
+	if until != "" {
+		if q.Until, err = parseTime(until); err != nil {
+			return q, shortener.NewBadParamsError("invalid end of the period", err)
+		}
+	}
+
+	q.From = q.Until.Add(-24 * time.Hour)
+	if from != "" {
+		if q.From, err = parseTime(from); err != nil {
+			return q, shortener.NewBadParamsError("invalid beginning of the period", err)
+		}
+	}
+
+	return q, q.Validate()
+}
+
+func ContentType(format string) string {
+	if format == NDJSON {
+		return "application/x-ndjson"
+	}
+	return "text/csv"
+}
+
+var csvHeaders = map[string][]string{
+	shortener.ExportEvents:  {"short_url", "access_at", "hit_kind"},
+	shortener.ExportRollups: {"short_url", "day", "clicks", "bot_clicks", "uniques"},
+}
+
+type csvWriter struct {
+	header      []string
+	w           *csv.Writer
+	out         io.Writer
+	records     int
+	wroteHeader bool
+}
+
+func newCSVWriter(kind string, w io.Writer) *csvWriter {
+	return &csvWriter{header: csvHeaders[kind], w: csv.NewWriter(w), out: w}
+}
+
+func (cw *csvWriter) WriteEvent(e *shortener.AccessEvent) error {
+	return cw.write([]string{
+		e.ShortURL,
+		e.AccessAt.Format(time.RFC3339),
+		e.HitKind,
+	})
+}
+
+func (cw *csvWriter) WriteRollup(r *shortener.DailyRollup) error {
+	return cw.write([]string{
+		r.ShortURL,
+		r.Day.Format(dayLayout),
+		strconv.Itoa(r.Clicks),
+		strconv.Itoa(r.BotClicks),
+		strconv.FormatUint(r.Uniques, 10),
+	})
+}
+
+// writeHeader writes the header once, even if there are no records.
+func (cw *csvWriter) writeHeader() error {
+	if cw.wroteHeader || cw.header == nil {
+		return nil
+	}
+	cw.wroteHeader = true
+	return cw.w.Write(cw.header)
+}
+
+func (cw *csvWriter) write(record []string) error {
+	if err := cw.writeHeader(); err != nil {
+		return err
+	}
+	if err := cw.w.Write(record); err != nil {
+		return err
+	}
+
+	cw.records++
+	if cw.records%flushEvery == 0 {
+		return cw.Flush()
+	}
+	return nil
+}
+
+func (cw *csvWriter) Flush() error {
+	if err := cw.writeHeader(); err != nil {
+		return err
+	}
+	cw.w.Flush()
+	if err := cw.w.Error(); err != nil {
+		return err
+	}
+	if f, ok := cw.out.(flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+type ndjsonWriter struct {
+	buf     *bufio.Writer
+	enc     *json.Encoder
+	out     io.Writer
+	records int
+}
+
+func newNDJSONWriter(w io.Writer) *ndjsonWriter {
+	buf := bufio.NewWriter(w)
+	return &ndjsonWriter{buf: buf, enc: json.NewEncoder(buf), out: w}
+}
+
+type event struct {
+	ShortURL string    `json:"short_url"`
+	AccessAt time.Time `json:"access_at"`
+	HitKind  string    `json:"hit_kind"`
+}
+
+type rollup struct {
+	ShortURL  string `json:"short_url"`
+	Day       string `json:"day"`
+	Clicks    int    `json:"clicks"`
+	BotClicks int    `json:"bot_clicks"`
+	Uniques   uint64 `json:"uniques"`
+}
+
+func (nw *ndjsonWriter) WriteEvent(e *shortener.AccessEvent) error {
+	return nw.write(event{ShortURL: e.ShortURL, AccessAt: e.AccessAt, HitKind: e.HitKind})
+}
+
+func (nw *ndjsonWriter) WriteRollup(r *shortener.DailyRollup) error {
+	return nw.write(rollup{
+		ShortURL:  r.ShortURL,
+		Day:       r.Day.Format(dayLayout),
+		Clicks:    r.Clicks,
+		BotClicks: r.BotClicks,
+		Uniques:   r.Uniques,
+	})
+}
+
+func (nw *ndjsonWriter) write(v interface{}) error {
+	if err := nw.enc.Encode(v); err != nil {
+		return err
+	}
+
+	nw.records++
+	if nw.records%flushEvery == 0 {
+		return nw.Flush()
+	}
+	return nil
+}
+
+func (nw *ndjsonWriter) Flush() error {
+	if err := nw.buf.Flush(); err != nil {
+		return err
+	}
+	if f, ok := nw.out.(flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/kalinink/simple-url-shortener/internal/shortener"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flushRecorder counts flushes and the bytes written before the last one.
+type flushRecorder struct {
+	bytes.Buffer
+	flushes int
+	flushed int
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushes++
+	r.flushed = r.Len()
+}
+
+func TestCSVWriter(t *testing.T) {
+	out := &flushRecorder{}
+	w, err := NewWriter(CSV, shortener.ExportRollups, out)
+	if err != nil {
+		t.Fatalf("new writer: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if got, want := out.String(), "short_url,day,clicks,bot_clicks,uniques\n"; got != want {
+		t.Errorf("want the header without records %q, got %q", want, got)
+	}
+
+	day := time.Date(2020, 11, 10, 0, 0, 0, 0, time.UTC)
+	err = w.WriteRollup(&shortener.DailyRollup{
+		ShortURL:        "abc",
+		DailyStatistics: shortener.DailyStatistics{Day: day, Clicks: 3, BotClicks: 1, Uniques: 2},
+	})
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if got, want := out.String(), "short_url,day,clicks,bot_clicks,uniques\nabc,2020-11-10,3,1,2\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestCSVWriter_Flush(t *testing.T) {
+	out := &flushRecorder{}
+	w, _ := NewWriter(CSV, shortener.ExportEvents, out)
+
+	e := &shortener.AccessEvent{ShortURL: "abc", AccessAt: time.Date(2020, 11, 10, 12, 0, 0, 0, time.UTC), HitKind: "human"}
+	for i := 0; i < flushEvery-1; i++ {
+		if err := w.WriteEvent(e); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if out.flushes != 0 {
+		t.Errorf("want no flushes before %d records, got %d", flushEvery, out.flushes)
+	}
+
+	if err := w.WriteEvent(e); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if out.flushes != 1 || out.flushed != out.Len() {
+		t.Errorf("want all records flushed after %d records, got %d flushes", flushEvery, out.flushes)
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != flushEvery+1 {
+		t.Errorf("want the header and %d records, got %d lines", flushEvery, lines)
+	}
+	if !strings.HasSuffix(out.String(), "abc,2020-11-10T12:00:00Z,human\n") {
+		t.Errorf("unexpected record in %q", out.String()[out.Len()-100:])
+	}
+}
+
+func TestNDJSONWriter(t *testing.T) {
+	out := &flushRecorder{}
+	w, err := NewWriter(NDJSON, shortener.ExportEvents, out)
+	if err != nil {
+		t.Fatalf("new writer: %v", err)
+	}
+
+	at := time.Date(2020, 11, 10, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < flushEvery; i++ {
+		if err := w.WriteEvent(&shortener.AccessEvent{ShortURL: "abc", AccessAt: at, HitKind: "bot"}); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if out.flushes != 1 || out.flushed != out.Len() {
+		t.Errorf("want all records flushed after %d records, got %d flushes", flushEvery, out.flushes)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != flushEvery {
+		t.Fatalf("want a line per record, got %d lines", len(lines))
+	}
+	var got event
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatalf("decode %q: %v", lines[0], err)
+	}
+	if want := (event{ShortURL: "abc", AccessAt: at, HitKind: "bot"}); got != want {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+}
+
+func TestNewWriter(t *testing.T) {
+	_, err := NewWriter("xml", shortener.ExportEvents, &bytes.Buffer{})
+	if e, ok := err.(shortener.Error); !ok || e.Type != shortener.BadParamsErrType {
+		t.Errorf("want a bad params error for an unknown format, got %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+// Package geoip locates IP addresses in a MaxMind database
+// (GeoLite2/GeoIP2 Country or City).
+package geoip
+
+import (
+	"github.com/kalinink/simple-url-shortener/internal/shortener"
+	"github.com/oschwald/maxminddb-golang"
+	"net"
+)
+
+type Reader struct {
+	db *maxminddb.Reader
+}
+
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+}
+
+// Open memory-maps the database, lookups don't touch the disk afterwards.
+func Open(path string) (*Reader, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{db: db}, nil
+}
+
+// Locate returns an empty location if the address isn't in the database.
+func (r *Reader) Locate(ip net.IP) (shortener.Location, error) {
+	var rec record
+	if err := r.db.Lookup(ip, &rec); err != nil {
+		return shortener.Location{}, err
+	}
+
+	loc := shortener.Location{Country: rec.Country.ISOCode}
+	if loc.Country != "" && len(rec.Subdivisions) > 0 && rec.Subdivisions[0].ISOCode != "" {
+		loc.Region = loc.Country + "-" + rec.Subdivisions[0].ISOCode
+	}
+	return loc, nil
+}
+
+func (r *Reader) Close() error {
+	return r.db.Close()
+}
@@ -0,0 +1,115 @@
+package geoip
+
+import (
+	"bytes"
+	"github.com/kalinink/simple-url-shortener/internal/shortener"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Values of the MaxMind DB data section, see https://maxmind.github.io/MaxMind-DB/.
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+func mmdbUint16(v uint16) []byte {
+	return []byte{5<<5 | 2, byte(v >> 8), byte(v)}
+}
+
+func mmdbUint32(v uint32) []byte {
+	return []byte{6<<5 | 4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+func mmdbMap(pairs ...[]byte) []byte {
+	return append([]byte{7<<5 | byte(len(pairs)/2)}, bytes.Join(pairs, nil)...)
+}
+
+// mmdbArray is an extended type, its number goes after the control byte.
+func mmdbArray(values ...[]byte) []byte {
+	return append([]byte{byte(len(values)), 11 - 7}, bytes.Join(values, nil)...)
+}
+
+// writeTestDB writes an IPv4 database where 0.0.0.0/2 is in California,
+// 64.0.0.0/2 is in Germany without a region and the upper half is unknown.
+func writeTestDB(t *testing.T) string {
+	california := mmdbMap(
+		mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString("US")),
+		mmdbString("subdivisions"), mmdbArray(mmdbMap(mmdbString("iso_code"), mmdbString("CA"))),
+	)
+	germany := mmdbMap(mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString("DE")))
+
+	// Records point at nodes, at the node count for no data or past it into the data section.
+	const nodeCount = 2
+	record := func(v int) []byte { return []byte{byte(v >> 16), byte(v >> 8), byte(v)} }
+	data := func(offset int) int { return nodeCount + 16 + offset }
+
+	var db bytes.Buffer
+	db.Write(record(1))
+	db.Write(record(nodeCount))
+	db.Write(record(data(0)))
+	db.Write(record(data(len(california))))
+	db.Write(make([]byte, 16))
+	db.Write(california)
+	db.Write(germany)
+	db.WriteString("\xAB\xCD\xEFMaxMind.com")
+	db.Write(mmdbMap(
+		mmdbString("node_count"), mmdbUint32(nodeCount),
+		mmdbString("record_size"), mmdbUint16(24),
+		mmdbString("ip_version"), mmdbUint16(4),
+		mmdbString("binary_format_major_version"), mmdbUint16(2),
+		mmdbString("database_type"), mmdbString("Test-City"),
+	))
+
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatalf("temp dir: %v", err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "test.mmdb")
+	if err := ioutil.WriteFile(path, db.Bytes(), 0600); err != nil {
+		t.Fatalf("write database: %v", err)
+	}
+	return path
+}
+
+func TestReader_Locate(t *testing.T) {
+	r, err := Open(writeTestDB(t))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer r.Close()
+
+	cases := []struct {
+		ip   string
+		want shortener.Location
+	}{
+		{ip: "10.0.0.1", want: shortener.Location{Country: "US", Region: "US-CA"}},
+		{ip: "100.0.0.1", want: shortener.Location{Country: "DE"}},
+		{ip: "200.0.0.1", want: shortener.Location{}},
+		{ip: "::ffff:10.0.0.1", want: shortener.Location{Country: "US", Region: "US-CA"}},
+	}
+	for _, c := range cases {
+		got, err := r.Locate(net.ParseIP(c.ip))
+		if err != nil {
+			t.Errorf("[%s] locate: %v", c.ip, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("[%s] want %+v, got %+v", c.ip, c.want, got)
+		}
+	}
+
+	if _, err := r.Locate(net.ParseIP("2001:db8::1")); err == nil {
+		t.Errorf("want an error for an IPv6 address in an IPv4 database")
+	}
+}
+
+func TestOpen_Missing(t *testing.T) {
+	if _, err := Open(filepath.Join(os.TempDir(), "missing.mmdb")); err == nil {
+		t.Errorf("want an error for a missing database")
+	}
+}
@@ -1,38 +1,114 @@
 package handler
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kalinink/simple-url-shortener/internal/clickstream"
+	"github.com/kalinink/simple-url-shortener/internal/export"
 	"github.com/kalinink/simple-url-shortener/internal/shortener"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/rs/zerolog"
 	"github.com/swaggo/echo-swagger"
+	"html/template"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/kalinink/simple-url-shortener/docs" // docs is generated by Swag CLI
 )
 
+// transparentPixel is a 1x1 transparent GIF.
+var transparentPixel = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+const (
+	sseRetry               = time.Second
+	sseHeartbeat           = 15 * time.Second
+	defaultStatisticsDays  = 30
+	defaultTopLimit        = 10
+	defaultTopWindow       = 24 * time.Hour
+	defaultMissesWindow    = 7 * 24 * time.Hour
+	defaultCampaignsWindow = 7 * 24 * time.Hour
+	// variantCookiePrefix followed by a short URL key names the cookie
+	// that keeps a visitor on the same A/B variant.
+	variantCookiePrefix = "v_"
+	variantCookieMaxAge = 30 * 24 * time.Hour
+	// deepLinkFallbackDelay is how long the app is given to open before the fallback.
+	deepLinkFallbackDelay = 1500 * time.Millisecond
+)
+
+var deepLinkPage = template.Must(template.New("deep link").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Opening the app</title>
+</head>
+<body>
+<p><a href="{{.DeepLink}}">Open the app</a> or <a href="{{.Fallback}}">continue</a>.</p>
+<script>
+setTimeout(function () {
+  if (!document.hidden) {
+    window.location.replace({{.Fallback}});
+  }
+}, {{.Delay}});
+window.location.href = {{.DeepLink}};
+</script>
+</body>
+</html>
+`))
+
 type HTTPHandler struct {
 	e          *echo.Echo
 	urlService shortener.URLShortenerService
+	clicks     *clickstream.Broker
 	log        *zerolog.Logger
 }
 
-func NewHTTPHandler(service shortener.URLShortenerService, log *zerolog.Logger) *HTTPHandler {
+func NewHTTPHandler(service shortener.URLShortenerService, clicks *clickstream.Broker, log *zerolog.Logger) *HTTPHandler {
 	e := echo.New()
 	e.Debug = false
 	e.HideBanner = true
 	e.HidePort = true
 
-	h := &HTTPHandler{e: e, urlService: service, log: log}
+	h := &HTTPHandler{e: e, urlService: service, clicks: clicks, log: log}
 	h.registerRoutes()
 
 	return h
 }
 
 func (hdl *HTTPHandler) RegisterAndStartServer(s *http.Server) error {
+	s.ConnContext = withConn
 	return hdl.e.StartServer(s)
 }
 
+// connKey keeps the connection of a request in its context, see liftWriteTimeout.
+type connKey struct{}
+
+func withConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// liftWriteTimeout lets a long response outlast the server write timeout,
+// the server sets the deadline on the connection before the handler runs.
+func liftWriteTimeout(c echo.Context) error {
+	conn, ok := c.Request().Context().Value(connKey{}).(net.Conn)
+	if !ok {
+		return errors.New("the connection isn't in the request context")
+	}
+	return conn.SetWriteDeadline(time.Time{})
+}
+
 func (hdl *HTTPHandler) registerRoutes() {
 	hdl.e.GET("/swagger/*", echoSwagger.WrapHandler)
 	hdl.e.Use(middleware.Logger())
@@ -41,29 +117,78 @@ func (hdl *HTTPHandler) registerRoutes() {
 	hdl.e.POST("/short", hdl.createShortURL)
 	hdl.e.POST("/long", hdl.getLongURL)
 	hdl.e.GET("/statistics", hdl.getStatistics)
+	hdl.e.GET("/v2/statistics", hdl.getStatisticsV2)
+	hdl.e.GET("/statistics/top", hdl.getTopLinks)
+	hdl.e.GET("/statistics/export", hdl.exportStatistics)
+	hdl.e.GET("/statistics/misses", hdl.getTopMisses)
+	hdl.e.GET("/statistics/campaigns", hdl.getCampaigns)
+	hdl.e.POST("/conversions", hdl.postConversion)
+	hdl.e.GET("/conversions/pixel.gif", hdl.conversionPixel)
+	hdl.e.GET("/links", hdl.findLinks)
+	hdl.e.GET("/links/:key/statistics", hdl.getLinkStatistics)
+	hdl.e.GET("/links/:key/live", hdl.streamClicks)
+	hdl.e.GET("/links/:key/routes", hdl.getRoutes)
+	hdl.e.PUT("/links/:key/routes", hdl.putRoutes)
+	hdl.e.GET("/links/:key/languages", hdl.getLanguages)
+	hdl.e.PUT("/links/:key/languages", hdl.putLanguages)
+	hdl.e.GET("/links/:key/schedule", hdl.getSchedule)
+	hdl.e.PUT("/links/:key/schedule", hdl.putSchedule)
+	hdl.e.GET("/live", hdl.streamClicks)
+	hdl.e.GET("/tags/:tag/utm", hdl.getUTMTemplate)
+	hdl.e.PUT("/tags/:tag/utm", hdl.putUTMTemplate)
+	// Browsers and crawlers ask for these on their own, they aren't misses of short URLs.
+	hdl.e.GET("/favicon.ico", notFound)
+	hdl.e.GET("/robots.txt", notFound)
+	// Any other path is a short URL.
+	hdl.e.GET("/*", hdl.redirect)
 }
 
 // @Summary Create a new short URL
 // @Accept  json
 // @Produce  json
-// @Param   body body URLRequest true "Origin URL"
-// @Success 201 {object} URLResponse
+// @Param   body body CreateURLRequest true "Origin URL"
+// @Success 200 {object} CreatedURLResponse "An existing link to the origin in the dedupe mode"
+// @Success 201 {object} CreatedURLResponse
 // @Failure 400 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
 // @Failure 404 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /short [post]
 func (hdl *HTTPHandler) createShortURL(c echo.Context) error {
-	longURL := URLRequest{}
+	longURL := CreateURLRequest{}
 	if err := c.Bind(&longURL); err != nil {
 		return RespondError(c, err, http.StatusBadRequest)
 	}
 
-	url, err := hdl.urlService.CreateShortURL(c.Request().Context(), longURL.URL)
+	opts := shortener.LinkOptions{
+		IgnoreBotAccess:  longURL.IgnoreBotAccess,
+		Tags:             longURL.Tags,
+		TrackConversions: longURL.TrackConversions,
+		Routes:           requestRoutesToServiceDTO(longURL.Routes),
+		Variants:         requestVariantsToServiceDTO(longURL.Variants),
+		Schedule:         requestScheduleToServiceDTO(longURL.Schedule),
+		Fallbacks:        longURL.Fallbacks,
+		DefaultLanguage:  longURL.DefaultLanguage,
+		Languages:        requestLanguagesToServiceDTO(longURL.Languages),
+		PassPath:         longURL.PassPath,
+		PassQuery:        longURL.PassQuery,
+		RedirectStatus:   longURL.RedirectStatus,
+		UTM:              requestUTMToServiceDTO(longURL.UTM),
+	}
+	if longURL.CacheMaxAge != nil {
+		maxAge := time.Duration(*longURL.CacheMaxAge) * time.Second
+		opts.CacheMaxAge = &maxAge
+	}
+	url, err := hdl.urlService.CreateShortURL(c.Request().Context(), longURL.URL, opts)
 	if err != nil {
 		return hdl.handleShortenerServiceError(c, err)
 	}
 
-	return Respond(c, URLResponse{url.Short}, http.StatusCreated)
+	resp := CreatedURLResponse{URL: url.Short, DisplayURL: url.Display, MixedScriptHost: url.MixedScript}
+	if url.Existing {
+		return Respond(c, resp, http.StatusOK)
+	}
+	return Respond(c, resp, http.StatusCreated)
 }
 
 // @Summary Get the origin URL by short URL
@@ -72,6 +197,7 @@ func (hdl *HTTPHandler) createShortURL(c echo.Context) error {
 // @Param   body body URLRequest true "Short URL"
 // @Success 200 {object} URLResponse
 // @Failure 400 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
 // @Failure 404 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /long [post]
@@ -81,12 +207,68 @@ func (hdl *HTTPHandler) getLongURL(c echo.Context) error {
 		return RespondError(c, err, http.StatusBadRequest)
 	}
 
-	url, err := hdl.urlService.GetLongURL(c.Request().Context(), shortURL.URL)
+	visitor := visitorFromRequest(c)
+
+	url, err := hdl.urlService.GetLongURL(c.Request().Context(), shortURL.URL, visitor)
 	if err != nil {
 		return hdl.handleShortenerServiceError(c, err)
 	}
 
-	return Respond(c, URLResponse{url.Long}, http.StatusOK)
+	setVariantCookie(c, url)
+
+	return Respond(c, URLResponse{URL: url.Long, DeepLink: url.DeepLink}, http.StatusOK)
+}
+
+// @Summary Redirect a browser to the origin URL
+// @Param   key path string true "Short URL key, optionally followed by a path to pass through"
+// @Produce  html
+// @Success 200 {string} string "A page that opens the deep link of the matched route"
+// @Success 301
+// @Success 302
+// @Success 307
+// @Success 308
+// @Failure 400 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /{key} [get]
+func (hdl *HTTPHandler) redirect(c echo.Context) error {
+	r := c.Request()
+	shortURL := c.Scheme() + "://" + r.Host + r.URL.RequestURI()
+
+	url, err := hdl.urlService.GetLongURL(r.Context(), shortURL, visitorFromRequest(c))
+	if err != nil {
+		return hdl.handleShortenerServiceError(c, err)
+	}
+
+	setVariantCookie(c, url)
+	setCacheHeaders(c, *url.CacheMaxAge, url.ResolvedAt)
+
+	if url.DeepLink != "" {
+		return openApp(c, url)
+	}
+	return c.Redirect(url.RedirectStatus, url.Long)
+}
+
+func notFound(c echo.Context) error {
+	return respond(c, ErrorResponse{Error: "not found"}, http.StatusNotFound)
+}
+
+// openApp serves a page that opens the deep link and goes on to the long URL
+// if the app doesn't take over, a redirect to an unknown scheme would fail.
+func openApp(c echo.Context, url *shortener.URL) error {
+	var page bytes.Buffer
+	err := deepLinkPage.Execute(&page, struct {
+		// The scheme of the deep link is checked on creation.
+		DeepLink template.URL
+		Fallback string
+		Delay    int64
+	}{template.URL(url.DeepLink), url.Long, deepLinkFallbackDelay.Milliseconds()})
+	if err != nil {
+		return err
+	}
+
+	return c.HTMLBlob(http.StatusOK, page.Bytes())
 }
 
 // @Summary Getting statistics on URLs
@@ -102,3 +284,566 @@ func (hdl *HTTPHandler) getStatistics(c echo.Context) error {
 
 	return Respond(c, serviceStatToResponseDTO(stat), http.StatusOK)
 }
+
+// @Summary Getting statistics on URLs with the distribution of clicks
+// @Produce  json
+// @Success 200 {object} StatisticV2Response
+// @Failure 500 {object} ErrorResponse
+// @Router /v2/statistics [get]
+func (hdl *HTTPHandler) getStatisticsV2(c echo.Context) error {
+	stat, err := hdl.urlService.DetailedStatistics(c.Request().Context())
+	if err != nil {
+		return hdl.handleShortenerServiceError(c, err)
+	}
+
+	return Respond(c, serviceStatV2ToResponseDTO(stat), http.StatusOK)
+}
+
+// @Summary Getting click and unique visitor statistics of a short URL
+// @Produce  json
+// @Param   key path string true "Short URL key"
+// @Param   days query int false "Number of last days, 30 by default"
+// @Success 200 {object} LinkStatisticResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /links/{key}/statistics [get]
+func (hdl *HTTPHandler) getLinkStatistics(c echo.Context) error {
+	days := defaultStatisticsDays
+	if d := c.QueryParam("days"); d != "" {
+		var err error
+		if days, err = strconv.Atoi(d); err != nil {
+			return RespondError(c, err, http.StatusBadRequest)
+		}
+	}
+
+	stat, err := hdl.urlService.LinkStatistics(c.Request().Context(), c.Param("key"), days)
+	if err != nil {
+		return hdl.handleShortenerServiceError(c, err)
+	}
+
+	return Respond(c, serviceLinkStatToResponseDTO(stat), http.StatusOK)
+}
+
+// @Summary Getting the most clicked or trending links
+// @Produce  json
+// @Param   mode query string false "Ranking mode: clicks (default) or trending"
+// @Param   window query string false "Window duration, 24h by default"
+// @Param   limit query int false "Number of links, 10 by default"
+// @Param   tag query string false "Only links with the tag"
+// @Param   domain query string false "Only links to the domain or its subdomains"
+// @Success 200 {object} TopLinksResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /statistics/top [get]
+func (hdl *HTTPHandler) getTopLinks(c echo.Context) error {
+	q := shortener.TopQuery{
+		Mode:   c.QueryParam("mode"),
+		Window: defaultTopWindow,
+		Limit:  defaultTopLimit,
+		Tag:    c.QueryParam("tag"),
+		Domain: c.QueryParam("domain"),
+	}
+	if q.Mode == "" {
+		q.Mode = shortener.TopByClicks
+	}
+
+	var err error
+	if w := c.QueryParam("window"); w != "" {
+		if q.Window, err = time.ParseDuration(w); err != nil {
+			return RespondError(c, err, http.StatusBadRequest)
+		}
+	}
+	if l := c.QueryParam("limit"); l != "" {
+		if q.Limit, err = strconv.Atoi(l); err != nil {
+			return RespondError(c, err, http.StatusBadRequest)
+		}
+	}
+
+	top, err := hdl.urlService.TopLinks(c.Request().Context(), q)
+	if err != nil {
+		return hdl.handleShortenerServiceError(c, err)
+	}
+
+	return Respond(c, serviceTopToResponseDTO(q, top), http.StatusOK)
+}
+
+// @Summary Getting the most requested missing, expired or malformed short URLs
+// @Produce  json
+// @Param   event query string false "not_found (default), expired, bad_request or denied"
+// @Param   window query string false "Window duration, 168h by default"
+// @Param   limit query int false "Number of keys, 10 by default"
+// @Success 200 {object} TopMissesResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /statistics/misses [get]
+func (hdl *HTTPHandler) getTopMisses(c echo.Context) error {
+	event := c.QueryParam("event")
+	if event == "" {
+		event = shortener.NotFoundMiss
+	}
+
+	window, limit := defaultMissesWindow, defaultTopLimit
+	var err error
+	if w := c.QueryParam("window"); w != "" {
+		if window, err = time.ParseDuration(w); err != nil {
+			return RespondError(c, err, http.StatusBadRequest)
+		}
+	}
+	if l := c.QueryParam("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil {
+			return RespondError(c, err, http.StatusBadRequest)
+		}
+	}
+
+	misses, err := hdl.urlService.TopMisses(c.Request().Context(), event, window, limit)
+	if err != nil {
+		return hdl.handleShortenerServiceError(c, err)
+	}
+
+	return Respond(c, serviceMissesToResponseDTO(event, window, misses), http.StatusOK)
+}
+
+// @Summary Finding short URLs that point at a destination
+// @Produce  json
+// @Param   target query string true "Destination URL"
+// @Param   match query string false "exact (default) or canonical"
+// @Param   offset query int false "Number of links to skip, 0 by default"
+// @Success 200 {object} TargetLinksResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /links [get]
+func (hdl *HTTPHandler) findLinks(c echo.Context) error {
+	target := c.QueryParam("target")
+	match := c.QueryParam("match")
+	if match == "" {
+		match = shortener.ExactMatch
+	}
+	offset := 0
+	if o := c.QueryParam("offset"); o != "" {
+		var err error
+		if offset, err = strconv.Atoi(o); err != nil {
+			return RespondError(c, err, http.StatusBadRequest)
+		}
+	}
+
+	page, err := hdl.urlService.FindLinks(c.Request().Context(), target, match, offset)
+	if err != nil {
+		return hdl.handleShortenerServiceError(c, err)
+	}
+
+	return Respond(c, serviceTargetLinksToResponseDTO(target, match, offset, page), http.StatusOK)
+}
+
+// @Summary Getting clicks of links grouped by UTM campaign
+// @Produce  json
+// @Param   window query string false "Window duration, 168h by default"
+// @Param   limit query int false "Number of campaigns, 10 by default"
+// @Success 200 {object} CampaignsResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /statistics/campaigns [get]
+func (hdl *HTTPHandler) getCampaigns(c echo.Context) error {
+	window, limit := defaultCampaignsWindow, defaultTopLimit
+	var err error
+	if w := c.QueryParam("window"); w != "" {
+		if window, err = time.ParseDuration(w); err != nil {
+			return RespondError(c, err, http.StatusBadRequest)
+		}
+	}
+	if l := c.QueryParam("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil {
+			return RespondError(c, err, http.StatusBadRequest)
+		}
+	}
+
+	campaigns, err := hdl.urlService.Campaigns(c.Request().Context(), window, limit)
+	if err != nil {
+		return hdl.handleShortenerServiceError(c, err)
+	}
+
+	return Respond(c, serviceCampaignsToResponseDTO(window, campaigns), http.StatusOK)
+}
+
+// @Summary Getting the default UTM parameters of links with the tag
+// @Produce  json
+// @Param   tag path string true "Tag"
+// @Success 200 {object} UTM
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /tags/{tag}/utm [get]
+func (hdl *HTTPHandler) getUTMTemplate(c echo.Context) error {
+	utm, err := hdl.urlService.UTMTemplate(c.Request().Context(), c.Param("tag"))
+	if err != nil {
+		return hdl.handleShortenerServiceError(c, err)
+	}
+
+	return Respond(c, serviceUTMToResponseDTO(utm), http.StatusOK)
+}
+
+// @Summary Replacing the default UTM parameters of links with the tag
+// @Accept  json
+// @Param   tag path string true "Tag"
+// @Param   body body UTM true "UTM parameters, empty ones delete the template"
+// @Success 204
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /tags/{tag}/utm [put]
+func (hdl *HTTPHandler) putUTMTemplate(c echo.Context) error {
+	body := UTM{}
+	if err := c.Bind(&body); err != nil {
+		return RespondError(c, err, http.StatusBadRequest)
+	}
+
+	if err := hdl.urlService.SetUTMTemplate(c.Request().Context(), c.Param("tag"), requestUTMToServiceDTO(body)); err != nil {
+		return hdl.handleShortenerServiceError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// @Summary Streaming access events or daily rollups of a period
+// @Produce  text/csv
+// @Produce  application/x-ndjson
+// @Param   kind query string false "events (default) or rollups"
+// @Param   format query string false "csv (default) or ndjson"
+// @Param   from query string false "Beginning of the period, RFC 3339 or a date, a day before the end by default"
+// @Param   to query string false "End of the period, RFC 3339 or a date, now by default"
+// @Success 200 {string} string
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /statistics/export [get]
+func (hdl *HTTPHandler) exportStatistics(c echo.Context) error {
+	kind := c.QueryParam("kind")
+	if kind == "" {
+		kind = shortener.ExportEvents
+	}
+	format := c.QueryParam("format")
+	if format == "" {
+		format = export.CSV
+	}
+
+	q, err := export.Query(kind, c.QueryParam("from"), c.QueryParam("to"))
+	if err != nil {
+		return hdl.handleShortenerServiceError(c, err)
+	}
+
+	res := c.Response()
+	w, err := export.NewWriter(format, kind, res)
+	if err != nil {
+		return hdl.handleShortenerServiceError(c, err)
+	}
+
+	// An export of a long period takes longer than the server write timeout,
+	// it lasts until it's done or the client goes away.
+	if err := liftWriteTimeout(c); err != nil {
+		hdl.log.Err(err).Msg("export write deadline")
+	}
+
+	res.Header().Set(echo.HeaderContentType, export.ContentType(format))
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", kind+"."+format))
+	res.WriteHeader(http.StatusOK)
+
+	// The status is already sent, so errors can only be logged from here.
+	ctx := c.Request().Context()
+	if err := hdl.urlService.Export(ctx, q, w); err != nil {
+		if ctx.Err() != nil {
+			hdl.log.Info().Msg("export is interrupted by the client")
+			return nil
+		}
+		hdl.log.Err(err).Msg("export")
+		return nil
+	}
+
+	if err := w.Flush(); err != nil {
+		hdl.log.Err(err).Msg("export flush")
+	}
+	return nil
+}
+
+// @Summary Getting routing rules of a short URL
+// @Produce  json
+// @Param   key path string true "Short URL key"
+// @Success 200 {object} RoutesBody
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /links/{key}/routes [get]
+func (hdl *HTTPHandler) getRoutes(c echo.Context) error {
+	routes, err := hdl.urlService.Routes(c.Request().Context(), c.Param("key"))
+	if err != nil {
+		return hdl.handleShortenerServiceError(c, err)
+	}
+
+	return Respond(c, serviceRoutesToResponseDTO(routes), http.StatusOK)
+}
+
+// @Summary Replacing routing rules of a short URL
+// @Accept  json
+// @Produce  json
+// @Param   key path string true "Short URL key"
+// @Param   body body RoutesBody true "Routes evaluated in order, the first matching one wins"
+// @Success 200 {object} RoutesBody
+// @Failure 400 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /links/{key}/routes [put]
+func (hdl *HTTPHandler) putRoutes(c echo.Context) error {
+	body := RoutesBody{}
+	if err := c.Bind(&body); err != nil {
+		return RespondError(c, err, http.StatusBadRequest)
+	}
+
+	routes := requestRoutesToServiceDTO(body.Routes)
+	if err := hdl.urlService.SetRoutes(c.Request().Context(), c.Param("key"), routes); err != nil {
+		return hdl.handleShortenerServiceError(c, err)
+	}
+
+	return hdl.getRoutes(c)
+}
+
+// @Summary Getting localized destinations of a short URL
+// @Produce  json
+// @Param   key path string true "Short URL key"
+// @Success 200 {object} LanguagesBody
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /links/{key}/languages [get]
+func (hdl *HTTPHandler) getLanguages(c echo.Context) error {
+	localization, err := hdl.urlService.Languages(c.Request().Context(), c.Param("key"))
+	if err != nil {
+		return hdl.handleShortenerServiceError(c, err)
+	}
+
+	return Respond(c, serviceLanguagesToResponseDTO(localization), http.StatusOK)
+}
+
+// @Summary Replacing localized destinations of a short URL
+// @Accept  json
+// @Produce  json
+// @Param   key path string true "Short URL key"
+// @Param   body body LanguagesBody true "Destinations by BCP 47 language tags"
+// @Success 200 {object} LanguagesBody
+// @Failure 400 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /links/{key}/languages [put]
+func (hdl *HTTPHandler) putLanguages(c echo.Context) error {
+	body := LanguagesBody{}
+	if err := c.Bind(&body); err != nil {
+		return RespondError(c, err, http.StatusBadRequest)
+	}
+
+	localization := &shortener.Localization{Default: body.Default, Languages: requestLanguagesToServiceDTO(body.Languages)}
+	if err := hdl.urlService.SetLanguages(c.Request().Context(), c.Param("key"), localization); err != nil {
+		return hdl.handleShortenerServiceError(c, err)
+	}
+
+	return hdl.getLanguages(c)
+}
+
+// @Summary Getting the destination schedule of a short URL
+// @Produce  json
+// @Param   key path string true "Short URL key"
+// @Success 200 {object} ScheduleBody
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /links/{key}/schedule [get]
+func (hdl *HTTPHandler) getSchedule(c echo.Context) error {
+	schedule, err := hdl.urlService.Schedule(c.Request().Context(), c.Param("key"))
+	if err != nil {
+		return hdl.handleShortenerServiceError(c, err)
+	}
+
+	return Respond(c, serviceScheduleToResponseDTO(schedule), http.StatusOK)
+}
+
+// @Summary Replacing the destination schedule of a short URL
+// @Accept  json
+// @Produce  json
+// @Param   key path string true "Short URL key"
+// @Param   body body ScheduleBody true "Entries mustn't overlap"
+// @Success 200 {object} ScheduleBody
+// @Failure 400 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /links/{key}/schedule [put]
+func (hdl *HTTPHandler) putSchedule(c echo.Context) error {
+	body := ScheduleBody{}
+	if err := c.Bind(&body); err != nil {
+		return RespondError(c, err, http.StatusBadRequest)
+	}
+
+	schedule := requestScheduleToServiceDTO(body.Schedule)
+	if err := hdl.urlService.SetSchedule(c.Request().Context(), c.Param("key"), schedule); err != nil {
+		return hdl.handleShortenerServiceError(c, err)
+	}
+
+	return hdl.getSchedule(c)
+}
+
+// @Summary Recording a conversion of a click by a server-to-server postback
+// @Accept  json
+// @Param   body body ConversionRequest true "Click ID appended to the long URL"
+// @Success 204
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /conversions [post]
+func (hdl *HTTPHandler) postConversion(c echo.Context) error {
+	conversion := ConversionRequest{}
+	if err := c.Bind(&conversion); err != nil {
+		return RespondError(c, err, http.StatusBadRequest)
+	}
+
+	if err := hdl.urlService.Convert(c.Request().Context(), conversion.ClickID); err != nil {
+		return hdl.handleShortenerServiceError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// @Summary Recording a conversion of a click by a tracking pixel
+// @Produce  image/gif
+// @Param   click_id query string true "Click ID appended to the long URL"
+// @Success 200 {string} string
+// @Router /conversions/pixel.gif [get]
+func (hdl *HTTPHandler) conversionPixel(c echo.Context) error {
+	// The pixel is served anyway, so a page doesn't show a broken image.
+	if err := hdl.urlService.Convert(c.Request().Context(), c.QueryParam("click_id")); err != nil {
+		hdl.log.Info().Err(err).Msg("conversion pixel")
+	}
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.Blob(http.StatusOK, "image/gif", transparentPixel)
+}
+
+// @Summary Streaming clicks of a short URL as Server-Sent Events
+// @Produce  text/event-stream
+// @Param   key path string true "Short URL key"
+// @Success 200 {string} string
+// @Failure 503 {object} ErrorResponse
+// @Router /links/{key}/live [get]
+// @Router /live [get]
+func (hdl *HTTPHandler) streamClicks(c echo.Context) error {
+	sub, err := hdl.clicks.Subscribe(c.Param("key"))
+	if err != nil {
+		return RespondError(c, err, http.StatusServiceUnavailable)
+	}
+	defer hdl.clicks.Unsubscribe(sub)
+
+	// Streams last until the client goes away or the server shuts down.
+	if err := liftWriteTimeout(c); err != nil {
+		hdl.log.Err(err).Msg("live stream write deadline")
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	// EventSource clients reconnect after the retry delay if the stream breaks.
+	if _, err := fmt.Fprintf(res, "retry: %d\n\n", sseRetry.Milliseconds()); err != nil {
+		return nil
+	}
+	res.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	var dropped uint64
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+		case e, ok := <-sub.C:
+			if !ok {
+				return nil
+			}
+			if d := sub.Dropped(); d != dropped {
+				dropped = d
+				if err := writeEvent(res, "dropped", DroppedEventResponse{Dropped: d}); err != nil {
+					return nil
+				}
+			}
+			if err := writeEvent(res, "click", serviceClickToResponseDTO(e)); err != nil {
+				return nil
+			}
+		}
+		res.Flush()
+	}
+}
+
+func writeEvent(w io.Writer, event string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
+
+// setVariantCookie keeps the visitor on the chosen A/B variant.
+func setVariantCookie(c echo.Context, url *shortener.URL) {
+	if url.Variant == 0 {
+		return
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     variantCookiePrefix + url.Short,
+		Value:    strconv.Itoa(url.Variant),
+		Path:     "/",
+		MaxAge:   int(variantCookieMaxAge / time.Second),
+		HttpOnly: true,
+	})
+}
+
+// setCacheHeaders lets browsers reuse the redirect for maxAge since the resolution,
+// a zero one makes every click reach the server.
+func setCacheHeaders(c echo.Context, maxAge time.Duration, resolvedAt time.Time) {
+	h := c.Response().Header()
+	if maxAge <= 0 {
+		h.Set("Cache-Control", "private, no-cache, no-store, max-age=0")
+		h.Set("Expires", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+		return
+	}
+
+	h.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(maxAge/time.Second)))
+	h.Set("Expires", resolvedAt.Add(maxAge).UTC().Format(http.TimeFormat))
+}
+
+func visitorFromRequest(c echo.Context) *shortener.Visitor {
+	h := c.Request().Header
+	purpose := h.Get("Sec-Purpose")
+	if purpose == "" {
+		purpose = h.Get("Purpose")
+	}
+	if purpose == "" && h.Get("X-Moz") == "prefetch" {
+		purpose = "prefetch"
+	}
+
+	variants := make(map[string]int)
+	for _, cookie := range c.Cookies() {
+		if !strings.HasPrefix(cookie.Name, variantCookiePrefix) {
+			continue
+		}
+		if n, err := strconv.Atoi(cookie.Value); err == nil {
+			variants[strings.TrimPrefix(cookie.Name, variantCookiePrefix)] = n
+		}
+	}
+
+	return &shortener.Visitor{
+		IP:             c.RealIP(),
+		UserAgent:      c.Request().UserAgent(),
+		Purpose:        purpose,
+		AcceptLanguage: h.Get("Accept-Language"),
+		Variants:       variants,
+	}
+}
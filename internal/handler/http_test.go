@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"github.com/kalinink/simple-url-shortener/internal/clickstream"
+	"github.com/kalinink/simple-url-shortener/internal/shortener"
+	"github.com/rs/zerolog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeService resolves every short URL to url, the rest of the service isn't used.
+type fakeService struct {
+	shortener.URLShortenerService
+	url      shortener.URL
+	resolved []string
+}
+
+func (s *fakeService) GetLongURL(ctx context.Context, shortURL string, visitor *shortener.Visitor) (*shortener.URL, error) {
+	s.resolved = append(s.resolved, shortURL)
+	u := s.url
+	return &u, nil
+}
+
+func newTestHandler(url shortener.URL) (*HTTPHandler, *fakeService) {
+	service := &fakeService{url: url}
+	log := zerolog.New(nil).With().Logger()
+	return NewHTTPHandler(service, nil, &log), service
+}
+
+func TestHTTPHandler_Redirect(t *testing.T) {
+	resolvedAt := time.Date(2020, 11, 10, 12, 0, 0, 0, time.UTC)
+	hour, zero := time.Hour, time.Duration(0)
+
+	cases := []struct {
+		name         string
+		status       int
+		maxAge       *time.Duration
+		cacheControl string
+		expires      string
+	}{
+		{
+			name:         "cached",
+			status:       http.StatusMovedPermanently,
+			maxAge:       &hour,
+			cacheControl: "private, max-age=3600",
+			expires:      "Tue, 10 Nov 2020 13:00:00 GMT",
+		},
+		{
+			name:         "not cached",
+			status:       http.StatusFound,
+			maxAge:       &zero,
+			cacheControl: "private, no-cache, no-store, max-age=0",
+			expires:      "Thu, 01 Jan 1970 00:00:00 GMT",
+		},
+	}
+	for _, c := range cases {
+		hdl, _ := newTestHandler(shortener.URL{
+			Long:        "https://example.org/article",
+			ResolvedAt:  resolvedAt,
+			LinkOptions: shortener.LinkOptions{RedirectStatus: c.status, CacheMaxAge: c.maxAge},
+		})
+
+		rec := httptest.NewRecorder()
+		hdl.e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/4bd1f2e8a6c3", nil))
+
+		if rec.Code != c.status {
+			t.Errorf("[%s] want status %d, got %d", c.name, c.status, rec.Code)
+		}
+		if got := rec.Header().Get("Location"); got != "https://example.org/article" {
+			t.Errorf("[%s] want a redirect to the long url, got %q", c.name, got)
+		}
+		if got := rec.Header().Get("Cache-Control"); got != c.cacheControl {
+			t.Errorf("[%s] want Cache-Control %q, got %q", c.name, c.cacheControl, got)
+		}
+		if got := rec.Header().Get("Expires"); got != c.expires {
+			t.Errorf("[%s] want Expires %q, got %q", c.name, c.expires, got)
+		}
+	}
+}
+
+func TestHTTPHandler_NotShortURLs(t *testing.T) {
+	hdl, service := newTestHandler(shortener.URL{})
+
+	for _, path := range []string{"/favicon.ico", "/robots.txt"} {
+		rec := httptest.NewRecorder()
+		hdl.e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("[%s] want status %d, got %d", path, http.StatusNotFound, rec.Code)
+		}
+	}
+	if len(service.resolved) != 0 {
+		t.Errorf("want no short urls resolved, got %v", service.resolved)
+	}
+}
+
+func TestHTTPHandler_StreamClicks(t *testing.T) {
+	clicks := clickstream.NewBroker(8, clickstream.DropOldest)
+	defer clicks.Close()
+	log := zerolog.New(nil).With().Logger()
+	hdl := NewHTTPHandler(&fakeService{}, clicks, &log)
+
+	const writeTimeout = 100 * time.Millisecond
+	srv := httptest.NewUnstartedServer(hdl.e)
+	srv.Config.WriteTimeout = writeTimeout
+	srv.Config.ConnContext = withConn
+	srv.Start()
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/links/4bd1f2e8a6c3/live")
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	defer res.Body.Close()
+
+	time.Sleep(3 * writeTimeout)
+	clicks.Publish(&shortener.ClickEvent{Key: "4bd1f2e8a6c3", Long: "https://example.org/", At: time.Now()})
+
+	events := bufio.NewScanner(res.Body)
+	for events.Scan() {
+		if events.Text() == "event: click" {
+			return
+		}
+	}
+	t.Errorf("want a click after the write timeout, the stream ended with %v", events.Err())
+}
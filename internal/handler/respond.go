@@ -7,14 +7,17 @@ import (
 	"time"
 )
 
-const layout = "2006-01-02 15:04:05"
+const (
+	layout    = "2006-01-02 15:04:05"
+	dayLayout = "2006-01-02"
+)
 
 func RespondError(c echo.Context, err error, status int) error {
 	if echoErr, ok := err.(*echo.HTTPError); ok {
 		err = echoErr.Internal
 	}
 
-	return respond(c, ErrorResponse{err.Error()}, status)
+	return respond(c, ErrorResponse{Error: err.Error()}, status)
 }
 
 func Respond(c echo.Context, data interface{}, status int) error {
@@ -30,10 +33,12 @@ func respond(c echo.Context, data interface{}, status int) error {
 
 type ErrorResponse struct {
 	Error string `json:"error"`
+	// Code tells apart errors with the same status, e.g. destination_denied.
+	Code string `json:"code,omitempty"`
 } // @name Error
 
 func RespondInternalError(c echo.Context) error {
-	return respond(c, ErrorResponse{"internal server error"}, http.StatusInternalServerError)
+	return respond(c, ErrorResponse{Error: "internal server error"}, http.StatusInternalServerError)
 }
 
 func (hdl *HTTPHandler) handleShortenerServiceError(c echo.Context, err error) error {
@@ -44,22 +49,192 @@ func (hdl *HTTPHandler) handleShortenerServiceError(c echo.Context, err error) e
 	}
 
 	hdl.log.Err(sErr.Origin).Msg("")
-	return RespondError(c, sErr, serviceErrorToHTTPError[sErr.Type])
+	return respond(c, ErrorResponse{Error: sErr.Error(), Code: sErr.Code}, serviceErrorToHTTPError[sErr.Type])
 }
 
 var serviceErrorToHTTPError = map[int]int{
 	shortener.NotFoundErrType:  http.StatusNotFound,
 	shortener.BadParamsErrType: http.StatusBadRequest,
+	shortener.ForbiddenErrType: http.StatusForbidden,
 }
 
 type URLResponse struct {
 	URL string `json:"url"`
+	// DeepLink opens the app of the visitor, URL is the fallback if it isn't installed.
+	DeepLink string `json:"deep_link,omitempty"`
 } // @name Response
 
+type CreatedURLResponse struct {
+	URL string `json:"url" example:"http://example.com/4bd1f2e8a6c3"`
+	// DisplayURL is the long URL with an internationalized host in the Unicode form.
+	DisplayURL string `json:"display_url" example:"https://пример.рф/article"`
+	// MixedScriptHost warns that the host of the long URL mixes scripts like a lookalike domain.
+	MixedScriptHost bool `json:"mixed_script_host,omitempty" example:"false"`
+} // @name CreatedURL
+
 type URLRequest struct {
 	URL string `json:"url"`
 } // @name Request
 
+type CreateURLRequest struct {
+	URL string `json:"url"`
+	// IgnoreBotAccess keeps bots and prefetches from extending the link life.
+	IgnoreBotAccess bool     `json:"ignore_bot_access"`
+	Tags            []string `json:"tags" example:"promo,newsletter"`
+	// TrackConversions appends a click ID to the long URL on resolution.
+	TrackConversions bool    `json:"track_conversions"`
+	Routes           []Route `json:"routes"`
+	// Variants split visitors that don't match any route across destinations by weight.
+	Variants []Variant `json:"variants"`
+	// Schedule changes the destination over time.
+	Schedule []ScheduleEntry `json:"schedule"`
+	// Fallbacks replace the origin in order while it fails health checks.
+	Fallbacks []string `json:"fallbacks" example:"https://mirror.example.org/article"`
+	// Languages are localized destinations negotiated by the Accept-Language header
+	// along with DefaultLanguage, the BCP 47 tag of the url. It's required with languages.
+	DefaultLanguage string                `json:"default_language" example:"en"`
+	Languages       []LanguageDestination `json:"languages"`
+	// PassPath appends the path after the key to the destination, e.g. /{key}/api/v2.
+	PassPath bool `json:"pass_path"`
+	// PassQuery merges the query of the short URL into the destination one.
+	PassQuery bool `json:"pass_query"`
+	// RedirectStatus is 301, 302, 307 or 308, the server default if omitted.
+	RedirectStatus int `json:"redirect_status" example:"307"`
+	// CacheMaxAge is how long browsers may cache the redirect in seconds,
+	// the server default if omitted and no caching if 0.
+	CacheMaxAge *int `json:"cache_max_age" example:"0"`
+	// UTM parameters are merged into the query of the url, templates of the tags fill the missing ones.
+	UTM UTM `json:"utm"`
+} // @name CreateRequest
+
+type UTM struct {
+	Source   string `json:"source,omitempty" example:"newsletter"`
+	Medium   string `json:"medium,omitempty" example:"email"`
+	Campaign string `json:"campaign,omitempty" example:"black_friday"`
+	Term     string `json:"term,omitempty"`
+	Content  string `json:"content,omitempty"`
+} // @name UTM
+
+func requestUTMToServiceDTO(u UTM) shortener.UTM {
+	return shortener.UTM{Source: u.Source, Medium: u.Medium, Campaign: u.Campaign, Term: u.Term, Content: u.Content}
+}
+
+func serviceUTMToResponseDTO(u *shortener.UTM) *UTM {
+	return &UTM{Source: u.Source, Medium: u.Medium, Campaign: u.Campaign, Term: u.Term, Content: u.Content}
+}
+
+type Variant struct {
+	Destination string `json:"destination" example:"https://example.org/landing-b"`
+	Weight      int    `json:"weight" example:"30"`
+} // @name Variant
+
+func requestVariantsToServiceDTO(variants []Variant) []shortener.Variant {
+	res := make([]shortener.Variant, 0, len(variants))
+	for _, v := range variants {
+		res = append(res, shortener.Variant{Destination: v.Destination, Weight: v.Weight})
+	}
+	return res
+}
+
+type RoutesBody struct {
+	Routes []Route `json:"routes"`
+} // @name Routes
+
+// Route matches an "os" (ios, android, windows, macos, chromeos, linux),
+// a "device" (mobile, tablet, desktop), a "country" (ISO 3166-1 alpha-2, e.g. "de")
+// or a "region" (ISO 3166-2, e.g. "us-ca") of a visitor. A deep link opens the app
+// and falls back to the destination, or to the link itself without a destination.
+type Route struct {
+	Kind        string `json:"kind" example:"os"`
+	Match       string `json:"match" example:"ios"`
+	Destination string `json:"destination,omitempty" example:"https://apps.apple.com/app/id000000000"`
+	DeepLink    string `json:"deep_link,omitempty" example:"example://product/1"`
+} // @name Route
+
+func requestRoutesToServiceDTO(routes []Route) []shortener.Route {
+	res := make([]shortener.Route, 0, len(routes))
+	for _, r := range routes {
+		res = append(res, shortener.Route{Kind: r.Kind, Match: r.Match, Destination: r.Destination, DeepLink: r.DeepLink})
+	}
+	return res
+}
+
+func serviceRoutesToResponseDTO(routes []shortener.Route) *RoutesBody {
+	res := make([]Route, 0, len(routes))
+	for _, r := range routes {
+		res = append(res, Route{Kind: r.Kind, Match: r.Match, Destination: r.Destination, DeepLink: r.DeepLink})
+	}
+	return &RoutesBody{Routes: res}
+}
+
+type LanguagesBody struct {
+	// Default is the BCP 47 tag of the long URL, it's required with languages.
+	Default   string                `json:"default" example:"en"`
+	Languages []LanguageDestination `json:"languages"`
+} // @name Languages
+
+type LanguageDestination struct {
+	// Tag is a BCP 47 language tag.
+	Tag         string `json:"tag" example:"pt-BR"`
+	Destination string `json:"destination" example:"https://example.org/pt-br/docs"`
+} // @name LanguageDestination
+
+func requestLanguagesToServiceDTO(languages []LanguageDestination) []shortener.LanguageDestination {
+	res := make([]shortener.LanguageDestination, 0, len(languages))
+	for _, l := range languages {
+		res = append(res, shortener.LanguageDestination{Tag: l.Tag, Destination: l.Destination})
+	}
+	return res
+}
+
+func serviceLanguagesToResponseDTO(localization *shortener.Localization) *LanguagesBody {
+	res := make([]LanguageDestination, 0, len(localization.Languages))
+	for _, l := range localization.Languages {
+		res = append(res, LanguageDestination{Tag: l.Tag, Destination: l.Destination})
+	}
+	return &LanguagesBody{Default: localization.Default, Languages: res}
+}
+
+type ScheduleBody struct {
+	Schedule []ScheduleEntry `json:"schedule"`
+} // @name Schedule
+
+// ScheduleEntry is active from start until end, or until the start of the next entry if end is omitted.
+type ScheduleEntry struct {
+	Start       time.Time  `json:"start" example:"2020-12-01T18:00:00Z"`
+	End         *time.Time `json:"end,omitempty" example:"2020-12-01T20:00:00Z"`
+	Destination string     `json:"destination" example:"https://example.org/livestream"`
+} // @name ScheduleEntry
+
+func requestScheduleToServiceDTO(schedule []ScheduleEntry) []shortener.ScheduleEntry {
+	res := make([]shortener.ScheduleEntry, 0, len(schedule))
+	for _, e := range schedule {
+		entry := shortener.ScheduleEntry{Start: e.Start, Destination: e.Destination}
+		if e.End != nil {
+			entry.End = *e.End
+		}
+		res = append(res, entry)
+	}
+	return res
+}
+
+func serviceScheduleToResponseDTO(schedule []shortener.ScheduleEntry) *ScheduleBody {
+	res := make([]ScheduleEntry, 0, len(schedule))
+	for _, e := range schedule {
+		entry := ScheduleEntry{Start: e.Start, Destination: e.Destination}
+		if !e.End.IsZero() {
+			end := e.End
+			entry.End = &end
+		}
+		res = append(res, entry)
+	}
+	return &ScheduleBody{Schedule: res}
+}
+
+type ConversionRequest struct {
+	ClickID string `json:"click_id" example:"9f86d081884c7d659a2feaa0c55ad015"`
+} // @name ConversionRequest
+
 type StatisticResponse struct {
 	Counts  CountStatistics  `json:"counts"`
 	Timings TimingStatistics `json:"timings"`
@@ -88,6 +263,241 @@ func serviceStatToResponseDTO(s *shortener.OverallStatistics) *StatisticResponse
 	}
 }
 
+type StatisticV2Response struct {
+	Version int                       `json:"version" example:"2"`
+	Counts  CountStatistics           `json:"counts"`
+	Clicks  ClickDistributionResponse `json:"clicks"`
+} // @name StatisticsV2
+
+type ClickDistributionResponse struct {
+	// ByHour has 24 items for UTC hours of the day, ByWeekday has 7 items starting from Sunday.
+	ByHour            []int               `json:"by_hour"`
+	ByWeekday         []int               `json:"by_weekday"`
+	LinkAgeSeconds    PercentilesResponse `json:"link_age_seconds"`
+	InterClickSeconds PercentilesResponse `json:"inter_click_seconds"`
+} // @name ClickDistribution
+
+type PercentilesResponse struct {
+	P50 float64 `json:"p50" example:"3600"`
+	P90 float64 `json:"p90" example:"43200"`
+	P99 float64 `json:"p99" example:"82800"`
+} // @name Percentiles
+
+func serviceStatV2ToResponseDTO(s *shortener.DetailedStatistics) *StatisticV2Response {
+	return &StatisticV2Response{
+		Version: 2,
+		Counts: CountStatistics{
+			Long:  s.LongURL.Count,
+			Short: s.ShortURL.Count,
+		},
+		Clicks: ClickDistributionResponse{
+			ByHour:            s.Clicks.ByHour[:],
+			ByWeekday:         s.Clicks.ByWeekday[:],
+			LinkAgeSeconds:    percentilesToResponseDTO(s.Clicks.LinkAge),
+			InterClickSeconds: percentilesToResponseDTO(s.Clicks.InterClick),
+		},
+	}
+}
+
+func percentilesToResponseDTO(p shortener.Percentiles) PercentilesResponse {
+	return PercentilesResponse{
+		P50: p.P50.Seconds(),
+		P90: p.P90.Seconds(),
+		P99: p.P99.Seconds(),
+	}
+}
+
+type LinkStatisticResponse struct {
+	Key            string                `json:"key" example:"4bd1f2e8a6c3"`
+	Clicks         int                   `json:"clicks" example:"12"`
+	BotClicks      int                   `json:"bot_clicks" example:"4"`
+	Uniques        uint64                `json:"uniques" example:"7"`
+	Conversions    int                   `json:"conversions" example:"3"`
+	ConversionRate float64               `json:"conversion_rate" example:"0.25"`
+	Daily          []DailyStatisticsItem `json:"daily"`
+	Variants       []VariantStatistics   `json:"variants"`
+} // @name LinkStatistics
+
+type VariantStatistics struct {
+	Variant     int    `json:"variant" example:"2"`
+	Destination string `json:"destination" example:"https://example.org/landing-b"`
+	Clicks      int    `json:"clicks" example:"5"`
+} // @name VariantStatistics
+
+type DailyStatisticsItem struct {
+	Day         string `json:"day" example:"2020-11-10"`
+	Clicks      int    `json:"clicks" example:"3"`
+	BotClicks   int    `json:"bot_clicks" example:"1"`
+	Uniques     uint64 `json:"uniques" example:"2"`
+	Conversions int    `json:"conversions" example:"1"`
+} // @name DailyStatistics
+
+func serviceLinkStatToResponseDTO(s *shortener.LinkStatistics) *LinkStatisticResponse {
+	daily := make([]DailyStatisticsItem, 0, len(s.Daily))
+	for _, d := range s.Daily {
+		daily = append(daily, DailyStatisticsItem{
+			Day:         d.Day.Format(dayLayout),
+			Clicks:      d.Clicks,
+			BotClicks:   d.BotClicks,
+			Uniques:     d.Uniques,
+			Conversions: d.Conversions,
+		})
+	}
+
+	variants := make([]VariantStatistics, 0, len(s.Variants))
+	for _, v := range s.Variants {
+		variants = append(variants, VariantStatistics{Variant: v.Variant, Destination: v.Destination, Clicks: v.Clicks})
+	}
+
+	return &LinkStatisticResponse{
+		Key:            s.ShortURL,
+		Clicks:         s.Clicks,
+		BotClicks:      s.BotClicks,
+		Uniques:        s.Uniques,
+		Conversions:    s.Conversions,
+		ConversionRate: s.ConversionRate,
+		Daily:          daily,
+		Variants:       variants,
+	}
+}
+
+type TopLinksResponse struct {
+	Mode   string            `json:"mode" example:"trending"`
+	Window string            `json:"window" example:"24h0m0s"`
+	Links  []TopLinkResponse `json:"links"`
+} // @name TopLinks
+
+type TopLinkResponse struct {
+	Short          string  `json:"short" example:"http://example.com/4bd1f2e8a6c3"`
+	Long           string  `json:"long" example:"https://example.org/article"`
+	Clicks         int     `json:"clicks" example:"40"`
+	PreviousClicks int     `json:"previous_clicks" example:"10"`
+	Growth         float64 `json:"growth" example:"3"`
+} // @name TopLink
+
+func serviceTopToResponseDTO(q shortener.TopQuery, top []shortener.TopLink) *TopLinksResponse {
+	links := make([]TopLinkResponse, 0, len(top))
+	for _, l := range top {
+		links = append(links, TopLinkResponse{
+			Short:          l.Short,
+			Long:           l.Long,
+			Clicks:         l.Clicks,
+			PreviousClicks: l.PreviousClicks,
+			Growth:         l.Growth,
+		})
+	}
+
+	return &TopLinksResponse{Mode: q.Mode, Window: q.Window.String(), Links: links}
+}
+
+type TopMissesResponse struct {
+	Event  string              `json:"event" example:"not_found"`
+	Window string              `json:"window" example:"168h0m0s"`
+	Keys   []MissCountResponse `json:"keys"`
+} // @name TopMisses
+
+type MissCountResponse struct {
+	Key      string `json:"key" example:"4bd1f2e8a6c3"`
+	Count    int    `json:"count" example:"17"`
+	LastSeen string `json:"last_seen" example:"2020-11-10 12:00:05"`
+} // @name MissCount
+
+func serviceMissesToResponseDTO(event string, window time.Duration, misses []shortener.MissCount) *TopMissesResponse {
+	keys := make([]MissCountResponse, 0, len(misses))
+	for _, m := range misses {
+		keys = append(keys, MissCountResponse{
+			Key:      m.Key,
+			Count:    m.Count,
+			LastSeen: formatTime(&m.LastSeen, layout),
+		})
+	}
+
+	return &TopMissesResponse{Event: event, Window: window.String(), Keys: keys}
+}
+
+type CampaignsResponse struct {
+	Window    string                      `json:"window" example:"168h0m0s"`
+	Campaigns []CampaignStatisticResponse `json:"campaigns"`
+} // @name Campaigns
+
+type CampaignStatisticResponse struct {
+	Source   string `json:"source" example:"newsletter"`
+	Medium   string `json:"medium" example:"email"`
+	Campaign string `json:"campaign" example:"black_friday"`
+	Links    int    `json:"links" example:"3"`
+	Clicks   int    `json:"clicks" example:"120"`
+} // @name CampaignStatistics
+
+func serviceCampaignsToResponseDTO(window time.Duration, stat []shortener.CampaignStatistics) *CampaignsResponse {
+	campaigns := make([]CampaignStatisticResponse, 0, len(stat))
+	for _, c := range stat {
+		campaigns = append(campaigns, CampaignStatisticResponse{
+			Source:   c.Source,
+			Medium:   c.Medium,
+			Campaign: c.Campaign,
+			Links:    c.Links,
+			Clicks:   c.Clicks,
+		})
+	}
+
+	return &CampaignsResponse{Window: window.String(), Campaigns: campaigns}
+}
+
+type TargetLinksResponse struct {
+	Target string               `json:"target" example:"https://example.org/article"`
+	Match  string               `json:"match" example:"exact"`
+	Offset int                  `json:"offset" example:"0"`
+	Links  []TargetLinkResponse `json:"links"`
+	// Truncated is set if there are more links, the next page starts at offset plus the number of links.
+	Truncated bool `json:"truncated" example:"false"`
+} // @name TargetLinks
+
+type TargetLinkResponse struct {
+	ShortURL   string `json:"short_url" example:"http://example.com/4bd1f2e8a6c3"`
+	URL        string `json:"url" example:"https://example.org/article?utm_source=newsletter"`
+	DisplayURL string `json:"display_url" example:"https://example.org/article?utm_source=newsletter"`
+	CreatedAt  string `json:"created_at" example:"2020-11-10 12:00:05"`
+	LastAccess string `json:"last_access" example:"2020-11-12 08:30:00"`
+	Expired    bool   `json:"expired" example:"false"`
+} // @name TargetLink
+
+func serviceTargetLinksToResponseDTO(target, match string, offset int, page *shortener.TargetLinks) *TargetLinksResponse {
+	resp := make([]TargetLinkResponse, 0, len(page.Links))
+	for _, l := range page.Links {
+		resp = append(resp, TargetLinkResponse{
+			ShortURL:   l.Short,
+			URL:        l.Long,
+			DisplayURL: l.Display,
+			CreatedAt:  formatTime(&l.CreatedAt, layout),
+			LastAccess: formatTime(l.LastAccess, layout),
+			Expired:    l.Expired,
+		})
+	}
+
+	return &TargetLinksResponse{Target: target, Match: match, Offset: offset, Links: resp, Truncated: page.Truncated}
+}
+
+type ClickEventResponse struct {
+	Key     string `json:"key" example:"4bd1f2e8a6c3"`
+	URL     string `json:"url" example:"https://example.org/article"`
+	HitKind string `json:"hit_kind" example:"human"`
+	At      string `json:"at" example:"2020-11-10T12:00:05Z"`
+} // @name ClickEvent
+
+// DroppedEventResponse is sent before a click if a slow client missed some of the previous ones.
+type DroppedEventResponse struct {
+	Dropped uint64 `json:"dropped" example:"12"`
+} // @name DroppedEvent
+
+func serviceClickToResponseDTO(e *shortener.ClickEvent) *ClickEventResponse {
+	return &ClickEventResponse{
+		Key:     e.Key,
+		URL:     e.Long,
+		HitKind: e.HitKind,
+		At:      e.At.Format(time.RFC3339),
+	}
+}
+
 func formatTime(t *time.Time, layout string) string {
 	if t == nil {
 		return ""
@@ -0,0 +1,175 @@
+// Package healthcheck probes destinations of links with fallbacks and records
+// whether they answer, so resolution can skip the broken ones.
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"github.com/kalinink/simple-url-shortener/internal/shortener"
+	"github.com/rs/zerolog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	userAgent    = "simple-url-shortener-healthcheck"
+	maxRedirects = 5
+)
+
+// Store provides the destinations to probe and keeps their health,
+// it is implemented by the repository.
+type Store interface {
+	HealthCheckTargets(context.Context) ([]string, error)
+	SetHealth(context.Context, *shortener.DestinationHealth) error
+}
+
+type Config struct {
+	// Interval is how often all destinations are probed.
+	Interval time.Duration
+	// Timeout limits a single probe, a destination that doesn't answer in time is unhealthy.
+	Timeout time.Duration
+	// Concurrency is the number of destinations probed at once.
+	Concurrency int
+	// AllowInternal allows probes of private, loopback and other internal addresses,
+	// they fail otherwise, as do redirects to them.
+	AllowInternal bool
+}
+
+type Checker struct {
+	cfg    Config
+	store  Store
+	client *http.Client
+	log    *zerolog.Logger
+	now    func() time.Time
+}
+
+func NewChecker(store Store, cfg Config, log *zerolog.Logger) *Checker {
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+
+	return &Checker{
+		cfg:    cfg,
+		store:  store,
+		client: newClient(cfg),
+		log:    log,
+		now:    time.Now,
+	}
+}
+
+// newClient checks the address of every connection, so neither a destination
+// nor any hop of its redirects reaches an internal address, whatever its host
+// name resolves to at the moment.
+func newClient(cfg Config) *http.Client {
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	if !cfg.AllowInternal {
+		shortener.GuardDialer(dialer)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would be dialed instead of the destination.
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   cfg.Timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to the %q scheme", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// Run probes destinations every Interval until ctx is canceled.
+func (c *Checker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.CheckAll(ctx); err != nil {
+				c.log.Err(err).Msg("destinations health check")
+			}
+		}
+	}
+}
+
+// CheckAll probes every destination once and records the results.
+func (c *Checker) CheckAll(ctx context.Context) error {
+	targets, err := c.store.HealthCheckTargets(ctx)
+	if err != nil {
+		return err
+	}
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < c.cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range queue {
+				health := c.Check(ctx, target)
+				if err := c.store.SetHealth(ctx, health); err != nil {
+					c.log.Err(err).Msgf("recording health of %s", target)
+				}
+			}
+		}()
+	}
+
+	for _, target := range targets {
+		select {
+		case queue <- target:
+		case <-ctx.Done():
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+// Check probes the destination with a GET request, it's healthy if it
+// answers in time with a status below 500.
+func (c *Checker) Check(ctx context.Context, destination string) *shortener.DestinationHealth {
+	health := &shortener.DestinationHealth{URL: destination, CheckedAt: c.now()}
+
+	status, err := c.probe(ctx, destination)
+	health.StatusCode = status
+	switch {
+	case err != nil:
+		health.Error = err.Error()
+	case status >= http.StatusInternalServerError:
+		health.Error = fmt.Sprintf("responded with %d", status)
+	default:
+		health.Healthy = true
+	}
+
+	return health
+}
+
+func (c *Checker) probe(ctx context.Context, destination string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, destination, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
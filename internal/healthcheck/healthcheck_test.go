@@ -0,0 +1,121 @@
+package healthcheck
+
+import (
+	"context"
+	"github.com/kalinink/simple-url-shortener/internal/shortener"
+	"github.com/rs/zerolog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeStore struct {
+	targets []string
+
+	mu     sync.Mutex
+	health map[string]*shortener.DestinationHealth
+}
+
+func (s *fakeStore) HealthCheckTargets(ctx context.Context) ([]string, error) {
+	return s.targets, nil
+}
+
+func (s *fakeStore) SetHealth(ctx context.Context, h *shortener.DestinationHealth) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.health[h.URL] = h
+	return nil
+}
+
+func newTestServer(t *testing.T, handler http.HandlerFunc) string {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestChecker_CheckAll(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+
+	ok := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.UserAgent() != userAgent {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	notFound := newTestServer(t, http.NotFound)
+	unavailable := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	redirectToUnavailable := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, unavailable, http.StatusFound)
+	})
+	slow := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hang:
+		case <-r.Context().Done():
+		}
+	})
+	// Nothing listens on the address of a closed server.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	store := &fakeStore{
+		targets: []string{ok, notFound, unavailable, redirectToUnavailable, slow, closed.URL},
+		health:  make(map[string]*shortener.DestinationHealth),
+	}
+	log := zerolog.New(nil).With().Logger()
+	checker := NewChecker(store, Config{Interval: time.Minute, Timeout: 200 * time.Millisecond, Concurrency: 3, AllowInternal: true}, &log)
+	now := time.Date(2020, 12, 1, 12, 0, 0, 0, time.UTC)
+	checker.now = func() time.Time { return now }
+
+	if err := checker.CheckAll(context.Background()); err != nil {
+		t.Fatalf("check all: %v", err)
+	}
+
+	cases := []struct {
+		url     string
+		healthy bool
+		status  int
+	}{
+		{url: ok, healthy: true, status: http.StatusOK},
+		{url: notFound, healthy: true, status: http.StatusNotFound},
+		{url: unavailable, healthy: false, status: http.StatusServiceUnavailable},
+		{url: redirectToUnavailable, healthy: false, status: http.StatusServiceUnavailable},
+		{url: slow, healthy: false},
+		{url: closed.URL, healthy: false},
+	}
+	for _, c := range cases {
+		h := store.health[c.url]
+		if h == nil {
+			t.Fatalf("[%s] health wasn't recorded", c.url)
+		}
+		if h.Healthy != c.healthy || h.StatusCode != c.status || !h.CheckedAt.Equal(now) {
+			t.Errorf("[%s] want healthy %v with status %d, got %+v", c.url, c.healthy, c.status, h)
+		}
+		if !h.Healthy && h.Error == "" {
+			t.Errorf("[%s] want the reason of the failure", c.url)
+		}
+	}
+}
+
+func TestChecker_Internal(t *testing.T) {
+	var loop string
+	loop = newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, loop, http.StatusFound)
+	})
+	ok := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	log := zerolog.New(nil).With().Logger()
+	checker := NewChecker(&fakeStore{}, Config{Timeout: time.Second}, &log)
+	if h := checker.Check(context.Background(), ok); h.Healthy || !strings.Contains(h.Error, shortener.ErrInternalAddress.Error()) {
+		t.Errorf("want probes of internal addresses refused, got %+v", h)
+	}
+
+	internal := NewChecker(&fakeStore{}, Config{Timeout: time.Second, AllowInternal: true}, &log)
+	if h := internal.Check(context.Background(), loop); h.Healthy || !strings.Contains(h.Error, "redirects") {
+		t.Errorf("want a redirect loop stopped, got %+v", h)
+	}
+}
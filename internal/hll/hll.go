@@ -0,0 +1,89 @@
+// Package hll implements a HyperLogLog sketch for approximate counting of
+// distinct values. Sketches have a fixed binary layout so they can be stored
+// as-is and merged later, e.g. to combine daily sketches into a monthly one.
+package hll
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+)
+
+const (
+	// Precision is the number of hash bits used to select a register.
+	Precision = 12
+	// Size is the number of registers, which is also the length of the binary form.
+	Size = 1 << Precision
+)
+
+var ErrInvalidSize = errors.New("hll: invalid sketch size")
+
+type Sketch struct {
+	registers []uint8
+}
+
+func New() *Sketch {
+	return &Sketch{registers: make([]uint8, Size)}
+}
+
+// FromBytes restores a sketch from its binary form. The slice is copied.
+func FromBytes(b []byte) (*Sketch, error) {
+	if len(b) != Size {
+		return nil, ErrInvalidSize
+	}
+	s := New()
+	copy(s.registers, b)
+	return s, nil
+}
+
+func (s *Sketch) Bytes() []byte {
+	b := make([]byte, Size)
+	copy(b, s.registers)
+	return b
+}
+
+// Position returns the register index and the rank a hash updates.
+// It is exported so storage can apply the update in place.
+func Position(hash uint64) (index int, rank uint8) {
+	index = int(hash >> (64 - Precision))
+	w := hash<<Precision | 1<<(Precision-1)
+	rank = uint8(bits.LeadingZeros64(w) + 1)
+	return index, rank
+}
+
+func (s *Sketch) Add(hash uint64) {
+	i, r := Position(hash)
+	if r > s.registers[i] {
+		s.registers[i] = r
+	}
+}
+
+func (s *Sketch) Merge(other *Sketch) {
+	for i, r := range other.registers {
+		if r > s.registers[i] {
+			s.registers[i] = r
+		}
+	}
+}
+
+// Estimate returns the approximate number of distinct hashes added to the sketch.
+func (s *Sketch) Estimate() uint64 {
+	m := float64(Size)
+	alpha := 0.7213 / (1 + 1.079/m)
+
+	var sum float64
+	var zeros int
+	for _, r := range s.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(estimate + 0.5)
+}
@@ -0,0 +1,48 @@
+package hll
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func hash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func TestSketch_Estimate(t *testing.T) {
+	cases := []int{0, 1, 10, 1000, 50000}
+	for _, n := range cases {
+		s := New()
+		for i := 0; i < n; i++ {
+			s.Add(hash(strconv.Itoa(i)))
+			s.Add(hash(strconv.Itoa(i)))
+		}
+
+		got := float64(s.Estimate())
+		if diff := math.Abs(got - float64(n)); diff > 0.05*float64(n)+1 {
+			t.Errorf("n=%d: estimate %v is too far from the real value", n, got)
+		}
+	}
+}
+
+func TestSketch_Merge(t *testing.T) {
+	a, b := New(), New()
+	for i := 0; i < 1000; i++ {
+		a.Add(hash(strconv.Itoa(i)))
+		b.Add(hash(strconv.Itoa(i + 500)))
+	}
+
+	restored, err := FromBytes(a.Bytes())
+	if err != nil {
+		t.Fatalf("restore sketch: %v", err)
+	}
+	restored.Merge(b)
+
+	if got := float64(restored.Estimate()); math.Abs(got-1500) > 75 {
+		t.Errorf("merged estimate %v is too far from 1500", got)
+	}
+}
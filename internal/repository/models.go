@@ -1,6 +1,9 @@
 package repository
 
-import "time"
+import (
+	"github.com/lib/pq"
+	"time"
+)
 
 type URLs struct {
 	ShortURL   string     `db:"short_url"`
@@ -8,6 +11,37 @@ type URLs struct {
 	CreatedAt  time.Time  `db:"created_at"`
 	LastAccess *time.Time `db:"last_access"`
 	IsExpired  bool       `db:"is_expired"`
+	// IgnoreBotAccess keeps bot hits from updating LastAccess.
+	IgnoreBotAccess  bool           `db:"ignore_bot_access"`
+	Tags             pq.StringArray `db:"tags"`
+	TrackConversions bool           `db:"track_conversions"`
+	PassPath         bool           `db:"pass_path"`
+	PassQuery        bool           `db:"pass_query"`
+	RedirectStatus   int            `db:"redirect_status"`
+	CacheMaxAgeSec   *int           `db:"cache_max_age_sec"`
+	DefaultLanguage  string         `db:"default_language"`
+}
+
+// URLWithOptions is a link with its options as JSON arrays.
+type URLWithOptions struct {
+	URLs
+	Routes    []byte `db:"routes"`
+	Variants  []byte `db:"variants"`
+	Schedule  []byte `db:"schedule"`
+	Fallbacks []byte `db:"fallbacks"`
+	Languages []byte `db:"languages"`
+	Unhealthy []byte `db:"unhealthy"`
+}
+
+// LinkOptions are the decoded options of URLWithOptions, Unhealthy are the
+// origin or fallbacks that failed the last health check.
+type LinkOptions struct {
+	Routes    []Route
+	Variants  []Variant
+	Schedule  []ScheduleEntry
+	Fallbacks []string
+	Languages []LanguageDestination
+	Unhealthy []string
 }
 
 type URLsAccess struct {
@@ -18,3 +52,97 @@ type Statistics struct {
 	Timing *time.Time `db:"access_at"`
 	Count  *int       `db:"count"`
 }
+
+type DailyVisits struct {
+	Day       time.Time `db:"day"`
+	Clicks    int       `db:"clicks"`
+	BotClicks int       `db:"bot_clicks"`
+	Sketch    []byte    `db:"sketch"`
+}
+
+type ClickBucket struct {
+	Hour    int `db:"hour"`
+	Weekday int `db:"weekday"`
+	Count   int `db:"count"`
+}
+
+type DurationBucket struct {
+	Bucket int `db:"bucket"`
+	Count  int `db:"count"`
+}
+
+type TopLink struct {
+	ShortURL       string `db:"short_url"`
+	Origin         string `db:"origin"`
+	Clicks         int    `db:"clicks"`
+	PreviousClicks int    `db:"previous_clicks"`
+}
+
+type AccessEvent struct {
+	ShortURL string    `db:"short_url"`
+	AccessAt time.Time `db:"access_at"`
+	HitKind  string    `db:"hit_kind"`
+}
+
+type DailyRollup struct {
+	ShortURL string `db:"short_url"`
+	DailyVisits
+}
+
+type MissCount struct {
+	Key      string    `db:"key"`
+	Count    int       `db:"count"`
+	LastSeen time.Time `db:"last_seen"`
+}
+
+type DailyConversions struct {
+	Day         time.Time `db:"day"`
+	Conversions int       `db:"conversions"`
+}
+
+type Route struct {
+	Kind        string `db:"kind" json:"kind"`
+	Match       string `db:"match" json:"match"`
+	Destination string `db:"destination" json:"destination"`
+	DeepLink    string `db:"deep_link" json:"deep_link"`
+}
+
+type Variant struct {
+	Variant     int    `db:"variant" json:"variant"`
+	Destination string `db:"destination" json:"destination"`
+	Weight      int    `db:"weight" json:"weight"`
+}
+
+type VariantClicks struct {
+	Variant     int    `db:"variant"`
+	Destination string `db:"destination"`
+	Clicks      int    `db:"clicks"`
+}
+
+type ScheduleEntry struct {
+	StartsAt    time.Time  `db:"starts_at" json:"starts_at"`
+	EndsAt      *time.Time `db:"ends_at" json:"ends_at"`
+	Destination string     `db:"destination" json:"destination"`
+}
+
+type LanguageDestination struct {
+	Tag         string `db:"tag" json:"tag"`
+	Destination string `db:"destination" json:"destination"`
+}
+
+type CampaignStatistics struct {
+	Source   string `db:"utm_source"`
+	Medium   string `db:"utm_medium"`
+	Campaign string `db:"utm_campaign"`
+	Links    int    `db:"links"`
+	Clicks   int    `db:"clicks"`
+}
+
+type UTMTemplate struct {
+	Tag      string `db:"tag"`
+	Source   string `db:"utm_source"`
+	Medium   string `db:"utm_medium"`
+	Campaign string `db:"utm_campaign"`
+	Term     string `db:"utm_term"`
+	Content  string `db:"utm_content"`
+}
@@ -2,12 +2,20 @@ package repository
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"github.com/jmoiron/sqlx"
+	"github.com/kalinink/simple-url-shortener/internal/hll"
 	"github.com/kalinink/simple-url-shortener/internal/shortener"
+	"github.com/lib/pq"
+	"math"
+	"sort"
 	"time"
 )
 
+const cursorBatchSize = 1000
+
 type URL struct {
 	db      *sqlx.DB
 	timeout time.Duration
@@ -22,13 +30,59 @@ func (repo *URL) Save(ctx context.Context, url *shortener.NewURL) error {
 	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
 	defer cancel()
 
-	query := "INSERT INTO urls (short_url, origin, created_at) VALUES ($1, $2, $3)"
+	query := `
+		INSERT INTO urls (short_url, origin, created_at, ignore_bot_access, tags, domain, track_conversions, pass_path, pass_query,
+		                  redirect_status, cache_max_age_sec, raw_origin,
+		                  utm_source, utm_medium, utm_campaign, utm_term, utm_content, deduplicated, canonical_origin,
+		                  mixed_script_host, default_language)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
+	`
+
+	tx, err := repo.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return toServiceError(err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var cacheMaxAge *int
+	if url.CacheMaxAge != nil {
+		seconds := int(*url.CacheMaxAge / time.Second)
+		cacheMaxAge = &seconds
+	}
 
-	_, err := repo.db.ExecContext(ctx, query, &url.Short, &url.Long, &url.CreatedAt)
+	_, err = tx.ExecContext(ctx, query, &url.Short, &url.Long, &url.CreatedAt, &url.IgnoreBotAccess,
+		pq.Array(url.Tags), &url.Domain, &url.TrackConversions, &url.PassPath, &url.PassQuery,
+		&url.RedirectStatus, cacheMaxAge, &url.RawLong,
+		&url.UTM.Source, &url.UTM.Medium, &url.UTM.Campaign, &url.UTM.Term, &url.UTM.Content, &url.Deduplicated,
+		&url.Canonical, &url.MixedScript, &url.DefaultLanguage)
 	if err != nil {
 		return toServiceError(err)
 	}
 
+	if err := insertRoutes(ctx, tx, url.Short, url.Routes); err != nil {
+		return toServiceError(err)
+	}
+
+	if err := insertVariants(ctx, tx, url.Short, url.Variants); err != nil {
+		return toServiceError(err)
+	}
+
+	if err := insertSchedule(ctx, tx, url.Short, url.Schedule); err != nil {
+		return toServiceError(err)
+	}
+
+	if err := insertFallbacks(ctx, tx, url.Short, url.Fallbacks); err != nil {
+		return toServiceError(err)
+	}
+
+	if err := insertLanguages(ctx, tx, url.Short, url.Languages); err != nil {
+		return toServiceError(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return toServiceError(err)
+	}
+
 	return nil
 }
 
@@ -42,25 +96,164 @@ func (repo *URL) GetIfNotExpired(ctx context.Context, url *shortener.ShortURL, e
 		return nil, toServiceError(err)
 	}
 
+	if u.IsExpired {
+		return nil, shortener.NewExpiredError("url not found")
+	}
+
 	if expiredURL(u.LastAccess, u.CreatedAt) {
 		if err := repo.setURLExpired(ctx, u.ShortURL); err != nil {
 			return nil, toServiceError(err)
 		}
 
-		return nil, shortener.NewNotFoundError("url not found")
+		return nil, shortener.NewExpiredError("url not found")
 	}
 
-	if err := repo.updateAccess(ctx, u.ShortURL, url.AccessTime); err != nil {
-		return nil, toServiceError(err)
+	var options LinkOptions
+	if err := options.decode(u); err != nil {
+		return nil, shortener.NewInternalError("", err)
+	}
+
+	var unhealthy map[string]bool
+	if len(options.Fallbacks) > 0 && len(options.Unhealthy) > 0 {
+		unhealthy = make(map[string]bool, len(options.Unhealthy))
+		for _, d := range options.Unhealthy {
+			unhealthy[d] = true
+		}
+	}
+
+	var cacheMaxAge *time.Duration
+	if u.CacheMaxAgeSec != nil {
+		d := time.Duration(*u.CacheMaxAgeSec) * time.Second
+		cacheMaxAge = &d
 	}
 
 	return &shortener.URL{
-		Long:  u.Origin,
-		Short: u.ShortURL,
+		Long:      u.Origin,
+		Short:     u.ShortURL,
+		Unhealthy: unhealthy,
+		LinkOptions: shortener.LinkOptions{
+			IgnoreBotAccess:  u.IgnoreBotAccess,
+			Tags:             u.Tags,
+			TrackConversions: u.TrackConversions,
+			Routes:           toRoutes(options.Routes),
+			Variants:         toVariants(options.Variants),
+			Schedule:         toSchedule(options.Schedule),
+			Fallbacks:        options.Fallbacks,
+			DefaultLanguage:  u.DefaultLanguage,
+			Languages:        toLanguages(options.Languages),
+			PassPath:         u.PassPath,
+			PassQuery:        u.PassQuery,
+			RedirectStatus:   u.RedirectStatus,
+			CacheMaxAge:      cacheMaxAge,
+		},
 	}, nil
 
 }
 
+func (repo *URL) GetDuplicate(ctx context.Context, origin string, expiredURL shortener.CheckExpiredFunc) (*shortener.URL, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	// The hash lets the lookup use the partial unique index, origin is compared
+	// as well in case of collisions.
+	query := `
+		SELECT short_url, origin, created_at, last_access
+		FROM urls
+		WHERE md5(origin) = md5($1) AND origin = $1 AND deduplicated AND NOT is_expired
+	`
+
+	u := URLs{}
+	if err := repo.db.QueryRowxContext(ctx, query, &origin).StructScan(&u); err != nil {
+		return nil, toServiceError(err)
+	}
+
+	if expiredURL(u.LastAccess, u.CreatedAt) {
+		if err := repo.setURLExpired(ctx, u.ShortURL); err != nil {
+			return nil, toServiceError(err)
+		}
+
+		return nil, shortener.NewNotFoundError("url not found")
+	}
+
+	return &shortener.URL{Long: u.Origin, Short: u.ShortURL}, nil
+}
+
+func (repo *URL) WithoutCanonical(ctx context.Context, limit int) ([]shortener.URL, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	query := "SELECT short_url, origin FROM urls WHERE canonical_origin IS NULL LIMIT $1"
+
+	var rows []URLs
+	if err := repo.db.SelectContext(ctx, &rows, query, &limit); err != nil {
+		return nil, toServiceError(err)
+	}
+
+	urls := make([]shortener.URL, 0, len(rows))
+	for _, u := range rows {
+		urls = append(urls, shortener.URL{Short: u.ShortURL, Long: u.Origin})
+	}
+	return urls, nil
+}
+
+func (repo *URL) SetCanonical(ctx context.Context, shortURL, canonical string) error {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	query := "UPDATE urls SET canonical_origin = $2 WHERE short_url = $1"
+	if _, err := repo.db.ExecContext(ctx, query, &shortURL, &canonical); err != nil {
+		return toServiceError(err)
+	}
+	return nil
+}
+
+func (repo *URL) FindLinks(ctx context.Context, q *shortener.TargetQuery) ([]shortener.TargetLink, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	// Origins are matched by their hashes to use the indexes.
+	query := `
+		SELECT short_url, origin, created_at, last_access, is_expired
+		FROM urls
+		WHERE (md5(origin) = md5($1) AND origin = $1)
+		   OR (md5(raw_origin) = md5($1) AND raw_origin = $1)
+		ORDER BY created_at DESC, short_url
+		LIMIT $2 OFFSET $3
+	`
+	target := q.URL
+	if q.Canonical != "" {
+		query = `
+			SELECT short_url, origin, created_at, last_access, is_expired
+			FROM urls
+			WHERE md5(canonical_origin) = md5($1) AND canonical_origin = $1
+			ORDER BY created_at DESC, short_url
+			LIMIT $2 OFFSET $3
+		`
+		target = q.Canonical
+	}
+
+	var rows []URLs
+	if err := repo.db.SelectContext(ctx, &rows, query, &target, &q.Limit, &q.Offset); err != nil {
+		return nil, toServiceError(err)
+	}
+
+	links := make([]shortener.TargetLink, 0, len(rows))
+	for _, u := range rows {
+		links = append(links, shortener.TargetLink{
+			Short:      u.ShortURL,
+			Long:       u.Origin,
+			CreatedAt:  u.CreatedAt,
+			LastAccess: u.LastAccess,
+			Expired:    u.IsExpired,
+		})
+	}
+	return links, nil
+}
+
 func (repo *URL) IncShort(ctx context.Context) error {
 	if err := repo.addAccessRow(ctx, "short_urls_access", time.Now()); err != nil {
 		return toServiceError(err)
@@ -69,16 +262,146 @@ func (repo *URL) IncShort(ctx context.Context) error {
 	return nil
 }
 
-func (repo *URL) IncLong(ctx context.Context) error {
-	if err := repo.addAccessRow(ctx, "long_urls_access", time.Now()); err != nil {
+func (repo *URL) IncLong(ctx context.Context, access *shortener.Access) error {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	tx, err := repo.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return toServiceError(err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var clickID *string
+	if access.ClickID != "" {
+		clickID = &access.ClickID
+	}
+
+	query := "INSERT INTO long_urls_access (access_at, short_url, hit_kind, click_id, variant) VALUES ($1, $2, $3, $4, $5)"
+	if _, err := tx.ExecContext(ctx, query, &access.AccessAt, &access.ShortURL, &access.HitKind, clickID, &access.Variant); err != nil {
+		return toServiceError(err)
+	}
+
+	if access.HitKind == shortener.HumanHit {
+		if err := addVisitor(ctx, tx, access); err != nil {
+			return toServiceError(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
 		return toServiceError(err)
 	}
 
 	return nil
 }
 
+func (repo *URL) DailyStatistics(ctx context.Context, shortURL string, from time.Time) ([]shortener.DailyStatistics, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	if err := repo.checkURLExists(ctx, shortURL); err != nil {
+		return nil, toServiceError(err)
+	}
+
+	query := `
+		SELECT
+		       coalesce(c.day, v.day) AS day,
+		       coalesce(c.clicks, 0) AS clicks,
+		       coalesce(c.bot_clicks, 0) AS bot_clicks,
+		       v.sketch
+		FROM (
+		    SELECT
+		           (access_at AT TIME ZONE 'UTC')::date AS day,
+		           count(*) FILTER (WHERE hit_kind = 'human') AS clicks,
+		           count(*) FILTER (WHERE hit_kind <> 'human') AS bot_clicks
+		    FROM long_urls_access
+		    WHERE short_url = $1 AND access_at >= $2
+		    GROUP BY 1
+		) AS c
+		FULL JOIN (
+		    SELECT day, sketch
+		    FROM url_daily_visitors
+		    WHERE short_url = $1 AND day >= ($2::timestamptz AT TIME ZONE 'UTC')::date
+		) AS v ON v.day = c.day
+		ORDER BY 1
+	`
+
+	var rows []DailyVisits
+	if err := repo.db.SelectContext(ctx, &rows, query, &shortURL, &from); err != nil {
+		return nil, toServiceError(err)
+	}
+
+	var conversions []DailyConversions
+	query = `
+		SELECT (converted_at AT TIME ZONE 'UTC')::date AS day, count(*) AS conversions
+		FROM url_conversions
+		WHERE short_url = $1 AND converted_at >= $2
+		GROUP BY 1
+	`
+	if err := repo.db.SelectContext(ctx, &conversions, query, &shortURL, &from); err != nil {
+		return nil, toServiceError(err)
+	}
+	conversionsByDay := make(map[time.Time]int, len(conversions))
+	for _, c := range conversions {
+		conversionsByDay[c.Day] = c.Conversions
+	}
+
+	daily := make([]shortener.DailyStatistics, 0, len(rows))
+	for _, r := range rows {
+		d := shortener.DailyStatistics{Day: r.Day, Clicks: r.Clicks, BotClicks: r.BotClicks, Conversions: conversionsByDay[r.Day]}
+		delete(conversionsByDay, r.Day)
+		if r.Sketch != nil {
+			sketch, err := hll.FromBytes(r.Sketch)
+			if err != nil {
+				return nil, shortener.NewInternalError("", err)
+			}
+			d.Visitors = sketch
+		}
+		daily = append(daily, d)
+	}
+
+	// Conversions may come on a day without clicks.
+	for day, n := range conversionsByDay {
+		daily = append(daily, shortener.DailyStatistics{Day: day, Conversions: n})
+	}
+	sort.Slice(daily, func(i, j int) bool { return daily[i].Day.Before(daily[j].Day) })
+
+	return daily, nil
+}
+
+func (repo *URL) VariantStatistics(ctx context.Context, shortURL string, from time.Time) ([]shortener.VariantStatistics, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	query := `
+		SELECT v.variant, v.destination, count(a.access_at) AS clicks
+		FROM url_variants AS v
+		LEFT JOIN long_urls_access AS a
+		    ON a.short_url = v.short_url AND a.variant = v.variant
+		    AND a.hit_kind = 'human' AND a.access_at >= $2
+		WHERE v.short_url = $1
+		GROUP BY v.variant, v.destination
+		ORDER BY v.variant
+	`
+
+	var rows []VariantClicks
+	if err := repo.db.SelectContext(ctx, &rows, query, &shortURL, &from); err != nil {
+		return nil, toServiceError(err)
+	}
+
+	stat := make([]shortener.VariantStatistics, 0, len(rows))
+	for _, r := range rows {
+		stat = append(stat, shortener.VariantStatistics{Variant: r.Variant, Destination: r.Destination, Clicks: r.Clicks})
+	}
+
+	return stat, nil
+}
+
 func (repo *URL) StatShortURL(ctx context.Context) (*shortener.Statistics, error) {
-	s, err := repo.stat(ctx, "short_urls_access")
+	s, err := repo.stat(ctx, "short_urls_access", "true")
 	if err != nil {
 		return nil, toServiceError(err)
 	}
@@ -92,7 +415,7 @@ func (repo *URL) StatShortURL(ctx context.Context) (*shortener.Statistics, error
 }
 
 func (repo *URL) StatLongURL(ctx context.Context) (*shortener.Statistics, error) {
-	s, err := repo.stat(ctx, "long_urls_access")
+	s, err := repo.stat(ctx, "long_urls_access", "hit_kind = 'human'")
 	if err != nil {
 		return nil, toServiceError(err)
 	}
@@ -105,26 +428,828 @@ func (repo *URL) StatLongURL(ctx context.Context) (*shortener.Statistics, error)
 	return &stats, nil
 }
 
-func (repo *URL) updateAccess(ctx context.Context, shortURL string, t time.Time) error {
-	query := "UPDATE urls SET last_access = $1 WHERE short_url = $2"
-	_, err := repo.db.ExecContext(ctx, query, &t, &shortURL)
-	return err
+func (repo *URL) ClickHistograms(ctx context.Context) (*shortener.ClickHistograms, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	var buckets []ClickBucket
+	query := `
+		SELECT extract(hour FROM access_at AT TIME ZONE 'UTC')::int AS hour, extract(dow FROM access_at AT TIME ZONE 'UTC')::int AS weekday, count(*) AS count
+		FROM long_urls_access
+		WHERE hit_kind = 'human'
+		GROUP BY 1, 2
+	`
+	if err := repo.db.SelectContext(ctx, &buckets, query); err != nil {
+		return nil, toServiceError(err)
+	}
+
+	h := &shortener.ClickHistograms{}
+	for _, b := range buckets {
+		h.Times = append(h.Times, shortener.ClickTimeCount{Hour: b.Hour, Weekday: b.Weekday, Count: b.Count})
+	}
+
+	// Durations are bucketed like shortener.DurationBucket does, by milliseconds.
+	var err error
+	query = `
+		SELECT floor(ln(1 + greatest(extract(epoch FROM a.access_at - u.created_at), 0) * 1000) / $1)::int AS bucket,
+		       count(*) AS count
+		FROM long_urls_access a
+		JOIN urls u ON u.short_url = a.short_url
+		WHERE a.hit_kind = 'human'
+		GROUP BY 1
+	`
+	if h.LinkAge, err = repo.durationCounts(ctx, query); err != nil {
+		return nil, toServiceError(err)
+	}
+
+	query = `
+		SELECT floor(ln(1 + greatest(interval, 0) * 1000) / $1)::int AS bucket, count(*) AS count
+		FROM (
+		    SELECT extract(epoch FROM access_at - lag(access_at) OVER (PARTITION BY short_url ORDER BY access_at)) AS interval
+		    FROM long_urls_access
+		    WHERE hit_kind = 'human' AND short_url IS NOT NULL
+		) AS intervals
+		WHERE interval IS NOT NULL
+		GROUP BY 1
+	`
+	if h.InterClick, err = repo.durationCounts(ctx, query); err != nil {
+		return nil, toServiceError(err)
+	}
+
+	return h, nil
 }
 
-func (repo *URL) setURLExpired(ctx context.Context, shortURL string) error {
-	query := "UPDATE urls SET is_expired = true WHERE short_url = $1"
-	_, err := repo.db.ExecContext(ctx, query, &shortURL)
-	return err
+func (repo *URL) durationCounts(ctx context.Context, query string) ([]shortener.DurationCount, error) {
+	var rows []DurationBucket
+	if err := repo.db.SelectContext(ctx, &rows, query, math.Log(shortener.DurationBucketBase)); err != nil {
+		return nil, err
+	}
+
+	counts := make([]shortener.DurationCount, 0, len(rows))
+	for _, r := range rows {
+		counts = append(counts, shortener.DurationCount{Bucket: r.Bucket, Count: r.Count})
+	}
+	return counts, nil
+}
+
+func (repo *URL) TopLinks(ctx context.Context, f *shortener.TopFilter) ([]shortener.TopLink, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	order := "clicks DESC"
+	if f.Trending {
+		order = "(clicks - previous_clicks)::float / greatest(previous_clicks, 1) DESC, clicks DESC"
+	}
+
+	query := fmt.Sprintf(`
+		SELECT short_url, origin, clicks, previous_clicks
+		FROM (
+		    SELECT
+		           u.short_url,
+		           u.origin,
+		           count(*) FILTER (WHERE a.access_at >= $2) AS clicks,
+		           count(*) FILTER (WHERE a.access_at < $2) AS previous_clicks
+		    FROM long_urls_access a
+		    JOIN urls u ON u.short_url = a.short_url
+		    WHERE a.hit_kind = 'human' AND a.access_at >= $1 AND a.access_at < $3
+		      AND ($4 = '' OR $4 = ANY(u.tags))
+		      AND ($5 = '' OR u.domain = $5 OR right(u.domain, length($5) + 1) = '.' || $5)
+		    GROUP BY u.short_url, u.origin
+		) AS windows
+		WHERE clicks > 0
+		ORDER BY %s, short_url
+		LIMIT $6
+	`, order)
+
+	var rows []TopLink
+	err := repo.db.SelectContext(ctx, &rows, query, &f.PreviousSince, &f.Since, &f.Until, &f.Tag, &f.Domain, &f.Limit)
+	if err != nil {
+		return nil, toServiceError(err)
+	}
+
+	return toTopLinks(rows), nil
 }
 
-func (repo *URL) getURL(ctx context.Context, shortURL string) (*URLs, error) {
+func (repo *URL) GrowingLinks(ctx context.Context, f *shortener.GrowthFilter) ([]shortener.TopLink, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
 	query := `
-		SELECT short_url, origin, created_at, last_access
-		FROM urls
-		WHERE is_expired = false AND short_url = $1
+		SELECT short_url, origin, clicks, previous_clicks
+		FROM (
+		    SELECT
+		           u.short_url,
+		           u.origin,
+		           count(*) FILTER (WHERE a.access_at >= $2) AS clicks,
+		           count(*) FILTER (WHERE a.access_at < $2) AS previous_clicks
+		    FROM long_urls_access a
+		    JOIN urls u ON u.short_url = a.short_url
+		    WHERE a.hit_kind = 'human' AND a.access_at >= $1 AND a.access_at < $3
+		    GROUP BY u.short_url, u.origin
+		) AS windows
+		WHERE clicks > 0
+		  AND (($6 > 0 AND clicks >= $6) OR (clicks >= $4 AND clicks > $5 * previous_clicks))
+		ORDER BY clicks DESC, short_url
 	`
 
-	u := URLs{}
+	var rows []TopLink
+	err := repo.db.SelectContext(ctx, &rows, query, &f.PreviousSince, &f.Since, &f.Until, &f.MinClicks, &f.Ratio, &f.Threshold)
+	if err != nil {
+		return nil, toServiceError(err)
+	}
+
+	return toTopLinks(rows), nil
+}
+
+func toTopLinks(rows []TopLink) []shortener.TopLink {
+	top := make([]shortener.TopLink, 0, len(rows))
+	for _, r := range rows {
+		top = append(top, shortener.TopLink{
+			Long:           r.Origin,
+			Short:          r.ShortURL,
+			Clicks:         r.Clicks,
+			PreviousClicks: r.PreviousClicks,
+			Growth:         shortener.Growth(r.Clicks, r.PreviousClicks),
+		})
+	}
+
+	return top
+}
+
+func (repo *URL) Campaigns(ctx context.Context, since, until time.Time, limit int) ([]shortener.CampaignStatistics, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	query := `
+		SELECT u.utm_source, u.utm_medium, u.utm_campaign, count(DISTINCT u.short_url) AS links, count(*) AS clicks
+		FROM long_urls_access a
+		JOIN urls u ON u.short_url = a.short_url
+		WHERE a.hit_kind = 'human' AND a.access_at >= $1 AND a.access_at < $2 AND u.utm_campaign <> ''
+		GROUP BY u.utm_source, u.utm_medium, u.utm_campaign
+		ORDER BY clicks DESC, u.utm_campaign, u.utm_source, u.utm_medium
+		LIMIT $3
+	`
+
+	var rows []CampaignStatistics
+	if err := repo.db.SelectContext(ctx, &rows, query, &since, &until, &limit); err != nil {
+		return nil, toServiceError(err)
+	}
+
+	stat := make([]shortener.CampaignStatistics, 0, len(rows))
+	for _, r := range rows {
+		stat = append(stat, shortener.CampaignStatistics{
+			Source:   r.Source,
+			Medium:   r.Medium,
+			Campaign: r.Campaign,
+			Links:    r.Links,
+			Clicks:   r.Clicks,
+		})
+	}
+
+	return stat, nil
+}
+
+func (repo *URL) UTMTemplates(ctx context.Context, tags []string) (map[string]shortener.UTM, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	query := `
+		SELECT tag, utm_source, utm_medium, utm_campaign, utm_term, utm_content
+		FROM tag_utm_templates
+		WHERE tag = ANY($1)
+	`
+
+	var rows []UTMTemplate
+	if err := repo.db.SelectContext(ctx, &rows, query, pq.Array(tags)); err != nil {
+		return nil, toServiceError(err)
+	}
+
+	templates := make(map[string]shortener.UTM, len(rows))
+	for _, r := range rows {
+		templates[r.Tag] = shortener.UTM{
+			Source:   r.Source,
+			Medium:   r.Medium,
+			Campaign: r.Campaign,
+			Term:     r.Term,
+			Content:  r.Content,
+		}
+	}
+
+	return templates, nil
+}
+
+func (repo *URL) SetUTMTemplate(ctx context.Context, tag string, utm shortener.UTM) error {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	if utm.IsZero() {
+		if _, err := repo.db.ExecContext(ctx, "DELETE FROM tag_utm_templates WHERE tag = $1", &tag); err != nil {
+			return toServiceError(err)
+		}
+		return nil
+	}
+
+	query := `
+		INSERT INTO tag_utm_templates (tag, utm_source, utm_medium, utm_campaign, utm_term, utm_content)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (tag) DO UPDATE
+		SET utm_source = EXCLUDED.utm_source, utm_medium = EXCLUDED.utm_medium, utm_campaign = EXCLUDED.utm_campaign,
+		    utm_term = EXCLUDED.utm_term, utm_content = EXCLUDED.utm_content
+	`
+	_, err := repo.db.ExecContext(ctx, query, &tag, &utm.Source, &utm.Medium, &utm.Campaign, &utm.Term, &utm.Content)
+	if err != nil {
+		return toServiceError(err)
+	}
+
+	return nil
+}
+
+// ExportEvents isn't limited by the repository timeout, the export lasts
+// until all rows are written or ctx is canceled.
+func (repo *URL) ExportEvents(ctx context.Context, from, until time.Time, fn func(*shortener.AccessEvent) error) error {
+	query := `
+		SELECT short_url, access_at, hit_kind
+		FROM long_urls_access
+		WHERE short_url IS NOT NULL AND access_at >= $1 AND access_at < $2
+		ORDER BY access_at
+	`
+
+	return repo.withCursor(ctx, query, []interface{}{&from, &until}, func(rows *sqlx.Rows) error {
+		var e AccessEvent
+		if err := rows.StructScan(&e); err != nil {
+			return toServiceError(err)
+		}
+
+		return fn(&shortener.AccessEvent{ShortURL: e.ShortURL, AccessAt: e.AccessAt, HitKind: e.HitKind})
+	})
+}
+
+func (repo *URL) ExportRollups(ctx context.Context, from, until time.Time, fn func(*shortener.DailyRollup) error) error {
+	query := `
+		SELECT
+		       coalesce(c.short_url, v.short_url) AS short_url,
+		       coalesce(c.day, v.day) AS day,
+		       coalesce(c.clicks, 0) AS clicks,
+		       coalesce(c.bot_clicks, 0) AS bot_clicks,
+		       v.sketch
+		FROM (
+		    SELECT
+		           short_url,
+		           (access_at AT TIME ZONE 'UTC')::date AS day,
+		           count(*) FILTER (WHERE hit_kind = 'human') AS clicks,
+		           count(*) FILTER (WHERE hit_kind <> 'human') AS bot_clicks
+		    FROM long_urls_access
+		    WHERE short_url IS NOT NULL AND access_at >= $1 AND access_at < $2
+		    GROUP BY 1, 2
+		) AS c
+		FULL JOIN (
+		    SELECT short_url, day, sketch
+		    FROM url_daily_visitors
+		    WHERE day >= ($1::timestamptz AT TIME ZONE 'UTC')::date AND day < $2::timestamptz AT TIME ZONE 'UTC'
+		) AS v ON v.short_url = c.short_url AND v.day = c.day
+		ORDER BY 2, 1
+	`
+
+	return repo.withCursor(ctx, query, []interface{}{&from, &until}, func(rows *sqlx.Rows) error {
+		var r DailyRollup
+		if err := rows.StructScan(&r); err != nil {
+			return toServiceError(err)
+		}
+
+		rollup := &shortener.DailyRollup{ShortURL: r.ShortURL}
+		rollup.Day, rollup.Clicks, rollup.BotClicks = r.Day, r.Clicks, r.BotClicks
+		if r.Sketch != nil {
+			sketch, err := hll.FromBytes(r.Sketch)
+			if err != nil {
+				return shortener.NewInternalError("", err)
+			}
+			rollup.Visitors = sketch
+		}
+
+		return fn(rollup)
+	})
+}
+
+// withCursor runs the query through a server-side cursor and fetches it in
+// batches, so neither the database driver nor the caller keeps the whole result.
+func (repo *URL) withCursor(ctx context.Context, query string, args []interface{}, scan func(*sqlx.Rows) error) error {
+	tx, err := repo.db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return toServiceError(err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.ExecContext(ctx, "DECLARE export_cursor NO SCROLL CURSOR FOR "+query, args...); err != nil {
+		return toServiceError(err)
+	}
+
+	fetch := fmt.Sprintf("FETCH FORWARD %d FROM export_cursor", cursorBatchSize)
+	for {
+		rows, err := tx.QueryxContext(ctx, fetch)
+		if err != nil {
+			return toServiceError(err)
+		}
+
+		var n int
+		for rows.Next() {
+			n++
+			if err := scan(rows); err != nil {
+				_ = rows.Close()
+				return err
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return toServiceError(err)
+		}
+		_ = rows.Close()
+
+		if n < cursorBatchSize {
+			break
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (repo *URL) AddMiss(ctx context.Context, miss *shortener.Miss) error {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	query := "INSERT INTO url_misses (key, event, hit_kind, occurred_at) VALUES ($1, $2, $3, $4)"
+	if _, err := repo.db.ExecContext(ctx, query, &miss.Key, &miss.Event, &miss.HitKind, &miss.OccurredAt); err != nil {
+		return toServiceError(err)
+	}
+
+	return nil
+}
+
+func (repo *URL) DeleteMisses(ctx context.Context, before time.Time) (int64, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	res, err := repo.db.ExecContext(ctx, "DELETE FROM url_misses WHERE occurred_at < $1", &before)
+	if err != nil {
+		return 0, toServiceError(err)
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, toServiceError(err)
+	}
+	return deleted, nil
+}
+
+func (repo *URL) TopMisses(ctx context.Context, event string, since time.Time, limit int) ([]shortener.MissCount, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	query := `
+		SELECT key, count(*) AS count, max(occurred_at) AS last_seen
+		FROM url_misses
+		WHERE event = $1 AND occurred_at >= $2
+		GROUP BY key
+		ORDER BY count DESC, last_seen DESC
+		LIMIT $3
+	`
+
+	var rows []MissCount
+	if err := repo.db.SelectContext(ctx, &rows, query, &event, &since, &limit); err != nil {
+		return nil, toServiceError(err)
+	}
+
+	misses := make([]shortener.MissCount, 0, len(rows))
+	for _, r := range rows {
+		misses = append(misses, shortener.MissCount{Key: r.Key, Count: r.Count, LastSeen: r.LastSeen})
+	}
+
+	return misses, nil
+}
+
+func (repo *URL) AddConversion(ctx context.Context, clickID string, at time.Time) error {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	query := `
+		INSERT INTO url_conversions (click_id, short_url, converted_at)
+		SELECT click_id, short_url, $2
+		FROM long_urls_access
+		WHERE click_id = $1
+		ON CONFLICT (click_id) DO NOTHING
+	`
+	res, err := repo.db.ExecContext(ctx, query, &clickID, &at)
+	if err != nil {
+		return toServiceError(err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return nil
+	}
+
+	query = "SELECT click_id FROM url_conversions WHERE click_id = $1"
+	if err := repo.db.QueryRowxContext(ctx, query, &clickID).Scan(&clickID); err != nil {
+		return toServiceError(err)
+	}
+
+	return nil
+}
+
+func (repo *URL) Routes(ctx context.Context, shortURL string) ([]shortener.Route, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	if err := repo.checkURLExists(ctx, shortURL); err != nil {
+		return nil, toServiceError(err)
+	}
+
+	routes, err := repo.routes(ctx, shortURL)
+	if err != nil {
+		return nil, toServiceError(err)
+	}
+
+	return routes, nil
+}
+
+func (repo *URL) SetRoutes(ctx context.Context, shortURL string, routes []shortener.Route) error {
+	return repo.replace(ctx, shortURL, "url_routes", func(tx *sqlx.Tx) error {
+		return insertRoutes(ctx, tx, shortURL, routes)
+	})
+}
+
+func (repo *URL) routes(ctx context.Context, shortURL string) ([]shortener.Route, error) {
+	query := `
+		SELECT kind, match, destination, deep_link
+		FROM url_routes
+		WHERE short_url = $1
+		ORDER BY position
+	`
+
+	var rows []Route
+	if err := repo.db.SelectContext(ctx, &rows, query, &shortURL); err != nil {
+		return nil, err
+	}
+
+	return toRoutes(rows), nil
+}
+
+func toRoutes(rows []Route) []shortener.Route {
+	routes := make([]shortener.Route, 0, len(rows))
+	for _, r := range rows {
+		routes = append(routes, shortener.Route{Kind: r.Kind, Match: r.Match, Destination: r.Destination, DeepLink: r.DeepLink})
+	}
+	return routes
+}
+
+func insertRoutes(ctx context.Context, tx *sqlx.Tx, shortURL string, routes []shortener.Route) error {
+	query := "INSERT INTO url_routes (short_url, position, kind, match, destination, deep_link) VALUES ($1, $2, $3, $4, $5, $6)"
+	for i, r := range routes {
+		if _, err := tx.ExecContext(ctx, query, &shortURL, i, &r.Kind, &r.Match, &r.Destination, &r.DeepLink); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (repo *URL) Schedule(ctx context.Context, shortURL string) ([]shortener.ScheduleEntry, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	if err := repo.checkURLExists(ctx, shortURL); err != nil {
+		return nil, toServiceError(err)
+	}
+
+	schedule, err := repo.schedule(ctx, shortURL)
+	if err != nil {
+		return nil, toServiceError(err)
+	}
+
+	return schedule, nil
+}
+
+func (repo *URL) SetSchedule(ctx context.Context, shortURL string, schedule []shortener.ScheduleEntry) error {
+	return repo.replace(ctx, shortURL, "url_schedules", func(tx *sqlx.Tx) error {
+		return insertSchedule(ctx, tx, shortURL, schedule)
+	})
+}
+
+func (repo *URL) Languages(ctx context.Context, shortURL string) (*shortener.Localization, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	var defaultLanguage string
+	query := "SELECT default_language FROM urls WHERE short_url = $1"
+	if err := repo.db.QueryRowxContext(ctx, query, &shortURL).Scan(&defaultLanguage); err != nil {
+		return nil, toServiceError(err)
+	}
+
+	languages, err := repo.languages(ctx, shortURL)
+	if err != nil {
+		return nil, toServiceError(err)
+	}
+
+	return &shortener.Localization{Default: defaultLanguage, Languages: languages}, nil
+}
+
+func (repo *URL) SetLanguages(ctx context.Context, shortURL string, localization *shortener.Localization) error {
+	return repo.replace(ctx, shortURL, "url_languages", func(tx *sqlx.Tx) error {
+		query := "UPDATE urls SET default_language = $2 WHERE short_url = $1"
+		if _, err := tx.ExecContext(ctx, query, &shortURL, &localization.Default); err != nil {
+			return err
+		}
+		return insertLanguages(ctx, tx, shortURL, localization.Languages)
+	})
+}
+
+// replace deletes the rows of the short URL from the table and inserts new
+// ones within a transaction. The url is locked, so concurrent updates don't interleave.
+func (repo *URL) replace(ctx context.Context, shortURL, table string, insert func(*sqlx.Tx) error) error {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	tx, err := repo.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return toServiceError(err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var key string
+	query := "SELECT short_url FROM urls WHERE short_url = $1 FOR UPDATE"
+	if err := tx.QueryRowxContext(ctx, query, &shortURL).Scan(&key); err != nil {
+		return toServiceError(err)
+	}
+
+	query = fmt.Sprintf("DELETE FROM %s WHERE short_url = $1", table)
+	if _, err := tx.ExecContext(ctx, query, &shortURL); err != nil {
+		return toServiceError(err)
+	}
+
+	if err := insert(tx); err != nil {
+		return toServiceError(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return toServiceError(err)
+	}
+
+	return nil
+}
+
+func (repo *URL) languages(ctx context.Context, shortURL string) ([]shortener.LanguageDestination, error) {
+	query := `
+		SELECT tag, destination
+		FROM url_languages
+		WHERE short_url = $1
+		ORDER BY position
+	`
+
+	var rows []LanguageDestination
+	if err := repo.db.SelectContext(ctx, &rows, query, &shortURL); err != nil {
+		return nil, err
+	}
+
+	return toLanguages(rows), nil
+}
+
+func toLanguages(rows []LanguageDestination) []shortener.LanguageDestination {
+	languages := make([]shortener.LanguageDestination, 0, len(rows))
+	for _, r := range rows {
+		languages = append(languages, shortener.LanguageDestination{Tag: r.Tag, Destination: r.Destination})
+	}
+	return languages
+}
+
+func insertLanguages(ctx context.Context, tx *sqlx.Tx, shortURL string, languages []shortener.LanguageDestination) error {
+	query := "INSERT INTO url_languages (short_url, position, tag, destination) VALUES ($1, $2, $3, $4)"
+	for i, l := range languages {
+		if _, err := tx.ExecContext(ctx, query, &shortURL, i, &l.Tag, &l.Destination); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (repo *URL) schedule(ctx context.Context, shortURL string) ([]shortener.ScheduleEntry, error) {
+	query := `
+		SELECT starts_at, ends_at, destination
+		FROM url_schedules
+		WHERE short_url = $1
+		ORDER BY starts_at
+	`
+
+	var rows []ScheduleEntry
+	if err := repo.db.SelectContext(ctx, &rows, query, &shortURL); err != nil {
+		return nil, err
+	}
+
+	return toSchedule(rows), nil
+}
+
+func toSchedule(rows []ScheduleEntry) []shortener.ScheduleEntry {
+	schedule := make([]shortener.ScheduleEntry, 0, len(rows))
+	for _, r := range rows {
+		e := shortener.ScheduleEntry{Start: r.StartsAt, Destination: r.Destination}
+		if r.EndsAt != nil {
+			e.End = *r.EndsAt
+		}
+		schedule = append(schedule, e)
+	}
+	return schedule
+}
+
+func insertSchedule(ctx context.Context, tx *sqlx.Tx, shortURL string, schedule []shortener.ScheduleEntry) error {
+	query := "INSERT INTO url_schedules (short_url, starts_at, ends_at, destination) VALUES ($1, $2, $3, $4)"
+	for _, e := range schedule {
+		var end *time.Time
+		if !e.End.IsZero() {
+			end = &e.End
+		}
+		if _, err := tx.ExecContext(ctx, query, &shortURL, &e.Start, end, &e.Destination); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HealthCheckTargets are origins and fallbacks of the links with fallbacks that aren't expired.
+func (repo *URL) HealthCheckTargets(ctx context.Context) ([]string, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	query := `
+		SELECT u.origin
+		FROM urls AS u
+		WHERE NOT u.is_expired AND EXISTS (SELECT 1 FROM url_fallbacks AS f WHERE f.short_url = u.short_url)
+		UNION
+		SELECT f.destination
+		FROM url_fallbacks AS f
+		JOIN urls AS u ON u.short_url = f.short_url
+		WHERE NOT u.is_expired
+	`
+
+	var targets []string
+	if err := repo.db.SelectContext(ctx, &targets, query); err != nil {
+		return nil, toServiceError(err)
+	}
+
+	return targets, nil
+}
+
+func (repo *URL) SetHealth(ctx context.Context, health *shortener.DestinationHealth) error {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	query := `
+		INSERT INTO destination_health (destination, healthy, status_code, error, checked_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (destination) DO UPDATE
+		SET healthy = EXCLUDED.healthy, status_code = EXCLUDED.status_code,
+		    error = EXCLUDED.error, checked_at = EXCLUDED.checked_at
+	`
+	_, err := repo.db.ExecContext(ctx, query, &health.URL, &health.Healthy, &health.StatusCode, &health.Error, &health.CheckedAt)
+	if err != nil {
+		return toServiceError(err)
+	}
+
+	return nil
+}
+
+func insertFallbacks(ctx context.Context, tx *sqlx.Tx, shortURL string, fallbacks []string) error {
+	query := "INSERT INTO url_fallbacks (short_url, position, destination) VALUES ($1, $2, $3)"
+	for i, f := range fallbacks {
+		if _, err := tx.ExecContext(ctx, query, &shortURL, i, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func toVariants(rows []Variant) []shortener.Variant {
+	variants := make([]shortener.Variant, 0, len(rows))
+	for _, r := range rows {
+		variants = append(variants, shortener.Variant{Destination: r.Destination, Weight: r.Weight})
+	}
+	return variants
+}
+
+// insertVariants numbers variants from 1, the number is what visitors stick to.
+func insertVariants(ctx context.Context, tx *sqlx.Tx, shortURL string, variants []shortener.Variant) error {
+	query := "INSERT INTO url_variants (short_url, variant, destination, weight) VALUES ($1, $2, $3, $4)"
+	for i, v := range variants {
+		if _, err := tx.ExecContext(ctx, query, &shortURL, i+1, &v.Destination, &v.Weight); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (repo *URL) UpdateAccess(ctx context.Context, shortURL string, t time.Time) error {
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(ctx, repo.timeout)
+	defer cancel()
+
+	query := "UPDATE urls SET last_access = $1 WHERE short_url = $2"
+	if _, err := repo.db.ExecContext(ctx, query, &t, &shortURL); err != nil {
+		return toServiceError(err)
+	}
+	return nil
+}
+
+func (repo *URL) setURLExpired(ctx context.Context, shortURL string) error {
+	query := "UPDATE urls SET is_expired = true WHERE short_url = $1"
+	_, err := repo.db.ExecContext(ctx, query, &shortURL)
+	return err
+}
+
+func (repo *URL) checkURLExists(ctx context.Context, shortURL string) error {
+	query := "SELECT short_url FROM urls WHERE short_url = $1"
+	var key string
+	return repo.db.QueryRowxContext(ctx, query, &shortURL).Scan(&key)
+}
+
+// addVisitor updates the single register of the daily sketch the visitor
+// hash falls into, so concurrent accesses don't overwrite each other.
+func addVisitor(ctx context.Context, tx *sqlx.Tx, access *shortener.Access) error {
+	index, rank := hll.Position(access.VisitorHash)
+	sketch := hll.New()
+	sketch.Add(access.VisitorHash)
+
+	query := `
+		INSERT INTO url_daily_visitors (short_url, day, sketch) VALUES ($1, ($2::timestamptz AT TIME ZONE 'UTC')::date, $3)
+		ON CONFLICT (short_url, day) DO UPDATE
+		SET sketch = set_byte(url_daily_visitors.sketch, $4, greatest(get_byte(url_daily_visitors.sketch, $4), $5))
+	`
+	_, err := tx.ExecContext(ctx, query, &access.ShortURL, &access.AccessAt, sketch.Bytes(), index, int(rank))
+	return err
+}
+
+func (o *LinkOptions) decode(u *URLWithOptions) error {
+	columns := []struct {
+		data []byte
+		v    interface{}
+	}{
+		{u.Routes, &o.Routes},
+		{u.Variants, &o.Variants},
+		{u.Schedule, &o.Schedule},
+		{u.Fallbacks, &o.Fallbacks},
+		{u.Languages, &o.Languages},
+		{u.Unhealthy, &o.Unhealthy},
+	}
+	for _, c := range columns {
+		if err := json.Unmarshal(c.data, c.v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getURL loads the link along with its options in a single query, the option
+// tables are aggregated into JSON arrays ordered like the separate getters do.
+// Timestamps are formatted in UTC like the driver reads TIMESTAMP columns.
+func (repo *URL) getURL(ctx context.Context, shortURL string) (*URLWithOptions, error) {
+	query := `
+		SELECT u.short_url, u.origin, u.created_at, u.last_access, u.is_expired, u.ignore_bot_access, u.tags,
+		       u.track_conversions, u.pass_path, u.pass_query, u.redirect_status, u.cache_max_age_sec,
+		       u.default_language,
+		       (SELECT coalesce(json_agg(json_build_object('kind', r.kind, 'match', r.match, 'destination', r.destination,
+		                                                   'deep_link', r.deep_link)
+		                                 ORDER BY r.position), '[]')
+		        FROM url_routes r WHERE r.short_url = u.short_url) AS routes,
+		       (SELECT coalesce(json_agg(json_build_object('destination', v.destination, 'weight', v.weight)
+		                                 ORDER BY v.variant), '[]')
+		        FROM url_variants v WHERE v.short_url = u.short_url) AS variants,
+		       (SELECT coalesce(json_agg(json_build_object(
+		                   'starts_at', to_char(s.starts_at, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+		                   'ends_at', to_char(s.ends_at, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+		                   'destination', s.destination) ORDER BY s.starts_at), '[]')
+		        FROM url_schedules s WHERE s.short_url = u.short_url) AS schedule,
+		       (SELECT coalesce(json_agg(f.destination ORDER BY f.position), '[]')
+		        FROM url_fallbacks f WHERE f.short_url = u.short_url) AS fallbacks,
+		       (SELECT coalesce(json_agg(json_build_object('tag', l.tag, 'destination', l.destination)
+		                                 ORDER BY l.position), '[]')
+		        FROM url_languages l WHERE l.short_url = u.short_url) AS languages,
+		       (SELECT coalesce(json_agg(h.destination), '[]')
+		        FROM destination_health h
+		        WHERE NOT h.healthy AND (h.destination = u.origin OR h.destination IN (
+		            SELECT f.destination FROM url_fallbacks f WHERE f.short_url = u.short_url))) AS unhealthy
+		FROM urls u
+		WHERE u.short_url = $1
+	`
+
+	u := URLWithOptions{}
 	if err := repo.db.QueryRowxContext(ctx, query, &shortURL).StructScan(&u); err != nil {
 		return nil, err
 	}
@@ -138,18 +1263,19 @@ func (repo *URL) addAccessRow(ctx context.Context, table string, t time.Time) er
 	return err
 }
 
-func (repo *URL) stat(ctx context.Context, table string) (*Statistics, error) {
+func (repo *URL) stat(ctx context.Context, table, condition string) (*Statistics, error) {
 	query := fmt.Sprintf(`
 		SELECT access_at, count
 		FROM (
 		    SELECT
 		           access_at,
-		           (select count(*) from %s) as count,
+		           (select count(*) from %s where %s) as count,
 		           ROW_NUMBER() OVER (ORDER BY access_at) as rank
 		            FROM %s
+		            WHERE %s
 		    ) as ranks
 		WHERE rank = ceil(count/2::float);
-	`, table, table)
+	`, table, condition, table, condition)
 
 	s := Statistics{}
 	if err := repo.db.QueryRowxContext(ctx, query).StructScan(&s); err != nil {
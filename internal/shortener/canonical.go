@@ -0,0 +1,194 @@
+package shortener
+
+import (
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// DefaultTrackingParams are query parameters that identify the click rather
+// than the page. A trailing "*" matches any parameter with the prefix.
+var DefaultTrackingParams = []string{
+	"utm_*", "fbclid", "gclid", "dclid", "gbraid", "wbraid", "msclkid", "yclid", "twclid", "ttclid",
+	"igshid", "mc_cid", "mc_eid", "_ga", "_gl", "mkt_tok", "li_fat_id", "oly_anon_id", "oly_enc_id",
+	"_hsenc", "_hsmi", "vero_id", "rb_clickid", "s_cid",
+}
+
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// Canonicalizer rewrites equivalent URLs into the same form: the scheme and
+// the host are lowercased, the default port, tracking parameters and the
+// empty query are removed, query keys are sorted and percent-encoding is
+// normalized.
+type Canonicalizer struct {
+	exact    map[string]bool
+	prefixes []string
+}
+
+func NewCanonicalizer(trackingParams []string) *Canonicalizer {
+	c := &Canonicalizer{exact: make(map[string]bool)}
+	for _, p := range trackingParams {
+		p = strings.ToLower(strings.TrimSpace(p))
+		switch {
+		case p == "":
+		case strings.HasSuffix(p, "*"):
+			c.prefixes = append(c.prefixes, strings.TrimSuffix(p, "*"))
+		default:
+			c.exact[p] = true
+		}
+	}
+	return c
+}
+
+// Canonicalize expects a valid absolute URL, the fragment is kept as is
+// apart from percent-encoding.
+func (c *Canonicalizer) Canonicalize(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	scheme := strings.ToLower(u.Scheme)
+	b.WriteString(scheme)
+	b.WriteString("://")
+	if u.User != nil {
+		b.WriteString(u.User.String())
+		b.WriteByte('@')
+	}
+
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	b.WriteString(host)
+	if port != "" && port != defaultPorts[scheme] {
+		b.WriteByte(':')
+		b.WriteString(port)
+	}
+
+	path := normalizeEscapes(u.EscapedPath())
+	if path == "" {
+		path = "/"
+	}
+	b.WriteString(path)
+
+	if query := c.canonicalQuery(u.RawQuery); query != "" {
+		b.WriteByte('?')
+		b.WriteString(query)
+	}
+
+	if i := strings.IndexByte(rawURL, '#'); i >= 0 && i < len(rawURL)-1 {
+		b.WriteString(normalizeEscapes(rawURL[i:]))
+	}
+
+	return b.String(), nil
+}
+
+func (c *Canonicalizer) canonicalQuery(rawQuery string) string {
+	type pair struct{ key, raw string }
+
+	var pairs []pair
+	for _, p := range strings.Split(rawQuery, "&") {
+		if p == "" {
+			continue
+		}
+		p = normalizeEscapes(p)
+		rawKey := p
+		if i := strings.IndexByte(p, '='); i >= 0 {
+			rawKey = p[:i]
+		}
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			key = rawKey
+		}
+		if c.isTracking(key) {
+			continue
+		}
+		pairs = append(pairs, pair{key: key, raw: p})
+	}
+
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].key < pairs[j].key })
+
+	raw := make([]string, 0, len(pairs))
+	for _, p := range pairs {
+		raw = append(raw, p.raw)
+	}
+	return strings.Join(raw, "&")
+}
+
+func (c *Canonicalizer) isTracking(key string) bool {
+	key = strings.ToLower(key)
+	if c.exact[key] {
+		return true
+	}
+	for _, p := range c.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanPath resolves the escaped path the way servers do: unreserved characters
+// are decoded, repeated slashes are collapsed and dot segments are removed.
+func CleanPath(escapedPath string) string {
+	p := normalizeEscapes(escapedPath)
+	if p == "" {
+		return ""
+	}
+
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// normalizeEscapes decodes percent-encoded unreserved characters and
+// uppercases the hex digits of the remaining escapes.
+func normalizeEscapes(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		c := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteString(strings.ToUpper(s[i+1 : i+3]))
+		}
+		i += 2
+	}
+	return b.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
@@ -0,0 +1,157 @@
+package shortener
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultChainTimeout = 5 * time.Second
+	chainUserAgent      = "simple-url-shortener"
+)
+
+// DefaultShortenerDomains are well-known URL shorteners, links to them hide
+// the final destination from the allow and deny lists.
+var DefaultShortenerDomains = []string{
+	"bit.ly", "bitly.com", "buff.ly", "cutt.ly", "goo.gl", "is.gd", "lnkd.in", "ow.ly", "rb.gy",
+	"rebrand.ly", "s.id", "shorturl.at", "t.co", "t.ly", "tiny.cc", "tinyurl.com", "v.gd",
+}
+
+// HTTPClient sends requests to other shorteners, http.Client implements it.
+type HTTPClient interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// newChainClient returns a client that doesn't follow redirects, so every hop is checked,
+// and unless allowInternal is set, doesn't connect to internal addresses either.
+func newChainClient(allowInternal bool) HTTPClient {
+	dialer := &net.Dialer{Timeout: defaultChainTimeout}
+	if !allowInternal {
+		GuardDialer(dialer)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would be dialed instead of the destination.
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   defaultChainTimeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// ownHost tells if the URL points at the service itself.
+func (srv *Service) ownHost(u *url.URL) bool {
+	return strings.EqualFold(strings.TrimSuffix(u.Hostname(), "."), srv.ownHostName)
+}
+
+// shortener tells if the URL is on a domain of another URL shortener or its subdomain.
+func (srv *Service) shortener(u *url.URL) bool {
+	host, _, err := normalizeHost(strings.ToLower(strings.TrimSuffix(u.Hostname(), ".")))
+	if err != nil {
+		return false
+	}
+	for {
+		if srv.shortenerDomains[host] {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return false
+		}
+		host = host[i+1:]
+	}
+}
+
+// checkChain rejects destinations that would redirect back to the service
+// or through another shortener.
+func (srv *Service) checkChain(u *url.URL) error {
+	if srv.ownHost(u) {
+		return NewBadParamsError("links to short links of this service are not allowed", nil)
+	}
+	if srv.shortener(u) {
+		return NewBadParamsError(fmt.Sprintf("links to the url shortener %s are not allowed", u.Hostname()), nil)
+	}
+	return nil
+}
+
+// unwrapChain follows redirects of other shorteners up to the configured
+// number of hops and returns the first destination outside of them.
+// Destinations that aren't on shortener domains are returned as is.
+func (srv *Service) unwrapChain(ctx context.Context, longURL string, parsedURL *url.URL) (string, error) {
+	if srv.ownHost(parsedURL) {
+		return "", NewBadParamsError("links to short links of this service are not allowed", nil)
+	}
+	if !srv.shortener(parsedURL) || srv.maxChainHops == 0 {
+		return longURL, nil
+	}
+
+	current := parsedURL
+	seen := map[string]bool{current.String(): true}
+	for hop := 0; hop < srv.maxChainHops; hop++ {
+		if err := srv.checkSafeDestination(ctx, current); err != nil {
+			return "", err
+		}
+
+		next, err := srv.nextHop(ctx, current)
+		if err != nil {
+			return "", err
+		}
+
+		if srv.ownHost(next) {
+			return "", NewBadParamsError(fmt.Sprintf("%s redirects back to this service", longURL), nil)
+		}
+		if seen[next.String()] {
+			return "", NewBadParamsError(fmt.Sprintf("%s redirects in a loop", longURL), nil)
+		}
+		if !srv.shortener(next) {
+			return next.String(), nil
+		}
+
+		seen[next.String()] = true
+		current = next
+	}
+
+	return "", NewBadParamsError(fmt.Sprintf("%s redirects through more than %d shorteners", longURL, srv.maxChainHops), nil)
+}
+
+// nextHop requests the short link of another shortener and returns the destination it redirects to.
+func (srv *Service) nextHop(ctx context.Context, u *url.URL) (*url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, NewBadParamsError("invalid url format", err)
+	}
+	req.Header.Set("User-Agent", chainUserAgent)
+
+	resp, err := srv.client.Do(req)
+	if err != nil {
+		return nil, NewBadParamsError(fmt.Sprintf("can't follow the short link %s", u), err)
+	}
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	_ = resp.Body.Close()
+
+	location := resp.Header.Get("Location")
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 || location == "" {
+		return nil, NewBadParamsError(fmt.Sprintf("the short link %s doesn't redirect, status %d", u, resp.StatusCode), nil)
+	}
+
+	next, err := u.Parse(location)
+	if err != nil {
+		return nil, NewBadParamsError(fmt.Sprintf("the short link %s redirects to an invalid url", u), err)
+	}
+	if err := validateURL(next); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
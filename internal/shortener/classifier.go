@@ -0,0 +1,93 @@
+package shortener
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	HumanHit    = "human"
+	BotHit      = "bot"
+	PrefetchHit = "prefetch"
+)
+
+// DefaultBotSignatures are user agent words of link preview fetchers,
+// crawlers and scanners. Generic fragments like "bot" aren't listed,
+// they're parts of names of phones and browsers too.
+var DefaultBotSignatures = []string{
+	"googlebot", "bingbot", "yandexbot", "baiduspider", "duckduckbot", "applebot", "ahrefsbot",
+	"semrushbot", "petalbot", "mj12bot", "dotbot", "slurp", "crawler", "spider",
+	"facebookexternalhit", "facebot", "twitterbot", "slackbot", "slack-imgproxy", "linkedinbot",
+	"discordbot", "telegrambot", "pinterestbot", "redditbot", "whatsapp", "skypeuripreview",
+	"embedly", "scanner", "curl", "wget", "python-requests", "go-http-client", "headlesschrome",
+}
+
+// HitClassifier tells human visits apart from bots and browser prefetches.
+type HitClassifier struct {
+	signatures []string
+}
+
+func NewHitClassifier(signatures []string) *HitClassifier {
+	c := &HitClassifier{}
+	for _, s := range signatures {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s != "" {
+			c.signatures = append(c.signatures, s)
+		}
+	}
+	return c
+}
+
+func (c *HitClassifier) Classify(v *Visitor) string {
+	if v == nil {
+		return HumanHit
+	}
+	if isPrefetch(v.Purpose) {
+		return PrefetchHit
+	}
+
+	ua := strings.ToLower(v.UserAgent)
+	for _, s := range c.signatures {
+		if containsWord(ua, s) {
+			return BotHit
+		}
+	}
+
+	return HumanHit
+}
+
+// containsWord tells if the word is in s and isn't a part of a longer word,
+// e.g. "slackbot" is in "Slackbot-LinkExpanding 1.0" but "bot" isn't in "Cubot".
+func containsWord(s, word string) bool {
+	for i := 0; ; {
+		j := strings.Index(s[i:], word)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(word)
+		before, _ := utf8.DecodeLastRuneInString(s[:start])
+		after, _ := utf8.DecodeRuneInString(s[end:])
+		if !isWordRune(before) && !isWordRune(after) {
+			return true
+		}
+		i = start + 1
+	}
+}
+
+// isWordRune tells if r is a letter or a digit, utf8.RuneError of an empty string isn't.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// isPrefetch checks the value of the Purpose or Sec-Purpose header,
+// e.g. "prefetch" or "prefetch;prerender".
+func isPrefetch(purpose string) bool {
+	for _, p := range strings.Split(purpose, ";") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "prefetch" || p == "prerender" || p == "preview" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package shortener
+
+import (
+	"context"
+	"time"
+)
+
+// deduplicable tells if a link with the options may be shared by everyone
+// who shortens the same long URL. UTM parameters are part of the long URL,
+// any other option makes the link a distinct one.
+func deduplicable(opts LinkOptions) bool {
+	return len(opts.Tags) == 0 && !opts.IgnoreBotAccess && !opts.TrackConversions &&
+		len(opts.Routes) == 0 && len(opts.Variants) == 0 && len(opts.Schedule) == 0 &&
+		len(opts.Fallbacks) == 0 && len(opts.Languages) == 0 && !opts.PassPath && !opts.PassQuery &&
+		opts.RedirectStatus == 0 && opts.CacheMaxAge == nil
+}
+
+// duplicate returns the active link to the long URL or nil if there is none.
+func (srv *Service) duplicate(ctx context.Context, longURL string) (*URL, error) {
+	u, err := srv.urlRepository.GetDuplicate(ctx, longURL, srv.expired)
+	if err != nil {
+		if sErr, ok := err.(Error); ok && sErr.Type == NotFoundErrType {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &URL{
+		Long:     u.Long,
+		Short:    srv.keyToURL(u.Short).String(),
+		Existing: true,
+	}, nil
+}
+
+func (srv *Service) expired(lastAccess *time.Time, createdAt time.Time) bool {
+	if lastAccess == nil {
+		lastAccess = &createdAt
+	}
+	return lastAccess.Add(srv.expiredAfter).Before(srv.now())
+}
@@ -0,0 +1,72 @@
+package shortener
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// DurationBucketBase is the growth of duration buckets, so percentiles
+// computed from them are off by 5% at most.
+const DurationBucketBase = 1.05
+
+// DurationBucket returns the bucket of the duration: durations of d
+// milliseconds fall into floor(log(1 + d) / log(DurationBucketBase)).
+func DurationBucket(d time.Duration) int {
+	if d < 0 {
+		d = 0
+	}
+	ms := float64(d) / float64(time.Millisecond)
+	return int(math.Floor(math.Log1p(ms) / math.Log(DurationBucketBase)))
+}
+
+// bucketBounds returns the durations the bucket starts and ends at.
+func bucketBounds(bucket int) (time.Duration, time.Duration) {
+	bound := func(b int) time.Duration {
+		return time.Duration((math.Pow(DurationBucketBase, float64(b)) - 1) * float64(time.Millisecond))
+	}
+	return bound(bucket), bound(bucket + 1)
+}
+
+func clickDistribution(h *ClickHistograms) ClickDistribution {
+	var d ClickDistribution
+	for _, b := range h.Times {
+		d.ByHour[b.Hour] += b.Count
+		d.ByWeekday[b.Weekday] += b.Count
+	}
+	d.LinkAge = histogramPercentiles(h.LinkAge)
+	d.InterClick = histogramPercentiles(h.InterClick)
+	return d
+}
+
+// histogramPercentiles interpolates between the closest ranks like
+// percentile_cont does, values are assumed to be spread evenly within buckets.
+func histogramPercentiles(buckets []DurationCount) Percentiles {
+	buckets = append([]DurationCount(nil), buckets...)
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Bucket < buckets[j].Bucket })
+
+	total := 0
+	for _, b := range buckets {
+		total += b.Count
+	}
+	if total == 0 {
+		return Percentiles{}
+	}
+
+	p := func(fraction float64) time.Duration {
+		rank := fraction * float64(total-1)
+		before := 0
+		for _, b := range buckets {
+			if b.Count > 0 && rank < float64(before+b.Count) {
+				lower, upper := bucketBounds(b.Bucket)
+				position := (rank - float64(before) + 0.5) / float64(b.Count)
+				return lower + time.Duration(position*float64(upper-lower))
+			}
+			before += b.Count
+		}
+		_, upper := bucketBounds(buckets[len(buckets)-1].Bucket)
+		return upper
+	}
+
+	return Percentiles{P50: p(0.5), P90: p(0.9), P99: p(0.99)}
+}
@@ -1,17 +1,28 @@
 package shortener
 
+import "errors"
+
+// ErrExpired is the origin of not found errors of expired URLs.
+var ErrExpired = errors.New("url is expired")
+
 type Error struct {
 	ErrText string
 	Origin  error
 	Type    int
+	// Code tells apart errors of the same type for clients, it's empty for most errors.
+	Code string
 }
 
 const (
 	NotFoundErrType = iota
 	InternalErrType
 	BadParamsErrType
+	ForbiddenErrType
 )
 
+// DestinationDeniedCode is the code of errors of destinations denied by the DestinationFilter.
+const DestinationDeniedCode = "destination_denied"
+
 func (e Error) Error() string {
 	return e.ErrText
 }
@@ -23,6 +34,15 @@ func NewNotFoundError(errText string) error {
 	}
 }
 
+// NewExpiredError is a not found error that can be told apart by its origin.
+func NewExpiredError(errText string) error {
+	return Error{
+		ErrText: errText,
+		Origin:  ErrExpired,
+		Type:    NotFoundErrType,
+	}
+}
+
 func NewInternalError(errText string, originErr error) error {
 	return Error{
 		ErrText: errText,
@@ -38,3 +58,11 @@ func NewBadParamsError(errText string, originErr error) error {
 		Type:    BadParamsErrType,
 	}
 }
+
+func NewDestinationDeniedError(errText string) error {
+	return Error{
+		ErrText: errText,
+		Type:    ForbiddenErrType,
+		Code:    DestinationDeniedCode,
+	}
+}
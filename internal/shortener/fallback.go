@@ -0,0 +1,37 @@
+package shortener
+
+import "fmt"
+
+const maxFallbacks = 5
+
+// healthy returns the first healthy destination out of the origin and its
+// fallbacks, the origin is kept if all of them are down.
+func healthy(u *URL) string {
+	if !u.Unhealthy[u.Long] {
+		return u.Long
+	}
+	for _, f := range u.Fallbacks {
+		if !u.Unhealthy[f] {
+			return f
+		}
+	}
+	return u.Long
+}
+
+func normalizeFallbacks(fallbacks []string) ([]string, error) {
+	if len(fallbacks) > maxFallbacks {
+		return nil, NewBadParamsError(fmt.Sprintf("no more than %d fallbacks are allowed", maxFallbacks), nil)
+	}
+
+	for i, f := range fallbacks {
+		parsed, err := parseURL(f)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateURL(parsed); err != nil {
+			return nil, NewBadParamsError(fmt.Sprintf("fallback #%d: %s", i, err), nil)
+		}
+	}
+
+	return fallbacks, nil
+}
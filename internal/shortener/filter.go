@@ -0,0 +1,66 @@
+package shortener
+
+import (
+	"context"
+	"fmt"
+)
+
+// checkDestination fails if the destination filter denies the URL.
+func (srv *Service) checkDestination(destination string) error {
+	if srv.filter == nil {
+		return nil
+	}
+
+	u, err := parseURL(destination)
+	if err != nil {
+		return err
+	}
+	if !srv.filter.Allowed(u) {
+		return NewDestinationDeniedError(fmt.Sprintf("links to %s are not allowed", u.Hostname()))
+	}
+	return nil
+}
+
+// checkDestinations checks new destinations of links, they must be safe, allowed and
+// mustn't redirect through this or another shortener.
+func (srv *Service) checkDestinations(ctx context.Context, destinations []string) error {
+	for _, d := range destinations {
+		u, err := parseURL(d)
+		if err != nil {
+			return err
+		}
+		if err := srv.checkSafeDestination(ctx, u); err != nil {
+			return err
+		}
+		if err := srv.checkChain(u); err != nil {
+			return err
+		}
+		if err := srv.checkDestination(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// destinations returns every alternative destination of the link.
+func (opts LinkOptions) destinations() []string {
+	destinations := append([]string(nil), opts.Fallbacks...)
+	for _, r := range opts.Routes {
+		if r.Destination != "" {
+			destinations = append(destinations, r.Destination)
+		}
+		if universalLink(r.DeepLink) {
+			destinations = append(destinations, r.DeepLink)
+		}
+	}
+	for _, v := range opts.Variants {
+		destinations = append(destinations, v.Destination)
+	}
+	for _, e := range opts.Schedule {
+		destinations = append(destinations, e.Destination)
+	}
+	for _, l := range opts.Languages {
+		destinations = append(destinations, l.Destination)
+	}
+	return destinations
+}
@@ -0,0 +1,177 @@
+package shortener
+
+import (
+	"fmt"
+	"golang.org/x/net/idna"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Policies for hostnames that mix letters of several scripts, a common trick
+// of lookalike domains, e.g. "pаypal.com" with a Cyrillic "а".
+const (
+	MixedScriptAllow  = "allow"
+	MixedScriptFlag   = "flag"
+	MixedScriptReject = "reject"
+)
+
+// ValidMixedScriptPolicy tells if the policy is one of the supported ones.
+func ValidMixedScriptPolicy(policy string) bool {
+	return policy == MixedScriptAllow || policy == MixedScriptFlag || policy == MixedScriptReject
+}
+
+// Script combinations that are common in a single label, as allowed by the
+// highly restrictive level of Unicode Technical Standard #39.
+var allowedScriptSets = [][]string{
+	{"Latin", "Han", "Hiragana", "Katakana"},
+	{"Latin", "Han", "Bopomofo"},
+	{"Latin", "Han", "Hangul"},
+}
+
+// normalizeHost converts an internationalized hostname into its ASCII form by
+// IDNA2008 rules and returns its Unicode form for display as well. Hostnames
+// without non-ASCII characters or punycode labels are returned as is, so IP
+// addresses and names the IDNA rules are stricter about keep working.
+func normalizeHost(host string) (ascii, display string, err error) {
+	if !isIDN(host) {
+		return host, host, nil
+	}
+
+	if ascii, err = idna.Lookup.ToASCII(host); err != nil {
+		return "", "", NewBadParamsError(fmt.Sprintf("invalid internationalized host name %q", host), err)
+	}
+	if display, err = idna.Lookup.ToUnicode(ascii); err != nil {
+		return "", "", NewBadParamsError(fmt.Sprintf("invalid internationalized host name %q", host), err)
+	}
+	return ascii, display, nil
+}
+
+func isIDN(host string) bool {
+	for i := 0; i < len(host); i++ {
+		if host[i] >= utf8.RuneSelf {
+			return true
+		}
+	}
+	for _, label := range strings.Split(host, ".") {
+		if strings.HasPrefix(strings.ToLower(label), "xn--") {
+			return true
+		}
+	}
+	return false
+}
+
+// mixedScript tells if a label of the Unicode hostname mixes letters of
+// scripts that aren't normally used together.
+func mixedScript(host string) bool {
+	for _, label := range strings.Split(host, ".") {
+		scripts := make(map[string]bool)
+		for _, r := range label {
+			if !unicode.IsLetter(r) {
+				continue
+			}
+			if s := scriptOf(r); s != "" {
+				scripts[s] = true
+			}
+		}
+		if len(scripts) > 1 && !allowedScripts(scripts) {
+			return true
+		}
+	}
+	return false
+}
+
+func scriptOf(r rune) string {
+	for name, table := range unicode.Scripts {
+		if name != "Common" && name != "Inherited" && unicode.Is(table, r) {
+			return name
+		}
+	}
+	return ""
+}
+
+func allowedScripts(scripts map[string]bool) bool {
+	for _, set := range allowedScriptSets {
+		n := 0
+		for _, s := range set {
+			if scripts[s] {
+				n++
+			}
+		}
+		if n == len(scripts) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeIDN rewrites the host of the long URL into the ASCII form, mixed
+// is set for mixed-script hosts the policy doesn't reject.
+func (srv *Service) normalizeIDN(longURL string, parsedURL *url.URL) (normalized string, mixed bool, err error) {
+	ascii, unicodeHost, err := normalizeHost(parsedURL.Hostname())
+	if err != nil {
+		return "", false, err
+	}
+
+	if mixedScript(unicodeHost) {
+		switch srv.mixedScriptPolicy {
+		case MixedScriptReject:
+			return "", false, NewBadParamsError(fmt.Sprintf("host name %q mixes scripts", unicodeHost), nil)
+		case MixedScriptFlag:
+			mixed = true
+			srv.log.Warn().Msgf("host name %q of %s mixes scripts", unicodeHost, ascii)
+		}
+	}
+
+	return withHost(longURL, parsedURL, ascii), mixed, nil
+}
+
+// asciiURL rewrites the host of the URL into the ASCII form regardless of the policy.
+func asciiURL(longURL string, parsedURL *url.URL) (string, error) {
+	ascii, _, err := normalizeHost(parsedURL.Hostname())
+	if err != nil {
+		return "", err
+	}
+	return withHost(longURL, parsedURL, ascii), nil
+}
+
+func withHost(longURL string, parsedURL *url.URL, host string) string {
+	if host == parsedURL.Hostname() {
+		return longURL
+	}
+	return replaceHost(longURL, host, parsedURL.Port())
+}
+
+// displayURL returns the URL with an internationalized host in the Unicode form.
+func displayURL(longURL string) string {
+	parsedURL, err := url.Parse(longURL)
+	if err != nil || !isIDN(parsedURL.Hostname()) {
+		return longURL
+	}
+
+	_, unicodeHost, err := normalizeHost(parsedURL.Hostname())
+	if err != nil {
+		return longURL
+	}
+	return replaceHost(longURL, unicodeHost, parsedURL.Port())
+}
+
+// replaceHost replaces the host in the authority of the raw URL and keeps the
+// rest of it as is, unlike url.URL.String that escapes Unicode characters.
+func replaceHost(rawURL, host, port string) string {
+	i := strings.Index(rawURL, "://")
+	if i < 0 {
+		return rawURL
+	}
+	rest := rawURL[i+len("://"):]
+	end := strings.IndexAny(rest, "/?#")
+	if end < 0 {
+		end = len(rest)
+	}
+	userinfo := rest[:strings.LastIndex(rest[:end], "@")+1]
+	if port != "" {
+		host += ":" + port
+	}
+	return rawURL[:i+len("://")] + userinfo + host + rest[end:]
+}
@@ -0,0 +1,92 @@
+package shortener
+
+import (
+	"fmt"
+	"golang.org/x/text/language"
+)
+
+const maxLanguages = 20
+
+// LanguageDestination is a localized destination of a link, Tag is a BCP 47 language tag.
+type LanguageDestination struct {
+	Tag         string
+	Destination string
+}
+
+// Localization is the language of the long URL and its localized destinations.
+type Localization struct {
+	// Default is the BCP 47 tag of the long URL, it's required with localized destinations.
+	Default   string
+	Languages []LanguageDestination
+}
+
+// negotiateLanguage picks the destination that best matches the Accept-Language
+// header of the visitor, weighting languages by their quality values. The default
+// language takes part in the negotiation, no destination is picked if it wins.
+func negotiateLanguage(defaultTag string, languages []LanguageDestination, acceptLanguage string) (string, bool) {
+	if len(languages) == 0 || acceptLanguage == "" {
+		return "", false
+	}
+
+	desired, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(desired) == 0 {
+		return "", false
+	}
+
+	supported := make([]language.Tag, 0, len(languages)+1)
+	supported = append(supported, language.Make(defaultTag))
+	for _, l := range languages {
+		supported = append(supported, language.Make(l.Tag))
+	}
+
+	_, i, confidence := language.NewMatcher(supported).Match(desired...)
+	if confidence == language.No || i == 0 {
+		return "", false
+	}
+	return languages[i-1].Destination, true
+}
+
+func normalizeLocalization(loc *Localization) error {
+	if len(loc.Languages) > maxLanguages {
+		return NewBadParamsError(fmt.Sprintf("no more than %d languages are allowed", maxLanguages), nil)
+	}
+	if loc.Default == "" {
+		if len(loc.Languages) > 0 {
+			return NewBadParamsError("default language is required with localized destinations", nil)
+		}
+		return nil
+	}
+
+	tag, err := language.Parse(loc.Default)
+	if err != nil {
+		return NewBadParamsError(fmt.Sprintf("invalid default language %q", loc.Default), nil)
+	}
+	loc.Default = tag.String()
+
+	normalized := make([]LanguageDestination, 0, len(loc.Languages))
+	seen := map[string]bool{loc.Default: true}
+	for i, l := range loc.Languages {
+		tag, err := language.Parse(l.Tag)
+		if err != nil {
+			return NewBadParamsError(fmt.Sprintf("language #%d: invalid tag %q", i, l.Tag), nil)
+		}
+		l.Tag = tag.String()
+		if seen[l.Tag] {
+			return NewBadParamsError(fmt.Sprintf("language #%d: duplicate tag %q", i, l.Tag), nil)
+		}
+		seen[l.Tag] = true
+
+		parsed, err := parseURL(l.Destination)
+		if err != nil {
+			return err
+		}
+		if err := validateURL(parsed); err != nil {
+			return NewBadParamsError(fmt.Sprintf("language #%d: %s", i, err), nil)
+		}
+
+		normalized = append(normalized, l)
+	}
+
+	loc.Languages = normalized
+	return nil
+}
@@ -1,21 +1,127 @@
 package shortener
 
-import "time"
+import (
+	"fmt"
+	"github.com/kalinink/simple-url-shortener/internal/hll"
+	"time"
+)
 
 type URL struct {
-	Long  string
-	Short string
+	Long string
+	// Display is Long with an internationalized host in the Unicode form.
+	Display string
+	Short   string
+	// Variant is the number of the chosen variant starting from 1, 0 if there was no rotation.
+	Variant int
+	// DeepLink opens an app of the visitor on resolution, Long is opened if it isn't installed.
+	DeepLink string
+	// ResolvedAt is the time of the resolution by the service clock.
+	ResolvedAt time.Time
+	// Unhealthy are the origin or fallbacks that failed the last health check.
+	Unhealthy map[string]bool
+	// Existing is set if an existing link to the same origin was returned instead of a new one.
+	Existing bool
+	// MixedScript flags a long URL whose host name mixes scripts, e.g. Latin and Cyrillic.
+	MixedScript bool
+	LinkOptions
+}
+
+// LinkOptions are optional per-link settings given on creation.
+type LinkOptions struct {
+	// IgnoreBotAccess keeps bot and prefetch hits from extending the link life.
+	IgnoreBotAccess bool
+	Tags            []string
+	// TrackConversions appends a click ID to the long URL on resolution,
+	// so conversions can be attributed to the click.
+	TrackConversions bool
+	Routes           []Route
+	// Variants rotate the destination of visitors that don't match any route.
+	Variants []Variant
+	// Schedule changes the destination over time, it's sorted by start.
+	Schedule []ScheduleEntry
+	// Fallbacks replace the origin in order while it fails health checks.
+	Fallbacks []string
+	// Languages are localized destinations negotiated by the Accept-Language header
+	// along with DefaultLanguage, the language of the long URL.
+	DefaultLanguage string
+	Languages       []LanguageDestination
+	// PassPath appends the path after the key of the short URL to the destination,
+	// PassQuery merges the query of the short URL into the destination one.
+	PassPath  bool
+	PassQuery bool
+	// RedirectStatus and CacheMaxAge control browser redirects, the service
+	// defaults are used if they're zero and nil. A zero max age disables caching.
+	RedirectStatus int
+	CacheMaxAge    *time.Duration
+	// UTM are campaign parameters merged into the query of the long URL.
+	UTM UTM
 }
 
 type NewURL struct {
-	Long      string
+	// Long is tagged with the UTM parameters of the link, RawLong is the input of the user as is.
+	Long    string
+	RawLong string
+	// Canonical is the canonical form of Long, links are looked up by it.
+	Canonical string
 	Short     string
 	CreatedAt time.Time
+	// Domain is the lowercased host of the long URL.
+	Domain string
+	// Deduplicated links are reused by later requests for the same Long.
+	Deduplicated bool
+	MixedScript  bool
+	LinkOptions
 }
 
 type ShortURL struct {
 	URL        string
 	AccessTime time.Time
+	HitKind    string
+}
+
+// Visitor describes the client that resolves a short URL.
+type Visitor struct {
+	IP        string
+	UserAgent string
+	// Purpose is the value of the Purpose or Sec-Purpose request header.
+	Purpose        string
+	AcceptLanguage string
+	// Variants the visitor was assigned before, by the short URL key.
+	Variants map[string]int
+}
+
+// Location is a country as ISO 3166-1 alpha-2 code and a region as ISO 3166-2 code, e.g. "US" and "US-CA".
+type Location struct {
+	Country string
+	Region  string
+}
+
+// DestinationHealth is the result of the last health check of a destination.
+type DestinationHealth struct {
+	URL        string
+	Healthy    bool
+	StatusCode int
+	Error      string
+	CheckedAt  time.Time
+}
+
+// Access is a single resolution of a short URL. VisitorHash is a salted hash
+// of the visitor, raw client data is never passed to the repository.
+type Access struct {
+	ShortURL    string
+	AccessAt    time.Time
+	VisitorHash uint64
+	HitKind     string
+	ClickID     string
+	Variant     int
+}
+
+// ClickEvent is published on every resolution of a short URL.
+type ClickEvent struct {
+	Key     string
+	Long    string
+	HitKind string
+	At      time.Time
 }
 
 type OverallStatistics struct {
@@ -27,3 +133,202 @@ type Statistics struct {
 	Count  int
 	Timing *time.Time
 }
+
+// DetailedStatistics extends OverallStatistics with the distribution of human clicks.
+type DetailedStatistics struct {
+	OverallStatistics
+	Clicks ClickDistribution
+}
+
+type ClickDistribution struct {
+	// ByHour and ByWeekday count clicks per UTC hour of day and per day of week, Sunday first.
+	ByHour    [24]int
+	ByWeekday [7]int
+	// LinkAge is the age of links at the moment they are clicked.
+	LinkAge Percentiles
+	// InterClick is the interval between consecutive clicks of the same link.
+	InterClick Percentiles
+}
+
+// ClickHistograms are counts of human clicks the ClickDistribution is computed from.
+type ClickHistograms struct {
+	Times []ClickTimeCount
+	// LinkAge and InterClick count durations by their DurationBucket.
+	LinkAge    []DurationCount
+	InterClick []DurationCount
+}
+
+type ClickTimeCount struct {
+	Hour    int
+	Weekday int
+	Count   int
+}
+
+type DurationCount struct {
+	Bucket int
+	Count  int
+}
+
+type Percentiles struct {
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+}
+
+type LinkStatistics struct {
+	ShortURL    string
+	Clicks      int
+	BotClicks   int
+	Uniques     uint64
+	Conversions int
+	// ConversionRate is the share of clicks that led to a conversion.
+	ConversionRate float64
+	Daily          []DailyStatistics
+	Variants       []VariantStatistics
+}
+
+// DailyStatistics counts human clicks and bot or prefetch hits separately,
+// only human visitors are added to the Visitors sketch.
+type DailyStatistics struct {
+	Day         time.Time
+	Clicks      int
+	BotClicks   int
+	Uniques     uint64
+	Conversions int
+	Visitors    *hll.Sketch
+}
+
+const (
+	TopByClicks = "clicks"
+	TopTrending = "trending"
+)
+
+// TopQuery selects the most clicked links over the last Window. In the
+// trending mode links are ranked by growth against the previous window.
+type TopQuery struct {
+	Mode   string
+	Window time.Duration
+	Limit  int
+	Tag    string
+	Domain string
+}
+
+// TopFilter is TopQuery resolved into time ranges: the current window is
+// [Since, Until) and the previous one is [PreviousSince, Since).
+type TopFilter struct {
+	PreviousSince time.Time
+	Since         time.Time
+	Until         time.Time
+	Trending      bool
+	Limit         int
+	Tag           string
+	Domain        string
+}
+
+// GrowthFilter selects links with the current window [Since, Until) like TopFilter
+// whose clicks reach Threshold, if it's positive, or reach MinClicks and exceed
+// Ratio times the clicks of the previous window [PreviousSince, Since).
+type GrowthFilter struct {
+	PreviousSince time.Time
+	Since         time.Time
+	Until         time.Time
+	MinClicks     int
+	Ratio         float64
+	Threshold     int
+}
+
+type TopLink struct {
+	Long           string
+	Short          string
+	Clicks         int
+	PreviousClicks int
+	// Growth is the relative change of clicks against the previous window.
+	Growth float64
+}
+
+const (
+	ExportEvents  = "events"
+	ExportRollups = "rollups"
+)
+
+// ExportQuery selects access events or daily rollups in [From, Until).
+type ExportQuery struct {
+	Kind  string
+	From  time.Time
+	Until time.Time
+}
+
+// Validate allows to check the query before the output is started.
+func (q ExportQuery) Validate() error {
+	if q.Kind != ExportEvents && q.Kind != ExportRollups {
+		return NewBadParamsError(fmt.Sprintf("kind must be %q or %q", ExportEvents, ExportRollups), nil)
+	}
+	if !q.From.Before(q.Until) {
+		return NewBadParamsError("the beginning of the period must be before its end", nil)
+	}
+	return nil
+}
+
+type AccessEvent struct {
+	ShortURL string
+	AccessAt time.Time
+	HitKind  string
+}
+
+type DailyRollup struct {
+	ShortURL string
+	DailyStatistics
+}
+
+const (
+	ExactMatch     = "exact"
+	CanonicalMatch = "canonical"
+)
+
+// TargetQuery selects links by the long URL, either as given or as stored
+// (URL) or by its canonical form (Canonical).
+type TargetQuery struct {
+	URL       string
+	Canonical string
+	Offset    int
+	Limit     int
+}
+
+// TargetLinks is a page of links found by their destination, Truncated is set
+// if there are more links after the page.
+type TargetLinks struct {
+	Links     []TargetLink
+	Truncated bool
+}
+
+// TargetLink is a link found by its destination, both active and expired ones are found.
+type TargetLink struct {
+	Short      string
+	Long       string
+	Display    string
+	CreatedAt  time.Time
+	LastAccess *time.Time
+	Expired    bool
+}
+
+const (
+	NotFoundMiss   = "not_found"
+	ExpiredMiss    = "expired"
+	BadRequestMiss = "bad_request"
+	DeniedMiss     = "denied"
+)
+
+// Miss is a failed resolution of a short URL. Key is the attempted key,
+// or the reason the request is rejected for bad requests.
+type Miss struct {
+	Key        string
+	Event      string
+	HitKind    string
+	OccurredAt time.Time
+}
+
+type MissCount struct {
+	Key      string
+	Count    int
+	LastSeen time.Time
+}
@@ -0,0 +1,68 @@
+package shortener
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// ErrInternalAddress is returned by dialers guarded with GuardDialer
+// when they're about to connect to an internal address.
+var ErrInternalAddress = errors.New("destination resolves to an internal address")
+
+// privateNetworks are the ranges that aren't reachable from the internet
+// apart from loopback, link-local and multicast ones checked by net.IP methods.
+var privateNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"240.0.0.0/4",
+	"fc00::/7",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, n)
+	}
+	return networks
+}
+
+// InternalIP tells if the address is private, loopback, link-local, multicast or unspecified.
+func InternalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// GuardDialer makes the dialer check the address of every connection after
+// the host name is resolved, so it never reaches an internal address
+// whatever the name resolves to at the moment.
+func GuardDialer(dialer *net.Dialer) *net.Dialer {
+	dialer.Control = func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || InternalIP(ip) {
+			return ErrInternalAddress
+		}
+		return nil
+	}
+	return dialer
+}
@@ -0,0 +1,70 @@
+package shortener
+
+import (
+	"net/url"
+	"strings"
+)
+
+// splitShortPath separates the key of a short URL from the path suffix
+// that follows it, e.g. "/docs/api/v2" is split into "docs" and "/api/v2".
+// The suffix is returned both decoded and escaped.
+func splitShortPath(u *url.URL) (key, suffix, rawSuffix string) {
+	path := strings.TrimLeft(u.Path, "/")
+	i := strings.IndexByte(path, '/')
+	if i < 0 {
+		return path, "", ""
+	}
+
+	rawPath := strings.TrimLeft(u.EscapedPath(), "/")
+	if j := strings.IndexByte(rawPath, '/'); j >= 0 {
+		rawSuffix = rawPath[j:]
+	}
+	return path[:i], path[i:], rawSuffix
+}
+
+// safeSuffix rejects suffixes that would leave the path of the destination
+// once a server resolves them: dot segments, encoded slashes and backslashes.
+func safeSuffix(suffix, rawSuffix string) bool {
+	lower := strings.ToLower(rawSuffix)
+	if strings.Contains(lower, "%2f") || strings.Contains(lower, "%5c") || strings.Contains(suffix, "\\") {
+		return false
+	}
+	for _, segment := range strings.Split(suffix, "/") {
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// passThrough appends the path suffix and merges the query of the short URL
+// into the destination as the link allows. Parameters of the short URL
+// replace the destination ones with the same name.
+func passThrough(destination string, opts *LinkOptions, suffix, rawSuffix string, query url.Values) string {
+	passPath := opts.PassPath && suffix != ""
+	passQuery := opts.PassQuery && len(query) > 0
+	if !passPath && !passQuery {
+		return destination
+	}
+
+	dest, err := url.Parse(destination)
+	if err != nil {
+		return destination
+	}
+
+	if passPath {
+		rawPath := strings.TrimSuffix(dest.EscapedPath(), "/") + rawSuffix
+		dest.Path = strings.TrimSuffix(dest.Path, "/") + suffix
+		dest.RawPath = rawPath
+	}
+
+	if passQuery {
+		merged := dest.Query()
+		for k, v := range query {
+			merged[k] = v
+		}
+		dest.RawQuery = merged.Encode()
+	}
+
+	return dest.String()
+}
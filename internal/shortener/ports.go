@@ -2,19 +2,102 @@ package shortener
 
 import (
 	"context"
+	"net"
+	"net/url"
+	"time"
 )
 
 type URLShortenerService interface {
-	GetLongURL(ctx context.Context, shortURL string) (*URL, error)
-	CreateShortURL(ctx context.Context, longURL string) (*URL, error)
+	GetLongURL(ctx context.Context, shortURL string, visitor *Visitor) (*URL, error)
+	CreateShortURL(ctx context.Context, longURL string, opts LinkOptions) (*URL, error)
 	Statistics(context.Context) (*OverallStatistics, error)
+	DetailedStatistics(context.Context) (*DetailedStatistics, error)
+	LinkStatistics(ctx context.Context, key string, days int) (*LinkStatistics, error)
+	TopLinks(context.Context, TopQuery) ([]TopLink, error)
+	Export(context.Context, ExportQuery, ExportWriter) error
+	TopMisses(ctx context.Context, event string, window time.Duration, limit int) ([]MissCount, error)
+	Convert(ctx context.Context, clickID string) error
+	Routes(ctx context.Context, key string) ([]Route, error)
+	SetRoutes(ctx context.Context, key string, routes []Route) error
+	Languages(ctx context.Context, key string) (*Localization, error)
+	SetLanguages(ctx context.Context, key string, localization *Localization) error
+	Schedule(ctx context.Context, key string) ([]ScheduleEntry, error)
+	SetSchedule(ctx context.Context, key string, schedule []ScheduleEntry) error
+	UTMTemplate(ctx context.Context, tag string) (*UTM, error)
+	SetUTMTemplate(ctx context.Context, tag string, utm UTM) error
+	Campaigns(ctx context.Context, window time.Duration, limit int) ([]CampaignStatistics, error)
+	FindLinks(ctx context.Context, target, match string, offset int) (*TargetLinks, error)
+}
+
+// ExportWriter encodes exported records, e.g. as CSV.
+type ExportWriter interface {
+	WriteEvent(*AccessEvent) error
+	WriteRollup(*DailyRollup) error
 }
 
 type URLRepository interface {
 	Save(context.Context, *NewURL) error
 	GetIfNotExpired(context.Context, *ShortURL, CheckExpiredFunc) (*URL, error)
+	// UpdateAccess extends the life of the link, it's called once the link is resolved.
+	UpdateAccess(ctx context.Context, shortURL string, at time.Time) error
+	// GetDuplicate finds the active deduplicated link to the origin, expired ones are marked as such.
+	GetDuplicate(ctx context.Context, origin string, expired CheckExpiredFunc) (*URL, error)
 	IncShort(context.Context) error
-	IncLong(context.Context) error
+	IncLong(context.Context, *Access) error
 	StatShortURL(context.Context) (*Statistics, error)
 	StatLongURL(context.Context) (*Statistics, error)
+	ClickHistograms(context.Context) (*ClickHistograms, error)
+	DailyStatistics(ctx context.Context, shortURL string, from time.Time) ([]DailyStatistics, error)
+	// VariantStatistics counts human clicks of every variant of the short URL since from.
+	VariantStatistics(ctx context.Context, shortURL string, from time.Time) ([]VariantStatistics, error)
+	TopLinks(context.Context, *TopFilter) ([]TopLink, error)
+	// ExportEvents and ExportRollups stream records one by one without
+	// loading the whole range into memory, iteration stops on the first error.
+	ExportEvents(ctx context.Context, from, until time.Time, fn func(*AccessEvent) error) error
+	ExportRollups(ctx context.Context, from, until time.Time, fn func(*DailyRollup) error) error
+	AddMiss(context.Context, *Miss) error
+	// DeleteMisses deletes misses occurred before the time and returns their number.
+	DeleteMisses(ctx context.Context, before time.Time) (int64, error)
+	TopMisses(ctx context.Context, event string, since time.Time, limit int) ([]MissCount, error)
+	// AddConversion records a conversion of the click once, repeated ones are ignored.
+	AddConversion(ctx context.Context, clickID string, at time.Time) error
+	Routes(ctx context.Context, shortURL string) ([]Route, error)
+	// SetRoutes replaces all routes of the short URL.
+	SetRoutes(ctx context.Context, shortURL string, routes []Route) error
+	Languages(ctx context.Context, shortURL string) (*Localization, error)
+	// SetLanguages replaces the default language and all localized destinations of the short URL.
+	SetLanguages(ctx context.Context, shortURL string, localization *Localization) error
+	Schedule(ctx context.Context, shortURL string) ([]ScheduleEntry, error)
+	// SetSchedule replaces the whole schedule of the short URL.
+	SetSchedule(ctx context.Context, shortURL string, schedule []ScheduleEntry) error
+	// UTMTemplates returns the templates of the tags that have one.
+	UTMTemplates(ctx context.Context, tags []string) (map[string]UTM, error)
+	// SetUTMTemplate deletes the template of the tag if utm is zero.
+	SetUTMTemplate(ctx context.Context, tag string, utm UTM) error
+	Campaigns(ctx context.Context, since, until time.Time, limit int) ([]CampaignStatistics, error)
+	// WithoutCanonical returns up to limit links whose canonical form isn't stored yet.
+	WithoutCanonical(ctx context.Context, limit int) ([]URL, error)
+	SetCanonical(ctx context.Context, shortURL, canonical string) error
+	// FindLinks returns the newest links to the target first, ties are ordered by the key.
+	FindLinks(context.Context, *TargetQuery) ([]TargetLink, error)
+}
+
+// ClickPublisher delivers click events to live subscribers, Publish mustn't block.
+type ClickPublisher interface {
+	Publish(*ClickEvent)
+}
+
+// GeoLocator finds the location of an IP address, e.g. in a GeoIP database.
+type GeoLocator interface {
+	Locate(net.IP) (Location, error)
+}
+
+// DestinationFilter tells if links may point at the URL, e.g. by allow and deny lists.
+type DestinationFilter interface {
+	Allowed(*url.URL) bool
+}
+
+// Resolver looks up IP addresses of host names, net.Resolver implements it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
 }
@@ -0,0 +1,42 @@
+package shortener
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultRedirectStatus = http.StatusFound
+	maxCacheMaxAge        = 365 * 24 * time.Hour
+)
+
+// ValidRedirectStatus reports whether browsers can be redirected with the status.
+func ValidRedirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// applyRedirectDefaults fills the redirect settings the link doesn't override.
+func (srv *Service) applyRedirectDefaults(opts *LinkOptions) {
+	if opts.RedirectStatus == 0 {
+		opts.RedirectStatus = srv.redirectStatus
+	}
+	if opts.CacheMaxAge == nil {
+		maxAge := srv.cacheMaxAge
+		opts.CacheMaxAge = &maxAge
+	}
+}
+
+func validateRedirect(opts *LinkOptions) error {
+	if opts.RedirectStatus != 0 && !ValidRedirectStatus(opts.RedirectStatus) {
+		return NewBadParamsError("redirect status must be 301, 302, 307 or 308", nil)
+	}
+	if opts.CacheMaxAge != nil && (*opts.CacheMaxAge < 0 || *opts.CacheMaxAge > maxCacheMaxAge) {
+		return NewBadParamsError(fmt.Sprintf("cache max age must be between 0 and %s", maxCacheMaxAge), nil)
+	}
+	return nil
+}
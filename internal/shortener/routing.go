@@ -0,0 +1,230 @@
+package shortener
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	OSRoute      = "os"
+	DeviceRoute  = "device"
+	CountryRoute = "country"
+	RegionRoute  = "region"
+
+	maxRoutes = 20
+)
+
+// Route sends visitors matching the rule to its own destination.
+// Routes are evaluated in order and the first matching one wins.
+type Route struct {
+	Kind        string
+	Match       string
+	Destination string
+	// DeepLink opens an app, e.g. "example://product/1". The Destination, like
+	// a store page, is opened if the app isn't installed. A route with a deep
+	// link may have no Destination, the link resolves as usual then.
+	DeepLink string
+}
+
+// unsafeDeepLinkSchemes run code or read data in the browser instead of opening an app.
+var unsafeDeepLinkSchemes = map[string]bool{
+	"javascript": true,
+	"vbscript":   true,
+	"data":       true,
+	"file":       true,
+	"blob":       true,
+	"about":      true,
+}
+
+var (
+	countryCode = regexp.MustCompile(`^[a-z]{2}$`)
+	// regionCode is an ISO 3166-2 code like "us-ca".
+	regionCode = regexp.MustCompile(`^[a-z]{2}-[a-z0-9]{1,3}$`)
+)
+
+var routeMatches = map[string]func(string) bool{
+	OSRoute:      oneOf(IOS, Android, Windows, MacOS, ChromeOS, Linux),
+	DeviceRoute:  oneOf(Mobile, Tablet, Desktop),
+	CountryRoute: countryCode.MatchString,
+	RegionRoute:  regionCode.MatchString,
+}
+
+func oneOf(values ...string) func(string) bool {
+	return func(s string) bool {
+		for _, v := range values {
+			if s == v {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// route picks the destination of the visitor at the moment and the number
+// of the chosen variant, the deep link of the matching route is set to u.
+// Routes win over the schedule, the schedule over languages, languages over
+// variants and the first healthy of the origin and its fallbacks is the default.
+func (srv *Service) route(u *URL, visitor *Visitor, at time.Time) (string, int) {
+	if len(u.Routes) > 0 {
+		m := &routeMatcher{srv: srv, visitor: visitor}
+		for _, r := range u.Routes {
+			if !m.matches(r) {
+				continue
+			}
+			u.DeepLink = r.DeepLink
+			if r.Destination != "" {
+				return r.Destination, 0
+			}
+			break
+		}
+	}
+
+	if destination, ok := scheduled(u.Schedule, at); ok {
+		return destination, 0
+	}
+
+	if visitor != nil {
+		if destination, ok := negotiateLanguage(u.DefaultLanguage, u.Languages, visitor.AcceptLanguage); ok {
+			return destination, 0
+		}
+	}
+
+	if n := chooseVariant(u, visitor); n > 0 {
+		return u.Variants[n-1].Destination, n
+	}
+
+	return healthy(u), 0
+}
+
+// routeMatcher looks up visitor properties lazily, so links without
+// geo routes never hit the GeoIP database.
+type routeMatcher struct {
+	srv     *Service
+	visitor *Visitor
+
+	client   *Client
+	location *Location
+}
+
+func (m *routeMatcher) matches(r Route) bool {
+	switch r.Kind {
+	case OSRoute:
+		return r.Match == m.getClient().OS
+	case DeviceRoute:
+		return r.Match == m.getClient().Device
+	case CountryRoute:
+		return r.Match == m.getLocation().Country
+	case RegionRoute:
+		return r.Match == m.getLocation().Region
+	}
+	return false
+}
+
+func (m *routeMatcher) getClient() Client {
+	if m.client == nil {
+		m.client = &Client{}
+		if m.visitor != nil {
+			*m.client = ParseUserAgent(m.visitor.UserAgent)
+		}
+	}
+	return *m.client
+}
+
+func (m *routeMatcher) getLocation() Location {
+	if m.location != nil {
+		return *m.location
+	}
+
+	m.location = &Location{}
+	if m.srv.geo == nil || m.visitor == nil {
+		return *m.location
+	}
+
+	ip := net.ParseIP(m.visitor.IP)
+	if ip == nil {
+		return *m.location
+	}
+
+	loc, err := m.srv.geo.Locate(ip)
+	if err != nil {
+		m.srv.log.Err(err).Msg("the attempt to locate a visitor")
+		return *m.location
+	}
+
+	m.location.Country = strings.ToLower(loc.Country)
+	m.location.Region = strings.ToLower(loc.Region)
+	return *m.location
+}
+
+func normalizeRoutes(routes []Route) ([]Route, error) {
+	if len(routes) > maxRoutes {
+		return nil, NewBadParamsError(fmt.Sprintf("no more than %d routes are allowed", maxRoutes), nil)
+	}
+
+	normalized := make([]Route, 0, len(routes))
+	for i, r := range routes {
+		r.Kind = strings.ToLower(strings.TrimSpace(r.Kind))
+		r.Match = strings.ToLower(strings.TrimSpace(r.Match))
+
+		valid, ok := routeMatches[r.Kind]
+		if !ok {
+			return nil, NewBadParamsError(fmt.Sprintf("route #%d: unknown kind %q", i, r.Kind), nil)
+		}
+		if !valid(r.Match) {
+			return nil, NewBadParamsError(fmt.Sprintf("route #%d: unknown %s %q", i, r.Kind, r.Match), nil)
+		}
+
+		r.DeepLink = strings.TrimSpace(r.DeepLink)
+		if r.DeepLink != "" {
+			if err := validateDeepLink(r.DeepLink); err != nil {
+				return nil, NewBadParamsError(fmt.Sprintf("route #%d: %s", i, err), nil)
+			}
+			if r.Destination == "" {
+				normalized = append(normalized, r)
+				continue
+			}
+		}
+
+		parsed, err := parseURL(r.Destination)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateURL(parsed); err != nil {
+			return nil, NewBadParamsError(fmt.Sprintf("route #%d: %s", i, err), nil)
+		}
+
+		normalized = append(normalized, r)
+	}
+
+	return normalized, nil
+}
+
+// validateDeepLink accepts app URLs with a custom scheme, like "example://path"
+// or "example:path", and universal links over HTTPS.
+func validateDeepLink(link string) error {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return NewBadParamsError("invalid deep link format", err)
+	}
+	scheme := strings.ToLower(parsed.Scheme)
+	if scheme == "" {
+		return NewBadParamsError("deep link scheme can't be blank", nil)
+	}
+	if unsafeDeepLinkSchemes[scheme] || scheme == "http" {
+		return NewBadParamsError(fmt.Sprintf("deep link scheme %q isn't allowed", scheme), nil)
+	}
+	if scheme == "https" && parsed.Host == "" {
+		return NewBadParamsError("deep link host can't be blank", nil)
+	}
+	return nil
+}
+
+// universalLink reports whether the deep link is a web URL claimed by an app,
+// such links are checked like other destinations.
+func universalLink(link string) bool {
+	return strings.HasPrefix(strings.ToLower(link), "https://")
+}
@@ -0,0 +1,79 @@
+package shortener
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const maxScheduleEntries = 20
+
+// ScheduleEntry sends visitors to Destination from Start until End, or until
+// the start of the next entry if End is zero.
+type ScheduleEntry struct {
+	Start       time.Time
+	End         time.Time
+	Destination string
+}
+
+// scheduled returns the destination of the entry active at the moment.
+func scheduled(schedule []ScheduleEntry, at time.Time) (string, bool) {
+	active := -1
+	for i, e := range schedule {
+		if e.Start.After(at) {
+			break
+		}
+		active = i
+	}
+	if active < 0 {
+		return "", false
+	}
+
+	e := schedule[active]
+	if !e.End.IsZero() && !at.Before(e.End) {
+		return "", false
+	}
+	return e.Destination, true
+}
+
+// normalizeSchedule sorts entries by start and rejects overlapping ones.
+func normalizeSchedule(schedule []ScheduleEntry) ([]ScheduleEntry, error) {
+	if len(schedule) > maxScheduleEntries {
+		return nil, NewBadParamsError(fmt.Sprintf("no more than %d schedule entries are allowed", maxScheduleEntries), nil)
+	}
+
+	normalized := make([]ScheduleEntry, 0, len(schedule))
+	for i, e := range schedule {
+		if e.Start.IsZero() {
+			return nil, NewBadParamsError(fmt.Sprintf("schedule entry #%d: start can't be blank", i), nil)
+		}
+		if !e.End.IsZero() && !e.End.After(e.Start) {
+			return nil, NewBadParamsError(fmt.Sprintf("schedule entry #%d: end must be after start", i), nil)
+		}
+
+		parsed, err := parseURL(e.Destination)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateURL(parsed); err != nil {
+			return nil, NewBadParamsError(fmt.Sprintf("schedule entry #%d: %s", i, err), nil)
+		}
+
+		e.Start = e.Start.UTC()
+		if !e.End.IsZero() {
+			e.End = e.End.UTC()
+		}
+		normalized = append(normalized, e)
+	}
+
+	sort.SliceStable(normalized, func(i, j int) bool { return normalized[i].Start.Before(normalized[j].Start) })
+	for i := 1; i < len(normalized); i++ {
+		prev, next := normalized[i-1], normalized[i]
+		if prev.Start.Equal(next.Start) || (!prev.End.IsZero() && prev.End.After(next.Start)) {
+			return nil, NewBadParamsError(fmt.Sprintf("schedule entries starting at %s and %s overlap",
+				prev.Start.Format(time.RFC3339), next.Start.Format(time.RFC3339)), nil)
+		}
+	}
+
+	return normalized, nil
+}
@@ -3,7 +3,12 @@ package shortener
 import (
 	"context"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"fmt"
+	"github.com/kalinink/simple-url-shortener/internal/hll"
 	"github.com/rs/zerolog"
 	"net/url"
 	"strconv"
@@ -11,29 +16,194 @@ import (
 	"time"
 )
 
-const shortURLPathLength = 12
+const (
+	shortURLPathLength = 12
+	maxStatisticsDays  = 365
+	maxTags            = 10
+	maxTagLength       = 50
+	maxTopLimit        = 100
+	maxTopWindow       = 90 * 24 * time.Hour
+	maxMissKeyLength   = 2000
+	clickIDLength      = 32
+	maxTargetLinks     = 100
+	canonicalBatchSize = 1000
+)
+
+const DefaultClickIDParam = "click_id"
 
 type CheckExpiredFunc func(lastAccess *time.Time, createdAt time.Time) bool
 
+type Config struct {
+	HostName    string
+	Scheme      string
+	URLLifeTime time.Duration
+	// VisitorSalt is mixed into visitor hashes so they can't be reversed
+	// into IP addresses by brute force.
+	VisitorSalt string
+	// BotSignatures are user agent words of non-human clients, they match whole words only,
+	// DefaultBotSignatures are used if it's nil.
+	BotSignatures []string
+	// ClickIDParam is the query parameter a click ID is appended as,
+	// DefaultClickIDParam is used if it's empty.
+	ClickIDParam string
+	// Clicks receives every resolution if it's set.
+	Clicks ClickPublisher
+	// MissRetention is how long failed resolutions are kept, they're kept forever if it's zero.
+	MissRetention time.Duration
+	// Geo locates visitors for country and region routes, they never match if it's nil.
+	Geo GeoLocator
+	// Now is the clock of the service, time.Now is used if it's nil.
+	Now func() time.Time
+	// RedirectStatus and RedirectCacheMaxAge are the defaults of browser redirects,
+	// DefaultRedirectStatus is used if the status is zero.
+	RedirectStatus      int
+	RedirectCacheMaxAge time.Duration
+	// Canonicalize rewrites long URLs into the canonical form before they're stored.
+	// TrackingParams are stripped from canonical forms, DefaultTrackingParams are used if it's nil.
+	Canonicalize   bool
+	TrackingParams []string
+	// Dedupe returns the active link to the same long URL instead of creating
+	// a new one, links with per-link options other than UTM are never shared.
+	Dedupe bool
+	// MixedScriptPolicy tells what to do with long URLs whose internationalized
+	// host names mix scripts, MixedScriptFlag is used if it's empty.
+	MixedScriptPolicy string
+	// Filter denies destinations on creation and resolution of links, all are allowed if it's nil.
+	Filter DestinationFilter
+	// AllowedSchemes are the schemes of destinations, DefaultAllowedSchemes are used if it's nil.
+	AllowedSchemes []string
+	// AllowInternal allows destinations at private, loopback and other internal
+	// addresses, e.g. for deployments that shorten links to internal services.
+	AllowInternal bool
+	// Resolver resolves host names of new destinations to reject ones pointing at
+	// internal addresses, only literal addresses are checked if it's nil.
+	Resolver Resolver
+	// ShortenerDomains are domains of other URL shorteners, links to them and
+	// their subdomains are rejected unless they're followed, as are links to
+	// HostName. DefaultShortenerDomains are used if it's nil.
+	ShortenerDomains []string
+	// MaxChainHops is how many redirects of other shorteners are followed on
+	// creation to store the final destination instead, they aren't followed if it's zero.
+	MaxChainHops int
+	// Client follows redirects of other shorteners, it mustn't follow them by
+	// itself. A client that gives up after 5 seconds and, unless AllowInternal
+	// is set, doesn't connect to internal addresses is used if it's nil.
+	Client HTTPClient
+}
+
 type Service struct {
-	urlRepository URLRepository
-	scheme        string
-	hostName      string
-	expiredAfter  time.Duration
-	log           *zerolog.Logger
+	urlRepository  URLRepository
+	scheme         string
+	hostName       string
+	expiredAfter   time.Duration
+	visitorSalt    string
+	classifier     *HitClassifier
+	clickIDParam   string
+	clicks         ClickPublisher
+	geo            GeoLocator
+	now            func() time.Time
+	redirectStatus int
+	cacheMaxAge    time.Duration
+	canonicalizer  *Canonicalizer
+	canonicalize   bool
+	dedupe         bool
+	// mixedScriptPolicy is one of MixedScriptAllow, MixedScriptFlag and MixedScriptReject.
+	mixedScriptPolicy string
+	filter            DestinationFilter
+	allowedSchemes    map[string]bool
+	allowInternal     bool
+	resolver          Resolver
+	ownHostName       string
+	shortenerDomains  map[string]bool
+	maxChainHops      int
+	client            HTTPClient
+	missRetention     time.Duration
+	log               *zerolog.Logger
 }
 
-func NewService(repo URLRepository, hostName string, scheme string, expired time.Duration, log *zerolog.Logger) *Service {
+func NewService(repo URLRepository, cfg Config, log *zerolog.Logger) *Service {
+	signatures := cfg.BotSignatures
+	if signatures == nil {
+		signatures = DefaultBotSignatures
+	}
+	clickIDParam := cfg.ClickIDParam
+	if clickIDParam == "" {
+		clickIDParam = DefaultClickIDParam
+	}
+	now := cfg.Now
+	if now == nil {
+		now = time.Now
+	}
+	redirectStatus := cfg.RedirectStatus
+	if redirectStatus == 0 {
+		redirectStatus = DefaultRedirectStatus
+	}
+	mixedScriptPolicy := cfg.MixedScriptPolicy
+	if mixedScriptPolicy == "" {
+		mixedScriptPolicy = MixedScriptFlag
+	}
+	schemes := cfg.AllowedSchemes
+	if schemes == nil {
+		schemes = DefaultAllowedSchemes
+	}
+	allowedSchemes := make(map[string]bool, len(schemes))
+	for _, scheme := range schemes {
+		allowedSchemes[strings.ToLower(strings.TrimSpace(scheme))] = true
+	}
+	ownHostName := cfg.HostName
+	if u, err := url.Parse("//" + cfg.HostName); err == nil {
+		ownHostName = u.Hostname()
+	}
+	domains := cfg.ShortenerDomains
+	if domains == nil {
+		domains = DefaultShortenerDomains
+	}
+	shortenerDomains := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		shortenerDomains[strings.ToLower(strings.TrimSpace(d))] = true
+	}
+	client := cfg.Client
+	if client == nil {
+		client = newChainClient(cfg.AllowInternal)
+	}
+	trackingParams := cfg.TrackingParams
+	if trackingParams == nil {
+		trackingParams = DefaultTrackingParams
+	}
+
 	return &Service{
-		urlRepository: repo,
-		scheme:        scheme,
-		hostName:      hostName,
-		expiredAfter:  expired,
-		log:           log,
+		urlRepository:     repo,
+		scheme:            cfg.Scheme,
+		hostName:          cfg.HostName,
+		expiredAfter:      cfg.URLLifeTime,
+		visitorSalt:       cfg.VisitorSalt,
+		classifier:        NewHitClassifier(signatures),
+		clickIDParam:      clickIDParam,
+		clicks:            cfg.Clicks,
+		geo:               cfg.Geo,
+		now:               now,
+		redirectStatus:    redirectStatus,
+		cacheMaxAge:       cfg.RedirectCacheMaxAge,
+		canonicalizer:     NewCanonicalizer(trackingParams),
+		canonicalize:      cfg.Canonicalize,
+		dedupe:            cfg.Dedupe,
+		mixedScriptPolicy: mixedScriptPolicy,
+		filter:            cfg.Filter,
+		allowedSchemes:    allowedSchemes,
+		allowInternal:     cfg.AllowInternal,
+		resolver:          cfg.Resolver,
+		ownHostName:       ownHostName,
+		shortenerDomains:  shortenerDomains,
+		maxChainHops:      cfg.MaxChainHops,
+		client:            client,
+		missRetention:     cfg.MissRetention,
+		log:               log,
 	}
 }
 
-func (srv *Service) CreateShortURL(ctx context.Context, longURL string) (*URL, error) {
+func (srv *Service) CreateShortURL(ctx context.Context, longURL string, opts LinkOptions) (*URL, error) {
+	// The input is stored as given, longURL is unwrapped, normalized and canonicalized below.
+	rawLongURL := longURL
 	parsedURL, err := parseURL(longURL)
 	if err != nil {
 		return nil, err
@@ -43,52 +213,217 @@ func (srv *Service) CreateShortURL(ctx context.Context, longURL string) (*URL, e
 		return nil, err
 	}
 
+	unwrapped, err := srv.unwrapChain(ctx, longURL, parsedURL)
+	if err != nil {
+		return nil, err
+	}
+	if unwrapped != longURL {
+		longURL = unwrapped
+		if parsedURL, err = parseURL(longURL); err != nil {
+			return nil, err
+		}
+	}
+
+	longURL, mixedScript, err := srv.normalizeIDN(longURL, parsedURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsedURL, err = parseURL(longURL); err != nil {
+		return nil, err
+	}
+
+	if srv.canonicalize {
+		if longURL, err = srv.canonicalizer.Canonicalize(longURL); err != nil {
+			return nil, NewBadParamsError("invalid url format", err)
+		}
+		if parsedURL, err = parseURL(longURL); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Tags, err = normalizeTags(opts.Tags); err != nil {
+		return nil, err
+	}
+	if opts.Routes, err = normalizeRoutes(opts.Routes); err != nil {
+		return nil, err
+	}
+	if opts.Variants, err = normalizeVariants(opts.Variants); err != nil {
+		return nil, err
+	}
+	if opts.Schedule, err = normalizeSchedule(opts.Schedule); err != nil {
+		return nil, err
+	}
+	if opts.Fallbacks, err = normalizeFallbacks(opts.Fallbacks); err != nil {
+		return nil, err
+	}
+	localization := Localization{Default: opts.DefaultLanguage, Languages: opts.Languages}
+	if err := normalizeLocalization(&localization); err != nil {
+		return nil, err
+	}
+	opts.DefaultLanguage, opts.Languages = localization.Default, localization.Languages
+	if err := validateRedirect(&opts); err != nil {
+		return nil, err
+	}
+
+	taggedURL, err := srv.tagURL(ctx, longURL, parsedURL, &opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := srv.checkDestinations(ctx, append([]string{taggedURL}, opts.destinations()...)); err != nil {
+		return nil, err
+	}
+
+	dedupe := srv.dedupe && deduplicable(opts)
+	if dedupe {
+		existing, err := srv.duplicate(ctx, taggedURL)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			srv.incShort(ctx)
+			existing.Display = displayURL(existing.Long)
+			existing.MixedScript = mixedScript
+			return existing, nil
+		}
+	}
+
+	canonicalURL, err := srv.canonicalizer.Canonicalize(taggedURL)
+	if err != nil {
+		return nil, NewBadParamsError("invalid url format", err)
+	}
+
 	shortURL := srv.makeShortURL(longURL)
 
 	newURL := &NewURL{
-		Long:      longURL,
-		Short:     shortURLKey(shortURL),
-		CreatedAt: time.Now(),
+		Long:         taggedURL,
+		RawLong:      rawLongURL,
+		Canonical:    canonicalURL,
+		Short:        shortURLKey(shortURL),
+		CreatedAt:    srv.now(),
+		Domain:       strings.ToLower(parsedURL.Hostname()),
+		Deduplicated: dedupe,
+		MixedScript:  mixedScript,
+		LinkOptions:  opts,
 	}
 
 	if err := srv.urlRepository.Save(ctx, newURL); err != nil {
+		// A concurrent request may have created the link first.
+		if dedupe {
+			if existing, _ := srv.duplicate(ctx, taggedURL); existing != nil {
+				srv.incShort(ctx)
+				existing.Display = displayURL(existing.Long)
+				existing.MixedScript = mixedScript
+				return existing, nil
+			}
+		}
 		return nil, err
 	}
 
+	srv.incShort(ctx)
+
+	return &URL{
+		Long:        taggedURL,
+		Display:     displayURL(taggedURL),
+		Short:       shortURL.String(),
+		MixedScript: mixedScript,
+		LinkOptions: opts,
+	}, nil
+}
+
+func (srv *Service) incShort(ctx context.Context) {
 	if err := srv.urlRepository.IncShort(ctx); err != nil {
 		srv.log.Err(err).Msg("the attempt to increase the count of 'short' calls")
 	}
+}
 
-	return &URL{
-		Long:  longURL,
-		Short: shortURL.String(),
-	}, nil
+// tagURL merges UTM parameters into the long URL. The given ones win over the
+// ones already in the URL, templates of the tags fill the rest in tag order.
+func (srv *Service) tagURL(ctx context.Context, longURL string, parsedURL *url.URL, opts *LinkOptions) (string, error) {
+	utm, err := normalizeUTM(opts.UTM)
+	if err != nil {
+		return "", err
+	}
+
+	present := utmFromQuery(parsedURL.Query())
+	utm = utm.withDefaults(present)
+
+	if len(opts.Tags) > 0 {
+		templates, err := srv.urlRepository.UTMTemplates(ctx, opts.Tags)
+		if err != nil {
+			return "", err
+		}
+		for _, t := range opts.Tags {
+			utm = utm.withDefaults(templates[t])
+		}
+	}
+
+	// The parameters already in the long URL are stored along with the given ones.
+	if utm, err = normalizeUTM(utm); err != nil {
+		return "", err
+	}
+	opts.UTM = utm
+	if utm == present {
+		return longURL, nil
+	}
+	return tagURL(parsedURL, utm), nil
 }
 
-func (srv *Service) GetLongURL(ctx context.Context, shortURL string) (*URL, error) {
-	parsedURL, err := parseURL(shortURL)
+func (srv *Service) UTMTemplate(ctx context.Context, tag string) (*UTM, error) {
+	tags, err := normalizeTags([]string{tag})
+	if err != nil || len(tags) == 0 {
+		return nil, NewBadParamsError("invalid tag", err)
+	}
+
+	templates, err := srv.urlRepository.UTMTemplates(ctx, tags)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := validateURL(parsedURL); err != nil {
-		return nil, err
+	utm, ok := templates[tags[0]]
+	if !ok {
+		return nil, NewNotFoundError("utm template not found")
+	}
+	return &utm, nil
+}
+
+func (srv *Service) SetUTMTemplate(ctx context.Context, tag string, utm UTM) error {
+	tags, err := normalizeTags([]string{tag})
+	if err != nil || len(tags) == 0 {
+		return NewBadParamsError("invalid tag", err)
+	}
+
+	if utm, err = normalizeUTM(utm); err != nil {
+		return err
 	}
 
-	if err := srv.validateShortURL(parsedURL); err != nil {
+	return srv.urlRepository.SetUTMTemplate(ctx, tags[0], utm)
+}
+
+func (srv *Service) GetLongURL(ctx context.Context, shortURL string, visitor *Visitor) (*URL, error) {
+	hitKind := srv.classifier.Classify(visitor)
+
+	parsedURL, err := parseURL(shortURL)
+	if err == nil {
+		err = validateURL(parsedURL)
+	}
+	if err == nil {
+		err = srv.validateShortURL(parsedURL)
+	}
+	if err != nil {
+		srv.recordMiss(ctx, badRequestKey(err), BadRequestMiss, hitKind)
 		return nil, err
 	}
 
+	key, suffix, rawSuffix := splitShortPath(parsedURL)
 	s := ShortURL{
-		URL:        shortURLKey(parsedURL),
-		AccessTime: time.Now(),
+		URL:        key,
+		AccessTime: srv.now(),
+		HitKind:    hitKind,
 	}
 
 	u, err := srv.urlRepository.GetIfNotExpired(ctx, &s, func(lastAccess *time.Time, createdAt time.Time) bool {
-		if lastAccess == nil {
-			lastAccess = &createdAt
-		}
-		if lastAccess.Add(srv.expiredAfter).Before(time.Now()) {
+		if srv.expired(lastAccess, createdAt) {
 			srv.log.Info().Msgf("%s is expired", parsedURL.String())
 			return true
 		}
@@ -97,16 +432,168 @@ func (srv *Service) GetLongURL(ctx context.Context, shortURL string) (*URL, erro
 	})
 
 	if err != nil {
+		if sErr, ok := err.(Error); ok && sErr.Type == NotFoundErrType {
+			event := NotFoundMiss
+			if sErr.Origin == ErrExpired {
+				event = ExpiredMiss
+			}
+			srv.recordMiss(ctx, s.URL, event, hitKind)
+		}
+		return nil, err
+	}
+
+	if suffix != "" && (!u.PassPath || !safeSuffix(suffix, rawSuffix)) {
+		srv.recordMiss(ctx, s.URL+suffix, NotFoundMiss, hitKind)
+		return nil, NewNotFoundError("url not found")
+	}
+
+	u.Long, u.Variant = srv.route(u, visitor, s.AccessTime)
+	u.Long = passThrough(u.Long, &u.LinkOptions, suffix, rawSuffix, parsedURL.Query())
+	err = srv.checkDestination(u.Long)
+	if err == nil && universalLink(u.DeepLink) {
+		err = srv.checkDestination(u.DeepLink)
+	}
+	if err != nil {
+		srv.recordMiss(ctx, s.URL, DeniedMiss, hitKind)
 		return nil, err
 	}
 
-	if err := srv.urlRepository.IncLong(ctx); err != nil {
+	// Only resolved clicks keep the link alive, denied ones and probes of unknown paths don't.
+	if s.HitKind == HumanHit || !u.IgnoreBotAccess {
+		if err := srv.urlRepository.UpdateAccess(ctx, s.URL, s.AccessTime); err != nil {
+			return nil, err
+		}
+	}
+	srv.applyRedirectDefaults(&u.LinkOptions)
+	u.ResolvedAt = s.AccessTime
+
+	access := &Access{
+		ShortURL:    u.Short,
+		AccessAt:    s.AccessTime,
+		VisitorHash: srv.hashVisitor(visitor),
+		HitKind:     s.HitKind,
+		Variant:     u.Variant,
+	}
+	// Click IDs are given to the visitor only, the live stream gets the destination without them.
+	destination := u.Long
+	if u.TrackConversions && s.HitKind == HumanHit {
+		access.ClickID = newClickID()
+		u.Long = appendQueryParam(u.Long, srv.clickIDParam, access.ClickID)
+	}
+	if err := srv.urlRepository.IncLong(ctx, access); err != nil {
 		srv.log.Err(err).Msg("the attempt to increase the count of 'long' calls")
 	}
 
+	if srv.clicks != nil {
+		srv.clicks.Publish(&ClickEvent{Key: u.Short, Long: destination, HitKind: s.HitKind, At: s.AccessTime})
+	}
+
 	return u, nil
 }
 
+func (srv *Service) Routes(ctx context.Context, key string) ([]Route, error) {
+	return srv.urlRepository.Routes(ctx, key)
+}
+
+func (srv *Service) SetRoutes(ctx context.Context, key string, routes []Route) error {
+	routes, err := normalizeRoutes(routes)
+	if err != nil {
+		return err
+	}
+	if err := srv.checkDestinations(ctx, LinkOptions{Routes: routes}.destinations()); err != nil {
+		return err
+	}
+
+	return srv.urlRepository.SetRoutes(ctx, key, routes)
+}
+
+func (srv *Service) Languages(ctx context.Context, key string) (*Localization, error) {
+	return srv.urlRepository.Languages(ctx, key)
+}
+
+func (srv *Service) SetLanguages(ctx context.Context, key string, localization *Localization) error {
+	if err := normalizeLocalization(localization); err != nil {
+		return err
+	}
+	if err := srv.checkDestinations(ctx, LinkOptions{Languages: localization.Languages}.destinations()); err != nil {
+		return err
+	}
+
+	return srv.urlRepository.SetLanguages(ctx, key, localization)
+}
+
+func (srv *Service) Schedule(ctx context.Context, key string) ([]ScheduleEntry, error) {
+	return srv.urlRepository.Schedule(ctx, key)
+}
+
+func (srv *Service) SetSchedule(ctx context.Context, key string, schedule []ScheduleEntry) error {
+	schedule, err := normalizeSchedule(schedule)
+	if err != nil {
+		return err
+	}
+	if err := srv.checkDestinations(ctx, LinkOptions{Schedule: schedule}.destinations()); err != nil {
+		return err
+	}
+
+	return srv.urlRepository.SetSchedule(ctx, key, schedule)
+}
+
+// badRequestKey buckets bad requests by the reason, so arbitrary input isn't stored.
+func badRequestKey(err error) string {
+	if e, ok := err.(Error); ok {
+		return e.ErrText
+	}
+	return "invalid url"
+}
+
+// recordMiss stores a failed resolution, a failure to store it doesn't affect the response.
+func (srv *Service) recordMiss(ctx context.Context, key, event, hitKind string) {
+	if len(key) > maxMissKeyLength {
+		key = key[:maxMissKeyLength]
+	}
+
+	miss := &Miss{
+		Key:        strings.ToValidUTF8(key, ""),
+		Event:      event,
+		HitKind:    hitKind,
+		OccurredAt: srv.now(),
+	}
+	if err := srv.urlRepository.AddMiss(ctx, miss); err != nil {
+		srv.log.Err(err).Msgf("the attempt to record the '%s' miss", event)
+	}
+}
+
+// PurgeMisses deletes misses older than the retention period, if it's set.
+func (srv *Service) PurgeMisses(ctx context.Context) error {
+	if srv.missRetention <= 0 {
+		return nil
+	}
+
+	deleted, err := srv.urlRepository.DeleteMisses(ctx, srv.now().Add(-srv.missRetention))
+	if err != nil {
+		return err
+	}
+	srv.log.Debug().Msgf("%d misses are purged", deleted)
+	return nil
+}
+
+// RunMissRetention purges old misses every interval until ctx is canceled.
+func (srv *Service) RunMissRetention(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := srv.PurgeMisses(ctx); err != nil {
+				srv.log.Err(err).Msg("misses purge")
+			}
+		}
+	}
+}
+
 func (srv *Service) Statistics(ctx context.Context) (*OverallStatistics, error) {
 	shortURLStat, err := srv.urlRepository.StatShortURL(ctx)
 	if err != nil {
@@ -138,15 +625,283 @@ func (srv *Service) Statistics(ctx context.Context) (*OverallStatistics, error)
 	}, nil
 }
 
+func (srv *Service) DetailedStatistics(ctx context.Context) (*DetailedStatistics, error) {
+	overall, err := srv.Statistics(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	histograms, err := srv.urlRepository.ClickHistograms(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DetailedStatistics{
+		OverallStatistics: *overall,
+		Clicks:            clickDistribution(histograms),
+	}, nil
+}
+
+func (srv *Service) LinkStatistics(ctx context.Context, key string, days int) (*LinkStatistics, error) {
+	if days < 1 || days > maxStatisticsDays {
+		return nil, NewBadParamsError(fmt.Sprintf("days must be between 1 and %d", maxStatisticsDays), nil)
+	}
+
+	from := truncateToDay(srv.now().UTC()).AddDate(0, 0, -(days - 1))
+	daily, err := srv.urlRepository.DailyStatistics(ctx, key, from)
+	if err != nil {
+		return nil, err
+	}
+
+	stat := &LinkStatistics{ShortURL: key, Daily: daily}
+	visitors := hll.New()
+	for i := range daily {
+		stat.Clicks += daily[i].Clicks
+		stat.BotClicks += daily[i].BotClicks
+		stat.Conversions += daily[i].Conversions
+		if daily[i].Visitors != nil {
+			daily[i].Uniques = daily[i].Visitors.Estimate()
+			visitors.Merge(daily[i].Visitors)
+		}
+	}
+	stat.Uniques = visitors.Estimate()
+	if stat.Clicks > 0 {
+		stat.ConversionRate = float64(stat.Conversions) / float64(stat.Clicks)
+	}
+
+	if stat.Variants, err = srv.urlRepository.VariantStatistics(ctx, key, from); err != nil {
+		return nil, err
+	}
+
+	return stat, nil
+}
+
+func (srv *Service) Convert(ctx context.Context, clickID string) error {
+	if !isClickID(clickID) {
+		return NewBadParamsError("invalid click id", nil)
+	}
+
+	return srv.urlRepository.AddConversion(ctx, clickID, srv.now())
+}
+
+func (srv *Service) TopLinks(ctx context.Context, q TopQuery) ([]TopLink, error) {
+	if q.Mode != TopByClicks && q.Mode != TopTrending {
+		return nil, NewBadParamsError(fmt.Sprintf("mode must be %q or %q", TopByClicks, TopTrending), nil)
+	}
+	if q.Limit < 1 || q.Limit > maxTopLimit {
+		return nil, NewBadParamsError(fmt.Sprintf("limit must be between 1 and %d", maxTopLimit), nil)
+	}
+	if q.Window < time.Minute || q.Window > maxTopWindow {
+		return nil, NewBadParamsError(fmt.Sprintf("window must be between 1m and %s", maxTopWindow), nil)
+	}
+
+	now := srv.now()
+	top, err := srv.urlRepository.TopLinks(ctx, &TopFilter{
+		PreviousSince: now.Add(-2 * q.Window),
+		Since:         now.Add(-q.Window),
+		Until:         now,
+		Trending:      q.Mode == TopTrending,
+		Limit:         q.Limit,
+		Tag:           strings.ToLower(strings.TrimSpace(q.Tag)),
+		Domain:        strings.ToLower(strings.TrimSpace(q.Domain)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range top {
+		top[i].Short = srv.keyToURL(top[i].Short).String()
+	}
+
+	return top, nil
+}
+
+func (srv *Service) Export(ctx context.Context, q ExportQuery, w ExportWriter) error {
+	if err := q.Validate(); err != nil {
+		return err
+	}
+
+	if q.Kind == ExportEvents {
+		return srv.urlRepository.ExportEvents(ctx, q.From, q.Until, w.WriteEvent)
+	}
+
+	return srv.urlRepository.ExportRollups(ctx, q.From, q.Until, func(r *DailyRollup) error {
+		if r.Visitors != nil {
+			r.Uniques = r.Visitors.Estimate()
+		}
+		return w.WriteRollup(r)
+	})
+}
+
+func (srv *Service) TopMisses(ctx context.Context, event string, window time.Duration, limit int) ([]MissCount, error) {
+	if event != NotFoundMiss && event != ExpiredMiss && event != BadRequestMiss && event != DeniedMiss {
+		return nil, NewBadParamsError(fmt.Sprintf("event must be %q, %q, %q or %q", NotFoundMiss, ExpiredMiss, BadRequestMiss, DeniedMiss), nil)
+	}
+	if limit < 1 || limit > maxTopLimit {
+		return nil, NewBadParamsError(fmt.Sprintf("limit must be between 1 and %d", maxTopLimit), nil)
+	}
+	if window < time.Minute || window > maxTopWindow {
+		return nil, NewBadParamsError(fmt.Sprintf("window must be between 1m and %s", maxTopWindow), nil)
+	}
+
+	return srv.urlRepository.TopMisses(ctx, event, srv.now().Add(-window), limit)
+}
+
+func (srv *Service) FindLinks(ctx context.Context, target, match string, offset int) (*TargetLinks, error) {
+	if match != ExactMatch && match != CanonicalMatch {
+		return nil, NewBadParamsError(fmt.Sprintf("match must be %q or %q", ExactMatch, CanonicalMatch), nil)
+	}
+	if offset < 0 {
+		return nil, NewBadParamsError("offset must not be negative", nil)
+	}
+
+	parsedURL, err := parseURL(target)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateURL(parsedURL); err != nil {
+		return nil, err
+	}
+
+	if target, err = asciiURL(target, parsedURL); err != nil {
+		return nil, err
+	}
+
+	// One more link is asked for to tell if the page is truncated.
+	query := TargetQuery{URL: target, Offset: offset, Limit: maxTargetLinks + 1}
+	if match == CanonicalMatch {
+		if query.Canonical, err = srv.canonicalizer.Canonicalize(target); err != nil {
+			return nil, NewBadParamsError("invalid url format", err)
+		}
+		query.URL = ""
+	}
+
+	links, err := srv.urlRepository.FindLinks(ctx, &query)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &TargetLinks{Links: links}
+	if len(links) > maxTargetLinks {
+		page.Links, page.Truncated = links[:maxTargetLinks], true
+	}
+	for i := range page.Links {
+		l := &page.Links[i]
+		l.Expired = l.Expired || srv.expired(l.LastAccess, l.CreatedAt)
+		l.Short = srv.keyToURL(l.Short).String()
+		l.Display = displayURL(l.Long)
+	}
+	return page, nil
+}
+
+// BackfillCanonical stores the canonical forms of links created before they
+// were stored, so canonical matching finds them too.
+func (srv *Service) BackfillCanonical(ctx context.Context) (int, error) {
+	filled := 0
+	for {
+		urls, err := srv.urlRepository.WithoutCanonical(ctx, canonicalBatchSize)
+		if err != nil {
+			return filled, err
+		}
+
+		for _, u := range urls {
+			// An origin that can't be parsed is matched as is.
+			canonical, err := srv.canonicalizer.Canonicalize(u.Long)
+			if err != nil {
+				canonical = u.Long
+			}
+			if err := srv.urlRepository.SetCanonical(ctx, u.Short, canonical); err != nil {
+				return filled, err
+			}
+			filled++
+		}
+
+		if len(urls) < canonicalBatchSize {
+			return filled, nil
+		}
+	}
+}
+
+func (srv *Service) Campaigns(ctx context.Context, window time.Duration, limit int) ([]CampaignStatistics, error) {
+	if limit < 1 || limit > maxTopLimit {
+		return nil, NewBadParamsError(fmt.Sprintf("limit must be between 1 and %d", maxTopLimit), nil)
+	}
+	if window < time.Minute || window > maxTopWindow {
+		return nil, NewBadParamsError(fmt.Sprintf("window must be between 1m and %s", maxTopWindow), nil)
+	}
+
+	now := srv.now()
+	return srv.urlRepository.Campaigns(ctx, now.Add(-window), now, limit)
+}
+
+// Growth is the relative change of clicks, a link without previous clicks
+// is compared against a single one.
+func Growth(clicks, previousClicks int) float64 {
+	base := previousClicks
+	if base < 1 {
+		base = 1
+	}
+	return float64(clicks-previousClicks) / float64(base)
+}
+
+// hashVisitor identifies a visitor by a salted hash of the IP address and the user agent.
+func (srv *Service) hashVisitor(v *Visitor) uint64 {
+	if v == nil {
+		return 0
+	}
+	sum := sha256.Sum256([]byte(srv.visitorSalt + "\x00" + v.IP + "\x00" + v.UserAgent))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func newClickID() string {
+	b := make([]byte, clickIDLength/2)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isClickID(s string) bool {
+	if len(s) != clickIDLength {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// appendQueryParam adds the parameter without re-encoding the rest of the URL.
+func appendQueryParam(rawURL, key, value string) string {
+	fragment := ""
+	if i := strings.IndexByte(rawURL, '#'); i >= 0 {
+		rawURL, fragment = rawURL[:i], rawURL[i:]
+	}
+
+	sep := "?"
+	if strings.Contains(rawURL, "?") {
+		sep = "&"
+		if strings.HasSuffix(rawURL, "?") || strings.HasSuffix(rawURL, "&") {
+			sep = ""
+		}
+	}
+
+	return rawURL + sep + url.QueryEscape(key) + "=" + url.QueryEscape(value) + fragment
+}
+
+func truncateToDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
 func (srv *Service) makeShortURL(longURL string) *url.URL {
-	salt := strconv.FormatInt(time.Now().Unix(), 10)
+	salt := strconv.FormatInt(srv.now().Unix(), 10)
 	hash := hashWithSalt(longURL, salt)[:shortURLPathLength]
+	return srv.keyToURL(hash)
+}
+
+func (srv *Service) keyToURL(key string) *url.URL {
 	return &url.URL{
 		Scheme: srv.scheme,
 		Host:   srv.hostName,
-		Path:   hash,
+		Path:   key,
 	}
-
 }
 
 func hashWithSalt(str, salt string) string {
@@ -163,6 +918,28 @@ func (srv *Service) validateShortURL(shortURL *url.URL) error {
 	return nil
 }
 
+func normalizeTags(tags []string) ([]string, error) {
+	if len(tags) > maxTags {
+		return nil, NewBadParamsError(fmt.Sprintf("no more than %d tags are allowed", maxTags), nil)
+	}
+
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		if len(t) > maxTagLength {
+			return nil, NewBadParamsError(fmt.Sprintf("tag is longer than %d characters", maxTagLength), nil)
+		}
+		seen[t] = true
+		normalized = append(normalized, t)
+	}
+
+	return normalized, nil
+}
+
 func parseURL(shortURL string) (*url.URL, error) {
 	parsedURL, err := url.Parse(shortURL)
 	if err != nil {
@@ -3,7 +3,14 @@ package shortener
 import (
 	"context"
 	"fmt"
+	"github.com/kalinink/simple-url-shortener/internal/hll"
 	"github.com/rs/zerolog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -15,6 +22,8 @@ const (
 	noError  = -1
 )
 
+var testVisitor = &Visitor{IP: "192.0.2.1", UserAgent: "test-agent"}
+
 func TestService_GetLongURL(t *testing.T) {
 	srv := newTestService(500 * time.Millisecond)
 	cases := []struct {
@@ -38,7 +47,7 @@ func TestService_GetLongURL(t *testing.T) {
 	}
 	ctx := context.Background()
 	for i := range cases {
-		u, err := srv.CreateShortURL(ctx, cases[i].longURL)
+		u, err := srv.CreateShortURL(ctx, cases[i].longURL, LinkOptions{})
 		if cases[i].errType != noError {
 			AssertError(t, err, cases[i].errType, fmt.Sprintf("case #%d", i))
 		} else {
@@ -48,7 +57,7 @@ func TestService_GetLongURL(t *testing.T) {
 	}
 
 	for i := range cases {
-		_, err := srv.GetLongURL(ctx, cases[i].shortURL)
+		_, err := srv.GetLongURL(ctx, cases[i].shortURL, testVisitor)
 		if cases[i].errType != noError {
 			AssertError(t, err, NotFoundErrType, fmt.Sprintf("case #%d", i))
 		} else {
@@ -70,15 +79,15 @@ func TestService_GetExpired(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	u, err := srv.CreateShortURL(ctx, data.longURL)
+	u, err := srv.CreateShortURL(ctx, data.longURL, LinkOptions{})
 	AssertNoError(t, err, "creation short url")
 	data.shortURL = u.Short
 
-	_, err = srv.GetLongURL(ctx, data.shortURL)
+	_, err = srv.GetLongURL(ctx, data.shortURL, testVisitor)
 	AssertNoError(t, err, "getting not expired url")
 
 	time.Sleep(expiredAfter)
-	_, err = srv.GetLongURL(ctx, data.shortURL)
+	_, err = srv.GetLongURL(ctx, data.shortURL, testVisitor)
 	AssertError(t, err, NotFoundErrType, "getting expired url")
 }
 
@@ -94,13 +103,13 @@ func TestService_Statistics(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	u, err := srv.CreateShortURL(ctx, data.longURL)
+	u, err := srv.CreateShortURL(ctx, data.longURL, LinkOptions{})
 	AssertNoError(t, err, "creation short url")
 	data.shortURL = u.Short
 
 	reqNumber := 10
 	for i := 0; i < reqNumber; i++ {
-		_, err = srv.GetLongURL(ctx, data.shortURL)
+		_, err = srv.GetLongURL(ctx, data.shortURL, testVisitor)
 		AssertNoError(t, err, "getting url")
 		time.Sleep(100 * time.Millisecond)
 	}
@@ -116,90 +125,2122 @@ func TestService_Statistics(t *testing.T) {
 	}
 }
 
-type inMemoryDB struct {
-	mu             sync.Mutex
-	store          map[string]row
-	shortStatStore []time.Time
-	longStatStore  []time.Time
+func TestService_LinkStatistics(t *testing.T) {
+	srv := newTestService(time.Minute)
+	ctx := context.Background()
+
+	u, err := srv.CreateShortURL(ctx, "https://stackoverflow.com/questions/65324815/issorted", LinkOptions{})
+	AssertNoError(t, err, "creation short url")
+
+	visitors := []*Visitor{
+		{IP: "192.0.2.1", UserAgent: "firefox"},
+		{IP: "192.0.2.1", UserAgent: "chrome"},
+		{IP: "192.0.2.2", UserAgent: "firefox"},
+	}
+	for _, v := range visitors {
+		for i := 0; i < 3; i++ {
+			_, err = srv.GetLongURL(ctx, u.Short, v)
+			AssertNoError(t, err, "getting url")
+		}
+	}
+
+	parsed, _ := parseURL(u.Short)
+	stat, err := srv.LinkStatistics(ctx, shortURLKey(parsed), 30)
+	AssertNoError(t, err, "getting link statistic")
+
+	if stat.Clicks != 9 {
+		t.Errorf("want 9 clicks, got %d", stat.Clicks)
+	}
+	if stat.Uniques != uint64(len(visitors)) {
+		t.Errorf("want %d uniques, got %d", len(visitors), stat.Uniques)
+	}
+	if len(stat.Daily) != 1 || stat.Daily[0].Uniques != uint64(len(visitors)) {
+		t.Errorf("want a single day with %d uniques, got %+v", len(visitors), stat.Daily)
+	}
+
+	_, err = srv.LinkStatistics(ctx, "unknown", 30)
+	AssertError(t, err, NotFoundErrType, "statistic of unknown url")
+
+	_, err = srv.LinkStatistics(ctx, shortURLKey(parsed), 0)
+	AssertError(t, err, BadParamsErrType, "statistic with invalid period")
 }
 
-func newInMemoryDB() *inMemoryDB {
-	return &inMemoryDB{store: make(map[string]row)}
+func TestService_LinkStatisticsUTCDays(t *testing.T) {
+	// 01:00 on Nov 10 in Moscow is still Nov 9 in UTC.
+	now := time.Date(2020, 11, 10, 1, 0, 0, 0, time.FixedZone("MSK", 3*60*60))
+	srv := newTestService(time.Hour, Config{Now: func() time.Time { return now }})
+	ctx := context.Background()
+
+	u, err := srv.CreateShortURL(ctx, "https://stackoverflow.com/questions/65324815/issorted", LinkOptions{})
+	AssertNoError(t, err, "creation short url")
+	_, err = srv.GetLongURL(ctx, u.Short, testVisitor)
+	AssertNoError(t, err, "getting url")
+
+	parsed, _ := parseURL(u.Short)
+	stat, err := srv.LinkStatistics(ctx, shortURLKey(parsed), 1)
+	AssertNoError(t, err, "getting link statistic")
+
+	want := time.Date(2020, 11, 9, 0, 0, 0, 0, time.UTC)
+	if len(stat.Daily) != 1 || !stat.Daily[0].Day.Equal(want) || stat.Daily[0].Clicks != 1 {
+		t.Errorf("want a click on %s, got %+v", want, stat.Daily)
+	}
 }
 
-type row struct {
-	longURL    string
-	lastAccess *time.Time
-	createdAt  time.Time
+func TestService_BotHits(t *testing.T) {
+	expiredAfter := 200 * time.Millisecond
+	srv := newTestService(expiredAfter)
+	ctx := context.Background()
+
+	u, err := srv.CreateShortURL(ctx, "https://stackoverflow.com/questions/65324815/issorted", LinkOptions{IgnoreBotAccess: true})
+	AssertNoError(t, err, "creation short url")
+
+	bots := []*Visitor{
+		{IP: "192.0.2.10", UserAgent: "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)"},
+		{IP: "192.0.2.11", UserAgent: "Twitterbot/1.0"},
+		{IP: "192.0.2.12", UserAgent: "Mozilla/5.0 Chrome/87.0", Purpose: "prefetch"},
+	}
+	_, err = srv.GetLongURL(ctx, u.Short, testVisitor)
+	AssertNoError(t, err, "getting url by human")
+
+	time.Sleep(expiredAfter / 2)
+	for _, v := range bots {
+		_, err = srv.GetLongURL(ctx, u.Short, v)
+		AssertNoError(t, err, "getting url by bot")
+	}
+
+	time.Sleep(expiredAfter / 2)
+	_, err = srv.GetLongURL(ctx, u.Short, bots[0])
+	AssertError(t, err, NotFoundErrType, "bots mustn't extend the link life")
+
+	parsed, _ := parseURL(u.Short)
+	stat, err := srv.LinkStatistics(ctx, shortURLKey(parsed), 1)
+	AssertNoError(t, err, "getting link statistic")
+
+	if stat.Clicks != 1 || stat.Uniques != 1 {
+		t.Errorf("want 1 human click and visitor, got %d clicks and %d visitors", stat.Clicks, stat.Uniques)
+	}
+	if stat.BotClicks != len(bots) {
+		t.Errorf("want %d bot clicks, got %d", len(bots), stat.BotClicks)
+	}
+
+	overall, err := srv.Statistics(ctx)
+	AssertNoError(t, err, "getting statistic")
+	if overall.LongURL.Count != 1 {
+		t.Errorf("want 1 'long', got %d", overall.LongURL.Count)
+	}
 }
 
-func (db *inMemoryDB) Save(ctx context.Context, url *NewURL) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+func TestHitClassifier_Classify(t *testing.T) {
+	classifier := NewHitClassifier(DefaultBotSignatures)
+	cases := []struct {
+		userAgent string
+		kind      string
+	}{
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", BotHit},
+		{"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", BotHit},
+		{"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", BotHit},
+		{"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)", BotHit},
+		{"WhatsApp/2.21.4.18 A", BotHit},
+		{"curl/7.68.0", BotHit},
+		{"Mozilla/5.0 (Linux; Android 9; CUBOT P30) AppleWebKit/537.36 Chrome/87.0 Mobile Safari/537.36", HumanHit},
+		{"Mozilla/5.0 (Linux; Android 10; Cubot_X30) AppleWebKit/537.36 Chrome/87.0 Mobile Safari/537.36", HumanHit},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/87.0 Safari/537.36 PreviewApp/1.2", HumanHit},
+	}
+	for _, c := range cases {
+		if got := classifier.Classify(&Visitor{UserAgent: c.userAgent}); got != c.kind {
+			t.Errorf("[%s] want %s, got %s", c.userAgent, c.kind, got)
+		}
+	}
+}
 
-	db.store[url.Short] = row{longURL: url.Long, createdAt: url.CreatedAt}
-	return nil
+func TestService_DetailedStatistics(t *testing.T) {
+	srv := newTestService(time.Minute)
+	ctx := context.Background()
+
+	u, err := srv.CreateShortURL(ctx, "https://stackoverflow.com/questions/65324815/issorted", LinkOptions{})
+	AssertNoError(t, err, "creation short url")
+
+	reqNumber := 5
+	for i := 0; i < reqNumber; i++ {
+		time.Sleep(20 * time.Millisecond)
+		_, err = srv.GetLongURL(ctx, u.Short, testVisitor)
+		AssertNoError(t, err, "getting url")
+	}
+	_, err = srv.GetLongURL(ctx, u.Short, &Visitor{UserAgent: "Googlebot/2.1"})
+	AssertNoError(t, err, "getting url by bot")
+
+	stat, err := srv.DetailedStatistics(ctx)
+	AssertNoError(t, err, "getting detailed statistic")
+
+	if stat.LongURL.Count != reqNumber {
+		t.Errorf("want %d 'long', got %d", reqNumber, stat.LongURL.Count)
+	}
+
+	now := time.Now().UTC()
+	if got := stat.Clicks.ByHour[now.Hour()]; got != reqNumber {
+		t.Errorf("want %d clicks at %d hour, got %d", reqNumber, now.Hour(), got)
+	}
+	if got := stat.Clicks.ByWeekday[now.Weekday()]; got != reqNumber {
+		t.Errorf("want %d clicks on %s, got %d", reqNumber, now.Weekday(), got)
+	}
+
+	age := stat.Clicks.LinkAge
+	if age.P50 < 20*time.Millisecond || age.P50 > age.P90 || age.P90 > age.P99 {
+		t.Errorf("unexpected link age percentiles %+v", age)
+	}
+	interval := stat.Clicks.InterClick
+	if interval.P50 < 20*time.Millisecond || interval.P99 > time.Second {
+		t.Errorf("unexpected inter-click percentiles %+v", interval)
+	}
 }
 
-func (db *inMemoryDB) GetIfNotExpired(ctx context.Context, s *ShortURL, isExpired CheckExpiredFunc) (*URL, error) {
-	u, exists := db.store[s.URL]
-	if !exists {
-		return nil, NewNotFoundError("url not found")
+func TestHistogramPercentiles(t *testing.T) {
+	var values []time.Duration
+	counts := make(map[int]int)
+	for i := 1; i <= 1000; i++ {
+		d := time.Duration(i*i) * time.Millisecond
+		values = append(values, d)
+		counts[DurationBucket(d)]++
+	}
+	var buckets []DurationCount
+	for bucket, count := range counts {
+		buckets = append(buckets, DurationCount{Bucket: bucket, Count: count})
 	}
 
-	if isExpired(u.lastAccess, u.createdAt) {
-		return nil, NewNotFoundError("url not found")
+	// percentile_cont of the exact values.
+	exact := func(fraction float64) time.Duration {
+		rank := fraction * float64(len(values)-1)
+		i := int(rank)
+		return values[i] + time.Duration((rank-float64(i))*float64(values[i+1]-values[i]))
 	}
 
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	p := histogramPercentiles(buckets)
+	for _, c := range []struct {
+		name string
+		got  time.Duration
+		want time.Duration
+	}{
+		{"P50", p.P50, exact(0.5)},
+		{"P90", p.P90, exact(0.9)},
+		{"P99", p.P99, exact(0.99)},
+	} {
+		if diff := float64(c.got-c.want) / float64(c.want); diff < -0.05 || diff > 0.05 {
+			t.Errorf("%s is %s, want %s", c.name, c.got, c.want)
+		}
+	}
+
+	if p := histogramPercentiles(nil); p != (Percentiles{}) {
+		t.Errorf("percentiles of no values are %+v", p)
+	}
+}
+
+func TestService_TopLinks(t *testing.T) {
+	srv := newTestService(time.Hour)
+	db := srv.urlRepository.(*inMemoryDB)
+	ctx := context.Background()
+
+	links := []struct {
+		longURL  string
+		tags     []string
+		previous int
+		current  int
+	}{
+		{longURL: "https://blog.example.org/popular", tags: []string{"Blog"}, previous: 20, current: 30},
+		{longURL: "https://example.org/viral", tags: []string{"promo"}, previous: 1, current: 10},
+		{longURL: "https://other.org/new", tags: []string{"promo", "blog"}, current: 3},
+		{longURL: "https://other.org/dead", previous: 5},
+	}
+
+	window := time.Hour
+	shortURLs := make([]string, len(links))
+	for i, l := range links {
+		u, err := srv.CreateShortURL(ctx, l.longURL, LinkOptions{Tags: l.tags})
+		AssertNoError(t, err, "creation short url")
+		shortURLs[i] = u.Short
+
+		parsed, _ := parseURL(u.Short)
+		for j := 0; j < l.previous; j++ {
+			access := &Access{ShortURL: shortURLKey(parsed), AccessAt: time.Now().Add(-window - time.Minute), HitKind: HumanHit}
+			AssertNoError(t, db.IncLong(ctx, access), "adding previous access")
+		}
+		for j := 0; j < l.current; j++ {
+			_, err = srv.GetLongURL(ctx, u.Short, testVisitor)
+			AssertNoError(t, err, "getting url")
+		}
+	}
+
+	cases := []struct {
+		name  string
+		query TopQuery
+		want  []int
+	}{
+		{name: "clicks", query: TopQuery{Mode: TopByClicks, Window: window, Limit: 10}, want: []int{0, 1, 2}},
+		{name: "trending", query: TopQuery{Mode: TopTrending, Window: window, Limit: 10}, want: []int{1, 2, 0}},
+		{name: "limit", query: TopQuery{Mode: TopByClicks, Window: window, Limit: 1}, want: []int{0}},
+		{name: "tag", query: TopQuery{Mode: TopByClicks, Window: window, Limit: 10, Tag: "blog"}, want: []int{0, 2}},
+		{name: "domain", query: TopQuery{Mode: TopTrending, Window: window, Limit: 10, Domain: "example.org"}, want: []int{1, 0}},
+	}
+	for _, c := range cases {
+		top, err := srv.TopLinks(ctx, c.query)
+		AssertNoError(t, err, c.name)
 
-	u.lastAccess = &s.AccessTime
-	db.store[s.URL] = u
+		if len(top) != len(c.want) {
+			t.Errorf("[%s] want %d links, got %+v", c.name, len(c.want), top)
+			continue
+		}
+		for i, idx := range c.want {
+			if top[i].Short != shortURLs[idx] {
+				t.Errorf("[%s] want %s at %d position, got %s", c.name, links[idx].longURL, i, top[i].Long)
+			}
+		}
+	}
 
-	return &URL{Long: u.longURL, Short: s.URL}, nil
+	_, err := srv.TopLinks(ctx, TopQuery{Mode: "unknown", Window: window, Limit: 10})
+	AssertError(t, err, BadParamsErrType, "unknown mode")
 }
 
-func (db *inMemoryDB) IncShort(ctx context.Context) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+func TestService_Export(t *testing.T) {
+	srv := newTestService(time.Hour)
+	ctx := context.Background()
 
-	db.shortStatStore = append(db.shortStatStore, time.Now())
-	return nil
+	u, err := srv.CreateShortURL(ctx, "https://stackoverflow.com/questions/65324815/issorted", LinkOptions{})
+	AssertNoError(t, err, "creation short url")
+
+	for _, v := range []*Visitor{testVisitor, testVisitor, {UserAgent: "Twitterbot/1.0"}} {
+		_, err = srv.GetLongURL(ctx, u.Short, v)
+		AssertNoError(t, err, "getting url")
+	}
+
+	q := ExportQuery{Kind: ExportEvents, From: time.Now().Add(-time.Minute), Until: time.Now()}
+	w := &testExportWriter{}
+	AssertNoError(t, srv.Export(ctx, q, w), "exporting events")
+	if len(w.events) != 3 || w.events[2].HitKind != BotHit {
+		t.Errorf("want 3 events with the last bot one, got %+v", w.events)
+	}
+
+	q.Kind = ExportRollups
+	AssertNoError(t, srv.Export(ctx, q, w), "exporting rollups")
+	if len(w.rollups) != 1 {
+		t.Fatalf("want a single rollup, got %+v", w.rollups)
+	}
+	if r := w.rollups[0]; r.Clicks != 2 || r.BotClicks != 1 || r.Uniques != 1 {
+		t.Errorf("want 2 clicks, 1 bot click and 1 unique, got %+v", r)
+	}
+
+	q.From = q.Until
+	AssertError(t, srv.Export(ctx, q, w), BadParamsErrType, "exporting an empty period")
+
+	w.err = context.Canceled
+	q.From = q.Until.Add(-time.Minute)
+	if err := srv.Export(ctx, q, w); err != context.Canceled {
+		t.Errorf("want the writer error, got %v", err)
+	}
 }
 
-func (db *inMemoryDB) IncLong(ctx context.Context) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+func TestService_TopMisses(t *testing.T) {
+	expiredAfter := 100 * time.Millisecond
+	srv := newTestService(expiredAfter)
+	ctx := context.Background()
 
-	db.longStatStore = append(db.longStatStore, time.Now())
-	return nil
+	u, err := srv.CreateShortURL(ctx, "https://stackoverflow.com/questions/65324815/issorted", LinkOptions{})
+	AssertNoError(t, err, "creation short url")
+	parsed, _ := parseURL(u.Short)
+	expiredKey := shortURLKey(parsed)
+
+	time.Sleep(expiredAfter)
+	for i := 0; i < 3; i++ {
+		_, err = srv.GetLongURL(ctx, u.Short, testVisitor)
+		AssertError(t, err, NotFoundErrType, "getting expired url")
+	}
+
+	unknown := []string{"aaaa", "bbbb", "aaaa"}
+	for _, key := range unknown {
+		_, err = srv.GetLongURL(ctx, fmt.Sprintf("%s://%s/%s", scheme, hostName, key), testVisitor)
+		AssertError(t, err, NotFoundErrType, "getting unknown url")
+	}
+
+	_, err = srv.GetLongURL(ctx, "http://wrong:url:s", testVisitor)
+	AssertError(t, err, BadParamsErrType, "getting malformed url")
+	for _, host := range []string{"wrong.example", "other.example"} {
+		_, err = srv.GetLongURL(ctx, fmt.Sprintf("%s://%s/aaaa", scheme, host), testVisitor)
+		AssertError(t, err, BadParamsErrType, "getting url of another host")
+	}
+
+	cases := []struct {
+		event string
+		want  []MissCount
+	}{
+		{event: ExpiredMiss, want: []MissCount{{Key: expiredKey, Count: 3}}},
+		{event: NotFoundMiss, want: []MissCount{{Key: "aaaa", Count: 2}, {Key: "bbbb", Count: 1}}},
+		{event: BadRequestMiss, want: []MissCount{{Key: "invalid scheme or host name", Count: 2}, {Key: "invalid url format", Count: 1}}},
+	}
+	for _, c := range cases {
+		misses, err := srv.TopMisses(ctx, c.event, time.Hour, 10)
+		AssertNoError(t, err, c.event)
+
+		if len(misses) != len(c.want) {
+			t.Errorf("[%s] want %d keys, got %+v", c.event, len(c.want), misses)
+			continue
+		}
+		for i := range c.want {
+			if misses[i].Key != c.want[i].Key || misses[i].Count != c.want[i].Count {
+				t.Errorf("[%s] want %s requested %d times, got %+v", c.event, c.want[i].Key, c.want[i].Count, misses[i])
+			}
+		}
+	}
+
+	srv.missRetention = time.Millisecond
+	time.Sleep(srv.missRetention)
+	AssertNoError(t, srv.PurgeMisses(ctx), "purging misses")
+	misses, err := srv.TopMisses(ctx, NotFoundMiss, time.Hour, 10)
+	AssertNoError(t, err, "misses after the purge")
+	if len(misses) != 0 {
+		t.Errorf("want misses purged after the retention period, got %+v", misses)
+	}
 }
 
-func (db *inMemoryDB) StatShortURL(ctx context.Context) (*Statistics, error) {
-	return stat(db.shortStatStore), nil
+func TestService_Conversions(t *testing.T) {
+	srv := newTestService(time.Hour)
+	ctx := context.Background()
+
+	u, err := srv.CreateShortURL(ctx, "https://example.org/signup?ref=promo#form", LinkOptions{TrackConversions: true})
+	AssertNoError(t, err, "creation short url")
+
+	var clickIDs []string
+	for i := 0; i < 4; i++ {
+		long, err := srv.GetLongURL(ctx, u.Short, testVisitor)
+		AssertNoError(t, err, "getting url")
+
+		parsed, err := url.Parse(long.Long)
+		AssertNoError(t, err, "parsing long url")
+		clickID := parsed.Query().Get(DefaultClickIDParam)
+		if parsed.Query().Get("ref") != "promo" || parsed.Fragment != "form" || !isClickID(clickID) {
+			t.Fatalf("want the click id appended to the long url, got %s", long.Long)
+		}
+		clickIDs = append(clickIDs, clickID)
+	}
+
+	bot, err := srv.GetLongURL(ctx, u.Short, &Visitor{UserAgent: "Slackbot 1.0"})
+	AssertNoError(t, err, "getting url by bot")
+	if bot.Long != "https://example.org/signup?ref=promo#form" {
+		t.Errorf("want no click id for bots, got %s", bot.Long)
+	}
+
+	AssertNoError(t, srv.Convert(ctx, clickIDs[0]), "converting the first click")
+	AssertNoError(t, srv.Convert(ctx, clickIDs[0]), "converting the first click again")
+	// The second click converts the next day.
+	AssertNoError(t, srv.urlRepository.AddConversion(ctx, clickIDs[1], time.Now().AddDate(0, 0, 1)), "converting the second click")
+	AssertError(t, srv.Convert(ctx, newClickID()), NotFoundErrType, "converting an unknown click")
+	AssertError(t, srv.Convert(ctx, "<script>"), BadParamsErrType, "converting an invalid click")
+
+	parsed, _ := parseURL(u.Short)
+	stat, err := srv.LinkStatistics(ctx, shortURLKey(parsed), 2)
+	AssertNoError(t, err, "getting link statistic")
+
+	if stat.Clicks != 4 || stat.Conversions != 2 || stat.ConversionRate != 0.5 {
+		t.Errorf("want 4 clicks and 2 conversions, got %+v", stat)
+	}
+	if len(stat.Daily) != 2 || stat.Daily[0].Conversions != 1 || stat.Daily[1].Clicks != 0 || stat.Daily[1].Conversions != 1 {
+		t.Errorf("want conversions counted on the day they come, got %+v", stat.Daily)
+	}
 }
 
-func (db *inMemoryDB) StatLongURL(ctx context.Context) (*Statistics, error) {
-	return stat(db.longStatStore), nil
+func TestService_PublishClicks(t *testing.T) {
+	clicks := &testPublisher{}
+	srv := newTestService(time.Hour, Config{Clicks: clicks})
+	ctx := context.Background()
+
+	u, err := srv.CreateShortURL(ctx, "https://example.org/live", LinkOptions{})
+	AssertNoError(t, err, "creation short url")
+
+	_, err = srv.GetLongURL(ctx, u.Short, testVisitor)
+	AssertNoError(t, err, "getting url")
+	_, err = srv.GetLongURL(ctx, u.Short+"unknown", testVisitor)
+	AssertError(t, err, NotFoundErrType, "getting unknown url")
+
+	if len(clicks.events) != 1 || clicks.events[0].Long != "https://example.org/live" || clicks.events[0].HitKind != HumanHit {
+		t.Errorf("want a single click published, got %+v", clicks.events)
+	}
+	tracked, err := srv.CreateShortURL(ctx, "https://example.org/signup", LinkOptions{TrackConversions: true})
+	AssertNoError(t, err, "creation tracked short url")
+	long, err := srv.GetLongURL(ctx, tracked.Short, testVisitor)
+	AssertNoError(t, err, "getting tracked url")
+	if long.Long == "https://example.org/signup" {
+		t.Fatalf("want the click id appended for the visitor, got %s", long.Long)
+	}
+	if got := clicks.events[len(clicks.events)-1].Long; got != "https://example.org/signup" {
+		t.Errorf("want the destination published without the click id, got %s", got)
+	}
 }
 
-func stat(arr []time.Time) *Statistics {
-	var median *time.Time
-	count := len(arr)
-	if count > 0 {
-		median = &arr[count/2]
+func TestService_DeviceRoutes(t *testing.T) {
+	srv := newTestService(time.Hour)
+	ctx := context.Background()
+
+	const (
+		appStore   = "https://apps.apple.com/app/id000000000"
+		googlePlay = "https://play.google.com/store/apps/details?id=com.example"
+		mobileSite = "https://m.example.org/"
+		website    = "https://example.org/"
+	)
+	u, err := srv.CreateShortURL(ctx, website, LinkOptions{Routes: []Route{
+		{Kind: "OS", Match: "iOS", Destination: appStore},
+		{Kind: OSRoute, Match: Android, Destination: googlePlay},
+		{Kind: DeviceRoute, Match: Mobile, Destination: mobileSite},
+	}})
+	AssertNoError(t, err, "creation short url")
+
+	cases := []struct {
+		userAgent string
+		want      string
+	}{
+		{userAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 14_2 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148", want: appStore},
+		{userAgent: "Mozilla/5.0 (iPad; CPU OS 14_2 like Mac OS X) AppleWebKit/605.1.15", want: appStore},
+		{userAgent: "Mozilla/5.0 (Linux; Android 11; Pixel 5) AppleWebKit/537.36 Chrome/87.0 Mobile Safari/537.36", want: googlePlay},
+		{userAgent: "Opera/9.80 (J2ME/MIDP; Opera Mini/9.80) Presto/2.5.25 Version/10.54", want: website},
+		{userAgent: "Mozilla/5.0 (Mobile; rv:48.0) Gecko/48.0 Firefox/48.0 KAIOS/2.5", want: mobileSite},
+		{userAgent: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 Safari/605.1.15", want: website},
+		{userAgent: "", want: website},
 	}
-	return &Statistics{
-		Count:  count,
-		Timing: median,
+	for _, c := range cases {
+		got, err := srv.GetLongURL(ctx, u.Short, &Visitor{UserAgent: c.userAgent})
+		AssertNoError(t, err, c.userAgent)
+		if got.Long != c.want {
+			t.Errorf("[%s] want %s, got %s", c.userAgent, c.want, got.Long)
+		}
+	}
+
+	parsed, _ := parseURL(u.Short)
+	key := shortURLKey(parsed)
+	AssertNoError(t, srv.SetRoutes(ctx, key, []Route{{Kind: DeviceRoute, Match: Desktop, Destination: mobileSite}}), "replacing routes")
+
+	routes, err := srv.Routes(ctx, key)
+	AssertNoError(t, err, "getting routes")
+	if len(routes) != 1 || routes[0].Match != Desktop {
+		t.Errorf("want the replaced routes, got %+v", routes)
+	}
+
+	invalid := [][]Route{
+		{{Kind: "browser", Match: "firefox", Destination: website}},
+		{{Kind: OSRoute, Match: "symbian", Destination: website}},
+		{{Kind: OSRoute, Match: IOS, Destination: "apps.apple.com"}},
+	}
+	for _, routes := range invalid {
+		AssertError(t, srv.SetRoutes(ctx, key, routes), BadParamsErrType, fmt.Sprintf("invalid routes %+v", routes))
+	}
+	AssertError(t, srv.SetRoutes(ctx, "unknown", nil), NotFoundErrType, "routes of unknown url")
+}
+
+func TestService_DeepLinks(t *testing.T) {
+	srv := newTestService(time.Hour)
+	ctx := context.Background()
+
+	const (
+		appStore = "https://apps.apple.com/app/id000000000"
+		website  = "https://example.org/product/1"
+		iPhone   = "Mozilla/5.0 (iPhone; CPU iPhone OS 14_2 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148"
+		pixel    = "Mozilla/5.0 (Linux; Android 11; Pixel 5) AppleWebKit/537.36 Chrome/87.0 Mobile Safari/537.36"
+	)
+	u, err := srv.CreateShortURL(ctx, website, LinkOptions{Routes: []Route{
+		{Kind: OSRoute, Match: IOS, Destination: appStore, DeepLink: "example://product/1"},
+		{Kind: OSRoute, Match: Android, DeepLink: " https://app.example.org/product/1 "},
+	}})
+	AssertNoError(t, err, "creation short url")
+
+	cases := []struct {
+		userAgent    string
+		wantLong     string
+		wantDeepLink string
+	}{
+		{userAgent: iPhone, wantLong: appStore, wantDeepLink: "example://product/1"},
+		{userAgent: pixel, wantLong: website, wantDeepLink: "https://app.example.org/product/1"},
+		{userAgent: "", wantLong: website},
+	}
+	for _, c := range cases {
+		got, err := srv.GetLongURL(ctx, u.Short, &Visitor{UserAgent: c.userAgent})
+		AssertNoError(t, err, c.userAgent)
+		if got.Long != c.wantLong || got.DeepLink != c.wantDeepLink {
+			t.Errorf("[%s] want %s falling back to %s, got %+v", c.userAgent, c.wantDeepLink, c.wantLong, got)
+		}
+	}
+
+	invalid := []Route{
+		{Kind: OSRoute, Match: IOS, DeepLink: "javascript:alert(1)"},
+		{Kind: OSRoute, Match: IOS, DeepLink: "http://app.example.org/"},
+		{Kind: OSRoute, Match: IOS, DeepLink: "/product/1"},
+		{Kind: OSRoute, Match: IOS},
+	}
+	for _, r := range invalid {
+		_, err := srv.CreateShortURL(ctx, website, LinkOptions{Routes: []Route{r}})
+		AssertError(t, err, BadParamsErrType, r.DeepLink)
+	}
+}
+
+func TestService_GeoRoutes(t *testing.T) {
+	geo := testGeoLocator{
+		"203.0.113.1":  {Country: "US", Region: "US-CA"},
+		"203.0.113.2":  {Country: "US", Region: "US-NY"},
+		"198.51.100.1": {Country: "DE", Region: "DE-BY"},
+		"198.51.100.2": {Country: "FR"},
+	}
+	srv := newTestService(time.Hour, Config{Geo: geo})
+	ctx := context.Background()
+
+	const (
+		california = "https://example.org/us/ca/"
+		usa        = "https://example.org/us/"
+		germany    = "https://example.de/"
+		website    = "https://example.org/"
+	)
+	u, err := srv.CreateShortURL(ctx, website, LinkOptions{Routes: []Route{
+		{Kind: RegionRoute, Match: "us-ca", Destination: california},
+		{Kind: CountryRoute, Match: "US", Destination: usa},
+		{Kind: "Country", Match: "de", Destination: germany},
+	}})
+	AssertNoError(t, err, "creation short url")
+
+	cases := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "203.0.113.1", want: california},
+		{ip: "203.0.113.2", want: usa},
+		{ip: "198.51.100.1", want: germany},
+		{ip: "198.51.100.2", want: website},
+		{ip: "192.0.2.1", want: website},
+		{ip: "not an ip", want: website},
+	}
+	for _, c := range cases {
+		got, err := srv.GetLongURL(ctx, u.Short, &Visitor{IP: c.ip})
+		AssertNoError(t, err, c.ip)
+		if got.Long != c.want {
+			t.Errorf("[%s] want %s, got %s", c.ip, c.want, got.Long)
+		}
+	}
+
+	invalid := [][]Route{
+		{{Kind: CountryRoute, Match: "usa", Destination: website}},
+		{{Kind: RegionRoute, Match: "ca", Destination: website}},
+	}
+	for _, routes := range invalid {
+		_, err := srv.CreateShortURL(ctx, website, LinkOptions{Routes: routes})
+		AssertError(t, err, BadParamsErrType, fmt.Sprintf("invalid routes %+v", routes))
+	}
+}
+
+func TestService_Variants(t *testing.T) {
+	srv := newTestService(time.Hour)
+	ctx := context.Background()
+
+	const (
+		landingA = "https://example.org/a"
+		landingB = "https://example.org/b"
+		appStore = "https://apps.apple.com/app/id000000000"
+	)
+	u, err := srv.CreateShortURL(ctx, "https://example.org/", LinkOptions{
+		Routes:   []Route{{Kind: OSRoute, Match: IOS, Destination: appStore}},
+		Variants: []Variant{{Destination: landingA, Weight: 70}, {Destination: landingB, Weight: 30}},
+	})
+	AssertNoError(t, err, "creation short url")
+	parsed, _ := parseURL(u.Short)
+	key := shortURLKey(parsed)
+
+	const visits = 1000
+	counts := make(map[string]int)
+	for i := 0; i < visits; i++ {
+		got, err := srv.GetLongURL(ctx, u.Short, testVisitor)
+		AssertNoError(t, err, "getting long url")
+		if want := []string{"", landingA, landingB}[got.Variant]; got.Long != want {
+			t.Fatalf("variant %d: want %s, got %s", got.Variant, want, got.Long)
+		}
+		counts[got.Long]++
+	}
+	if share := float64(counts[landingA]) / visits; share < 0.6 || share > 0.8 {
+		t.Errorf("want about 70%% of visitors on the first variant, got %.2f", share)
+	}
+
+	// A visitor sticks to the assigned variant, a stale one is reassigned.
+	for i := 0; i < 20; i++ {
+		got, err := srv.GetLongURL(ctx, u.Short, &Visitor{Variants: map[string]int{key: 2}})
+		AssertNoError(t, err, "getting sticky variant")
+		if got.Long != landingB || got.Variant != 2 {
+			t.Fatalf("want the sticky variant %s, got %s", landingB, got.Long)
+		}
+	}
+	got, err := srv.GetLongURL(ctx, u.Short, &Visitor{Variants: map[string]int{key: 3}})
+	AssertNoError(t, err, "getting stale variant")
+	if got.Variant != 1 && got.Variant != 2 {
+		t.Errorf("want the stale variant to be reassigned, got %d", got.Variant)
+	}
+	counts[got.Long]++
+
+	// Routes win over the rotation.
+	iPhone := &Visitor{UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 14_2 like Mac OS X) Mobile/15E148"}
+	got, err = srv.GetLongURL(ctx, u.Short, iPhone)
+	AssertNoError(t, err, "getting routed url")
+	if got.Long != appStore || got.Variant != 0 {
+		t.Errorf("want the route %s, got %s (variant %d)", appStore, got.Long, got.Variant)
+	}
+
+	stat, err := srv.LinkStatistics(ctx, key, 1)
+	AssertNoError(t, err, "getting statistics")
+	if len(stat.Variants) != 2 {
+		t.Fatalf("want statistics of 2 variants, got %+v", stat.Variants)
+	}
+	if stat.Variants[0].Clicks != counts[landingA] || stat.Variants[1].Clicks != counts[landingB]+20 {
+		t.Errorf("want %d and %d clicks, got %+v", counts[landingA], counts[landingB]+20, stat.Variants)
+	}
+
+	invalid := [][]Variant{
+		{{Destination: landingA, Weight: 100}},
+		{{Destination: landingA, Weight: 0}, {Destination: landingB, Weight: 1}},
+		{{Destination: landingA, Weight: 1}, {Destination: "example.org/b", Weight: 1}},
+	}
+	for _, variants := range invalid {
+		_, err := srv.CreateShortURL(ctx, "https://example.org/", LinkOptions{Variants: variants})
+		AssertError(t, err, BadParamsErrType, fmt.Sprintf("invalid variants %+v", variants))
 	}
 }
 
-func newTestService(expired time.Duration) *Service {
+func TestService_Schedule(t *testing.T) {
+	now := time.Date(2020, 12, 1, 12, 0, 0, 0, time.UTC)
+	srv := newTestService(30*24*time.Hour, Config{Now: func() time.Time { return now }})
+	ctx := context.Background()
+
+	const (
+		eventPage    = "https://example.org/event"
+		registration = "https://example.org/register"
+		livestream   = "https://example.org/live"
+		recording    = "https://example.org/recording"
+	)
+	streamStart := time.Date(2020, 12, 3, 18, 0, 0, 0, time.UTC)
+	streamEnd := streamStart.Add(2 * time.Hour)
+	recordingStart := streamEnd.Add(24 * time.Hour)
+	registrationStart := now.Add(time.Hour)
+
+	u, err := srv.CreateShortURL(ctx, eventPage, LinkOptions{Schedule: []ScheduleEntry{
+		// Given out of order and in another time zone.
+		{Start: recordingStart, Destination: recording},
+		{Start: streamStart.In(time.FixedZone("UTC+3", 3*60*60)), End: streamEnd, Destination: livestream},
+		{Start: registrationStart, Destination: registration},
+	}})
+	AssertNoError(t, err, "creation short url")
+
+	cases := []struct {
+		at   time.Time
+		want string
+	}{
+		{at: registrationStart.Add(-time.Nanosecond), want: eventPage},
+		{at: registrationStart, want: registration},
+		{at: streamStart.Add(-time.Nanosecond), want: registration},
+		{at: streamStart, want: livestream},
+		{at: streamEnd.Add(-time.Nanosecond), want: livestream},
+		{at: streamEnd, want: eventPage},
+		{at: recordingStart.Add(-time.Nanosecond), want: eventPage},
+		{at: recordingStart, want: recording},
+		{at: recordingStart.AddDate(0, 0, 7), want: recording},
+	}
+	for _, c := range cases {
+		now = c.at
+		got, err := srv.GetLongURL(ctx, u.Short, testVisitor)
+		AssertNoError(t, err, c.at.String())
+		if got.Long != c.want {
+			t.Errorf("[%s] want %s, got %s", c.at, c.want, got.Long)
+		}
+	}
+
+	parsed, _ := parseURL(u.Short)
+	key := shortURLKey(parsed)
+	invalid := [][]ScheduleEntry{
+		{{Start: streamStart, End: streamEnd, Destination: livestream}, {Start: streamEnd.Add(-time.Minute), Destination: recording}},
+		{{Start: streamStart, Destination: livestream}, {Start: streamStart, Destination: recording}},
+		{{Start: streamStart, End: streamStart, Destination: livestream}},
+		{{Destination: livestream}},
+		{{Start: streamStart, Destination: "example.org/live"}},
+	}
+	for _, schedule := range invalid {
+		AssertError(t, srv.SetSchedule(ctx, key, schedule), BadParamsErrType, fmt.Sprintf("invalid schedule %+v", schedule))
+	}
+
+	AssertNoError(t, srv.SetSchedule(ctx, key, []ScheduleEntry{
+		{Start: streamStart, End: streamEnd, Destination: livestream},
+		{Start: streamEnd, Destination: recording},
+	}), "replacing schedule")
+	schedule, err := srv.Schedule(ctx, key)
+	AssertNoError(t, err, "getting schedule")
+	if len(schedule) != 2 || schedule[1].Destination != recording {
+		t.Errorf("want the replaced schedule, got %+v", schedule)
+	}
+	AssertError(t, srv.SetSchedule(ctx, "unknown", nil), NotFoundErrType, "schedule of unknown url")
+}
+
+func TestService_Fallbacks(t *testing.T) {
+	srv := newTestService(time.Hour)
+	db := srv.urlRepository.(*inMemoryDB)
+	ctx := context.Background()
+
+	const (
+		origin = "https://example.org/"
+		mirror = "https://mirror.example.org/"
+		backup = "https://backup.example.org/"
+	)
+	u, err := srv.CreateShortURL(ctx, origin, LinkOptions{Fallbacks: []string{mirror, backup}})
+	AssertNoError(t, err, "creation short url")
+
+	cases := []struct {
+		unhealthy []string
+		want      string
+	}{
+		{want: origin},
+		{unhealthy: []string{origin}, want: mirror},
+		{unhealthy: []string{origin, mirror}, want: backup},
+		{unhealthy: []string{mirror}, want: origin},
+		{unhealthy: []string{origin, mirror, backup}, want: origin},
+	}
+	for _, c := range cases {
+		for _, d := range []string{origin, mirror, backup} {
+			db.setHealth(d, !containsString(c.unhealthy, d))
+		}
+		got, err := srv.GetLongURL(ctx, u.Short, testVisitor)
+		AssertNoError(t, err, fmt.Sprintf("unhealthy %v", c.unhealthy))
+		if got.Long != c.want {
+			t.Errorf("[unhealthy %v] want %s, got %s", c.unhealthy, c.want, got.Long)
+		}
+	}
+
+	_, err = srv.CreateShortURL(ctx, origin, LinkOptions{Fallbacks: []string{"mirror.example.org"}})
+	AssertError(t, err, BadParamsErrType, "invalid fallback")
+}
+
+func TestService_PassThrough(t *testing.T) {
+	srv := newTestService(time.Hour)
+	ctx := context.Background()
+
+	create := func(destination string, opts LinkOptions) string {
+		u, err := srv.CreateShortURL(ctx, destination, opts)
+		AssertNoError(t, err, "creation short url")
+		return u.Short
+	}
+	docs := create("https://docs.internal/", LinkOptions{PassPath: true, PassQuery: true})
+	search := create("https://example.org/search?q=default&lang=en", LinkOptions{PassQuery: true})
+	article := create("https://example.org/article", LinkOptions{PassPath: true})
+	plain := create("https://example.org/plain?ref=link", LinkOptions{})
+
+	cases := []struct {
+		short string
+		want  string
+	}{
+		{short: docs, want: "https://docs.internal/"},
+		{short: docs + "/api/v2?x=1", want: "https://docs.internal/api/v2?x=1"},
+		{short: docs + "/a/c%20d/", want: "https://docs.internal/a/c%20d/"},
+		{short: search + "?q=shoes&page=2", want: "https://example.org/search?lang=en&page=2&q=shoes"},
+		{short: article + "/comments?x=1", want: "https://example.org/article/comments"},
+		{short: plain + "?x=1", want: "https://example.org/plain?ref=link"},
+	}
+	for _, c := range cases {
+		got, err := srv.GetLongURL(ctx, c.short, testVisitor)
+		AssertNoError(t, err, c.short)
+		if got.Long != c.want {
+			t.Errorf("[%s] want %s, got %s", c.short, c.want, got.Long)
+		}
+	}
+
+	guide := create("https://docs.internal/guide/", LinkOptions{PassPath: true})
+	escapes := []string{guide + "/../../admin", guide + "/%2e%2e/admin", guide + "/./a", guide + "/a%2Fb", guide + "/a%5c..%5cadmin"}
+	for _, short := range append([]string{search + "/more", plain + "/more"}, escapes...) {
+		_, err := srv.GetLongURL(ctx, short, testVisitor)
+		AssertError(t, err, NotFoundErrType, "path suffix of "+short)
+	}
+}
+
+func TestService_Languages(t *testing.T) {
+	srv := newTestService(time.Hour)
+	ctx := context.Background()
+
+	const (
+		english    = "https://example.org/docs"
+		german     = "https://example.org/de/docs"
+		french     = "https://example.org/fr/docs"
+		portuguese = "https://example.org/pt-br/docs"
+		chinese    = "https://example.org/zh-hant/docs"
+	)
+	u, err := srv.CreateShortURL(ctx, english, LinkOptions{DefaultLanguage: "en", Languages: []LanguageDestination{
+		{Tag: "de", Destination: german},
+		{Tag: "fr", Destination: french},
+		{Tag: "pt_BR", Destination: portuguese},
+		{Tag: "zh-Hant", Destination: chinese},
+	}})
+	AssertNoError(t, err, "creation short url")
+
+	cases := []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{acceptLanguage: "", want: english},
+		{acceptLanguage: "de-DE,de;q=0.9,en;q=0.8", want: german},
+		{acceptLanguage: "en-US,en;q=0.9,de;q=0.1", want: english},
+		{acceptLanguage: "en;q=0.5,fr;q=0.9", want: french},
+		{acceptLanguage: "pt-PT", want: portuguese},
+		{acceptLanguage: "zh-TW", want: chinese},
+		{acceptLanguage: "ja,ko;q=0.5", want: english},
+		{acceptLanguage: "fr;q=0", want: english},
+		{acceptLanguage: "*;q=?", want: english},
+	}
+	for _, c := range cases {
+		got, err := srv.GetLongURL(ctx, u.Short, &Visitor{AcceptLanguage: c.acceptLanguage})
+		AssertNoError(t, err, c.acceptLanguage)
+		if got.Long != c.want {
+			t.Errorf("[%s] want %s, got %s", c.acceptLanguage, c.want, got.Long)
+		}
+	}
+
+	parsed, _ := parseURL(u.Short)
+	key := shortURLKey(parsed)
+	replaced := &Localization{Default: "EN-gb", Languages: []LanguageDestination{{Tag: "DE-at", Destination: german}}}
+	AssertNoError(t, srv.SetLanguages(ctx, key, replaced), "replacing languages")
+	localization, err := srv.Languages(ctx, key)
+	AssertNoError(t, err, "getting languages")
+	if localization.Default != "en-GB" || len(localization.Languages) != 1 || localization.Languages[0].Tag != "de-AT" {
+		t.Errorf("want the replaced and canonicalized languages, got %+v", localization)
+	}
+
+	invalid := []*Localization{
+		{Default: "en", Languages: []LanguageDestination{{Tag: "not a tag", Destination: german}}},
+		{Default: "en", Languages: []LanguageDestination{{Tag: "de", Destination: german}, {Tag: "DE", Destination: french}}},
+		{Default: "en", Languages: []LanguageDestination{{Tag: "de", Destination: "example.org/de"}}},
+		{Default: "de", Languages: []LanguageDestination{{Tag: "de", Destination: german}}},
+		{Languages: []LanguageDestination{{Tag: "de", Destination: german}}},
+		{Default: "not a tag"},
+	}
+	for _, localization := range invalid {
+		AssertError(t, srv.SetLanguages(ctx, key, localization), BadParamsErrType, fmt.Sprintf("invalid languages %+v", localization))
+	}
+	AssertError(t, srv.SetLanguages(ctx, "unknown", &Localization{}), NotFoundErrType, "languages of unknown url")
+}
+
+func TestService_RedirectSettings(t *testing.T) {
+	srv := newTestService(time.Hour, Config{
+		RedirectStatus:      http.StatusTemporaryRedirect,
+		RedirectCacheMaxAge: time.Minute,
+	})
+	ctx := context.Background()
+
+	noCache := time.Duration(0)
+	day := 24 * time.Hour
+	cases := []struct {
+		opts       LinkOptions
+		wantStatus int
+		wantMaxAge time.Duration
+	}{
+		{opts: LinkOptions{}, wantStatus: http.StatusTemporaryRedirect, wantMaxAge: time.Minute},
+		{opts: LinkOptions{RedirectStatus: http.StatusMovedPermanently, CacheMaxAge: &day}, wantStatus: http.StatusMovedPermanently, wantMaxAge: day},
+		{opts: LinkOptions{RedirectStatus: http.StatusPermanentRedirect, CacheMaxAge: &noCache}, wantStatus: http.StatusPermanentRedirect, wantMaxAge: 0},
+	}
+	for _, c := range cases {
+		u, err := srv.CreateShortURL(ctx, "https://example.org/", c.opts)
+		AssertNoError(t, err, "creation short url")
+
+		got, err := srv.GetLongURL(ctx, u.Short, testVisitor)
+		AssertNoError(t, err, "getting long url")
+		if got.RedirectStatus != c.wantStatus || got.CacheMaxAge == nil || *got.CacheMaxAge != c.wantMaxAge {
+			t.Errorf("want %d cached for %s, got %d cached for %v", c.wantStatus, c.wantMaxAge, got.RedirectStatus, got.CacheMaxAge)
+		}
+	}
+
+	negative := -time.Second
+	invalid := []LinkOptions{
+		{RedirectStatus: http.StatusOK},
+		{RedirectStatus: http.StatusSeeOther},
+		{CacheMaxAge: &negative},
+	}
+	for _, opts := range invalid {
+		_, err := srv.CreateShortURL(ctx, "https://example.org/", opts)
+		AssertError(t, err, BadParamsErrType, fmt.Sprintf("invalid redirect settings %+v", opts))
+	}
+}
+
+func TestService_UTM(t *testing.T) {
+	srv := newTestService(time.Hour)
+	db := srv.urlRepository.(*inMemoryDB)
+	ctx := context.Background()
+
+	AssertNoError(t, srv.SetUTMTemplate(ctx, "Newsletter", UTM{Source: "newsletter", Medium: "email"}), "setting template")
+	AssertNoError(t, srv.SetUTMTemplate(ctx, "promo", UTM{Medium: "banner", Campaign: "promo"}), "setting template")
+
+	cases := []struct {
+		long string
+		opts LinkOptions
+		want string
+	}{
+		{
+			long: "https://example.org/sale?id=1",
+			opts: LinkOptions{UTM: UTM{Campaign: "black friday & more"}},
+			want: "https://example.org/sale?id=1&utm_campaign=black+friday+%26+more",
+		},
+		{
+			long: "https://example.org/sale?utm_source=old&utm_medium=cpc#top",
+			opts: LinkOptions{Tags: []string{"newsletter", "promo"}, UTM: UTM{Source: "partner"}},
+			want: "https://example.org/sale?utm_source=partner&utm_medium=cpc&utm_campaign=promo#top",
+		},
+		{
+			long: "https://example.org/sale?utm_source=a&flag&b=%7e&utm_source=b&id=2",
+			opts: LinkOptions{UTM: UTM{Source: "partner"}},
+			want: "https://example.org/sale?utm_source=partner&flag&b=%7e&id=2",
+		},
+		{
+			long: "https://example.org/sale?utm_campaign=kept",
+			opts: LinkOptions{Tags: []string{"unknown"}},
+			want: "https://example.org/sale?utm_campaign=kept",
+		},
+	}
+	for _, c := range cases {
+		u, err := srv.CreateShortURL(ctx, c.long, c.opts)
+		AssertNoError(t, err, c.long)
+		if u.Long != c.want {
+			t.Errorf("[%s] want %s, got %s", c.long, c.want, u.Long)
+		}
+
+		parsed, _ := parseURL(u.Short)
+		stored := db.store[shortURLKey(parsed)]
+		if stored.longURL != c.want || stored.rawLongURL != c.long {
+			t.Errorf("[%s] want the tagged and raw forms stored, got %s and %s", c.long, stored.longURL, stored.rawLongURL)
+		}
+
+		got, err := srv.GetLongURL(ctx, u.Short, testVisitor)
+		AssertNoError(t, err, "getting long url")
+		if got.Long != c.want {
+			t.Errorf("[%s] want to be redirected to %s, got %s", c.long, c.want, got.Long)
+		}
+	}
+
+	campaigns, err := srv.Campaigns(ctx, time.Hour, 10)
+	AssertNoError(t, err, "getting campaigns")
+	if len(campaigns) != 3 {
+		t.Errorf("want 3 campaigns, got %+v", campaigns)
+	}
+
+	utm, err := srv.UTMTemplate(ctx, " PROMO ")
+	AssertNoError(t, err, "getting template")
+	if utm.Campaign != "promo" {
+		t.Errorf("want the template of the tag, got %+v", utm)
+	}
+	AssertNoError(t, srv.SetUTMTemplate(ctx, "promo", UTM{}), "deleting template")
+	_, err = srv.UTMTemplate(ctx, "promo")
+	AssertError(t, err, NotFoundErrType, "deleted template")
+
+	_, err = srv.CreateShortURL(ctx, "https://example.org/", LinkOptions{UTM: UTM{Term: strings.Repeat("x", maxUTMLength+1)}})
+	AssertError(t, err, BadParamsErrType, "too long utm parameter")
+	_, err = srv.CreateShortURL(ctx, "https://example.org/?utm_term="+strings.Repeat("x", maxUTMLength+1), LinkOptions{})
+	AssertError(t, err, BadParamsErrType, "too long utm parameter of the long url")
+}
+
+func TestService_Canonicalize(t *testing.T) {
+	srv := newTestService(time.Hour, Config{
+		Canonicalize:   true,
+		TrackingParams: []string{"utm_*", "FBCLID", "ref"},
+	})
+	db := srv.urlRepository.(*inMemoryDB)
+	ctx := context.Background()
+
+	cases := []struct {
+		long string
+		want string
+	}{
+		{"HTTPS://Example.ORG:443", "https://example.org/"},
+		{"http://example.org:80/a?b=1", "http://example.org/a?b=1"},
+		{"http://example.org:8080/a", "http://example.org:8080/a"},
+		{"https://example.org/p?z=1&a=2&a=1&fbclid=x&UTM_Source=y", "https://example.org/p?a=2&a=1&z=1"},
+		{"https://example.org/%7euser/%e2%82%ac?q=%41%2f&ref=home", "https://example.org/~user/%E2%82%AC?q=A%2F"},
+		{"https://example.org/a?ref=home#Top", "https://example.org/a#Top"},
+	}
+	for _, c := range cases {
+		u, err := srv.CreateShortURL(ctx, c.long, LinkOptions{})
+		AssertNoError(t, err, c.long)
+		if u.Long != c.want {
+			t.Errorf("[%s] want %s, got %s", c.long, c.want, u.Long)
+		}
+
+		parsed, _ := parseURL(u.Short)
+		stored := db.store[shortURLKey(parsed)]
+		if stored.longURL != c.want || stored.canonicalURL != c.want || stored.rawLongURL != c.long {
+			t.Errorf("[%s] want the canonical form stored along with the input, got %s, %s and %s",
+				c.long, stored.longURL, stored.canonicalURL, stored.rawLongURL)
+		}
+	}
+
+	u, err := srv.CreateShortURL(ctx, "https://example.org/?utm_source=old&b=1", LinkOptions{UTM: UTM{Source: "partner"}})
+	AssertNoError(t, err, "tagging canonical url")
+	if want := "https://example.org/?b=1&utm_source=partner"; u.Long != want {
+		t.Errorf("want the link tagged after canonicalization %s, got %s", want, u.Long)
+	}
+
+	u, err = newTestService(time.Hour).CreateShortURL(ctx, "HTTPS://Example.ORG:443?fbclid=x", LinkOptions{})
+	AssertNoError(t, err, "disabled canonicalization")
+	if u.Long != "HTTPS://Example.ORG:443?fbclid=x" {
+		t.Errorf("want the url stored as is, got %s", u.Long)
+	}
+}
+
+func TestService_Dedupe(t *testing.T) {
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	srv := newTestService(time.Hour, Config{
+		Now:          func() time.Time { return now },
+		Canonicalize: true,
+		Dedupe:       true,
+	})
+	ctx := context.Background()
+
+	first, err := srv.CreateShortURL(ctx, "https://example.org/a?fbclid=1", LinkOptions{})
+	AssertNoError(t, err, "creating link")
+	if first.Existing {
+		t.Errorf("want a new link, got an existing one")
+	}
+
+	now = now.Add(time.Second)
+	second, err := srv.CreateShortURL(ctx, "HTTPS://Example.ORG/a", LinkOptions{})
+	AssertNoError(t, err, "creating duplicate")
+	if !second.Existing || second.Short != first.Short {
+		t.Errorf("want the existing link %s, got %+v", first.Short, second)
+	}
+
+	now = now.Add(time.Second)
+	tagged, err := srv.CreateShortURL(ctx, "https://example.org/a", LinkOptions{Tags: []string{"promo"}})
+	AssertNoError(t, err, "creating link with options")
+	if tagged.Existing || tagged.Short == first.Short {
+		t.Errorf("want a new link for a link with options, got %+v", tagged)
+	}
+
+	now = now.Add(time.Second)
+	campaign, err := srv.CreateShortURL(ctx, "https://example.org/a", LinkOptions{UTM: UTM{Campaign: "spring"}})
+	AssertNoError(t, err, "creating link with utm")
+	if campaign.Existing || campaign.Short == first.Short {
+		t.Errorf("want a new link for another campaign, got %+v", campaign)
+	}
+
+	now = now.Add(2 * time.Hour)
+	renewed, err := srv.CreateShortURL(ctx, "https://example.org/a", LinkOptions{})
+	AssertNoError(t, err, "creating link after expiry")
+	if renewed.Existing || renewed.Short == first.Short {
+		t.Errorf("want a new link after the old one expired, got %+v", renewed)
+	}
+
+	now = now.Add(time.Second)
+	disabled := newTestService(time.Hour, Config{Now: func() time.Time { return now }})
+	disabled.urlRepository = srv.urlRepository
+	u, err := disabled.CreateShortURL(ctx, "https://example.org/a", LinkOptions{})
+	AssertNoError(t, err, "creating link without dedupe")
+	if u.Existing || u.Short == renewed.Short {
+		t.Errorf("want a new link without dedupe, got %+v", u)
+	}
+}
+
+func TestService_FindLinks(t *testing.T) {
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	srv := newTestService(time.Hour, Config{Now: func() time.Time { return now }})
+	ctx := context.Background()
+
+	create := func(long string, opts LinkOptions) string {
+		now = now.Add(time.Minute)
+		u, err := srv.CreateShortURL(ctx, long, opts)
+		AssertNoError(t, err, long)
+		return u.Short
+	}
+	old := create("https://example.org/page", LinkOptions{})
+	now = now.Add(2 * time.Hour)
+	plain := create("https://example.org/page", LinkOptions{})
+	tagged := create("https://example.org/page", LinkOptions{UTM: UTM{Source: "newsletter"}})
+	variant := create("HTTPS://Example.org:443/page?fbclid=1", LinkOptions{})
+	create("https://example.org/other", LinkOptions{})
+
+	cases := []struct {
+		target string
+		match  string
+		want   []string
+	}{
+		{"https://example.org/page", ExactMatch, []string{tagged, plain, old}},
+		{"https://example.org/page?utm_source=newsletter", ExactMatch, []string{tagged}},
+		{"https://example.org/page", CanonicalMatch, []string{variant, tagged, plain, old}},
+		{"https://example.org/missing", CanonicalMatch, nil},
+	}
+	for _, c := range cases {
+		page, err := srv.FindLinks(ctx, c.target, c.match, 0)
+		AssertNoError(t, err, c.target)
+		if page.Truncated {
+			t.Errorf("[%s] want all links on the page", c.target)
+		}
+		var got []string
+		for _, l := range page.Links {
+			got = append(got, l.Short)
+			if l.Expired != (l.Short == old) {
+				t.Errorf("[%s] want only %s expired, got %+v", c.target, old, l)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("[%s %s] want %v, got %v", c.match, c.target, c.want, got)
+		}
+	}
+
+	_, err := srv.FindLinks(ctx, "https://example.org/page", "fuzzy", 0)
+	AssertError(t, err, BadParamsErrType, "unknown match")
+	_, err = srv.FindLinks(ctx, "example.org/page", ExactMatch, 0)
+	AssertError(t, err, BadParamsErrType, "relative target")
+	_, err = srv.FindLinks(ctx, "https://example.org/page", ExactMatch, -1)
+	AssertError(t, err, BadParamsErrType, "negative offset")
+
+	// A link created before canonical forms were stored.
+	db := srv.urlRepository.(*inMemoryDB)
+	legacy := "HTTPS://Example.org/page?gclid=1"
+	db.store["legacy"] = row{longURL: legacy, rawLongURL: legacy, createdAt: now.Add(time.Minute)}
+	filled, err := srv.BackfillCanonical(ctx)
+	AssertNoError(t, err, "backfilling canonical forms")
+	if filled != 1 {
+		t.Errorf("want the canonical form of 1 link stored, got %d", filled)
+	}
+	page, err := srv.FindLinks(ctx, "https://example.org/page", CanonicalMatch, 0)
+	AssertNoError(t, err, "finding backfilled link")
+	if len(page.Links) != 5 || page.Links[0].Long != legacy {
+		t.Errorf("want the backfilled link found by its canonical form, got %+v", page.Links)
+	}
+
+	for i := 0; i <= maxTargetLinks; i++ {
+		create("https://example.org/paged", LinkOptions{})
+	}
+	first, err := srv.FindLinks(ctx, "https://example.org/paged", ExactMatch, 0)
+	AssertNoError(t, err, "first page")
+	last, err := srv.FindLinks(ctx, "https://example.org/paged", ExactMatch, maxTargetLinks)
+	AssertNoError(t, err, "last page")
+	if len(first.Links) != maxTargetLinks || !first.Truncated {
+		t.Errorf("want a truncated page of %d links, got %d", maxTargetLinks, len(first.Links))
+	}
+	if len(last.Links) != 1 || last.Truncated || last.Links[0].Short == first.Links[maxTargetLinks-1].Short {
+		t.Errorf("want the oldest link alone on the last page, got %+v", last)
+	}
+}
+
+func TestService_IDN(t *testing.T) {
+	ctx := context.Background()
+	newService := func(policy string) *Service {
+		return newTestService(time.Hour, Config{MixedScriptPolicy: policy})
+	}
+	srv := newService("")
+
+	cases := []struct {
+		long    string
+		want    string
+		display string
+		mixed   bool
+	}{
+		{"https://user@Пример.РФ:8080/путь?q=1", "https://user@xn--e1afmkfd.xn--p1ai:8080/путь?q=1", "https://user@пример.рф:8080/путь?q=1", false},
+		{"https://pаypal.com/login", "https://xn--pypal-4ve.com/login", "https://pаypal.com/login", true},
+		{"https://xn--pypal-4ve.com/login", "https://xn--pypal-4ve.com/login", "https://pаypal.com/login", true},
+		{"https://例え.テスト/", "https://xn--r8jz45g.xn--zckzah/", "https://例え.テスト/", false},
+		{"https://Exa_mple.com/", "https://Exa_mple.com/", "https://Exa_mple.com/", false},
+	}
+	for _, c := range cases {
+		u, err := srv.CreateShortURL(ctx, c.long, LinkOptions{})
+		AssertNoError(t, err, c.long)
+		if u.Long != c.want || u.Display != c.display || u.MixedScript != c.mixed {
+			t.Errorf("[%s] want %s, %s and mixed %v, got %s, %s and %v", c.long, c.want, c.display, c.mixed, u.Long, u.Display, u.MixedScript)
+		}
+	}
+
+	page, err := srv.FindLinks(ctx, "https://user@пример.рф:8080/путь?q=1", ExactMatch, 0)
+	AssertNoError(t, err, "finding by unicode host")
+	if len(page.Links) != 1 || page.Links[0].Display != "https://user@пример.рф:8080/путь?q=1" {
+		t.Errorf("want the link by the unicode host, got %+v", page.Links)
+	}
+
+	_, err = srv.CreateShortURL(ctx, "https://xn--zz.com/", LinkOptions{})
+	AssertError(t, err, BadParamsErrType, "invalid punycode")
+	_, err = newService(MixedScriptReject).CreateShortURL(ctx, "https://pаypal.com/", LinkOptions{})
+	AssertError(t, err, BadParamsErrType, "rejected mixed script")
+	u, err := newService(MixedScriptAllow).CreateShortURL(ctx, "https://pаypal.com/", LinkOptions{})
+	AssertNoError(t, err, "allowed mixed script")
+	if u.MixedScript {
+		t.Errorf("want mixed scripts allowed silently")
+	}
+}
+
+func TestService_DestinationFilter(t *testing.T) {
+	filter := testFilter{"blocked.org": true}
+	srv := newTestService(time.Hour, Config{Filter: filter})
+	db := srv.urlRepository.(*inMemoryDB)
+	ctx := context.Background()
+
+	denied := []struct {
+		long string
+		opts LinkOptions
+	}{
+		{"https://blocked.org/page", LinkOptions{}},
+		{"https://example.org/", LinkOptions{Fallbacks: []string{"https://blocked.org/"}}},
+		{"https://example.org/", LinkOptions{Routes: []Route{{Kind: OSRoute, Match: "ios", Destination: "https://blocked.org/"}}}},
+	}
+	for _, c := range denied {
+		_, err := srv.CreateShortURL(ctx, c.long, c.opts)
+		AssertError(t, err, ForbiddenErrType, c.long)
+		if sErr, ok := err.(Error); !ok || sErr.Code != DestinationDeniedCode {
+			t.Errorf("[%s] want the destination denied code, got %+v", c.long, err)
+		}
+	}
+
+	u, err := srv.CreateShortURL(ctx, "https://example.org/page", LinkOptions{})
+	AssertNoError(t, err, "creating allowed link")
+	parsed, _ := parseURL(u.Short)
+	key := shortURLKey(parsed)
+
+	schedule := []ScheduleEntry{{Start: time.Now().Add(time.Hour), Destination: "https://blocked.org/"}}
+	AssertError(t, srv.SetSchedule(ctx, key, schedule), ForbiddenErrType, "denied schedule")
+
+	_, err = srv.GetLongURL(ctx, u.Short, testVisitor)
+	AssertNoError(t, err, "resolving allowed link")
+	lastAccess := *db.store[key].lastAccess
+
+	_, err = srv.GetLongURL(ctx, u.Short+"/probe", testVisitor)
+	AssertError(t, err, NotFoundErrType, "resolving unknown path")
+	filter["example.org"] = true
+	_, err = srv.GetLongURL(ctx, u.Short, testVisitor)
+	AssertError(t, err, ForbiddenErrType, "resolving newly denied link")
+	if len(db.misses) != 2 || db.misses[1].Event != DeniedMiss || db.misses[1].Key != key {
+		t.Errorf("want a denied miss recorded, got %+v", db.misses)
+	}
+	if got := *db.store[key].lastAccess; !got.Equal(lastAccess) {
+		t.Errorf("want the link life kept by failed resolutions, last access moved to %s", got)
+	}
+}
+
+func TestService_SafeDestinations(t *testing.T) {
+	resolver := testResolver{
+		"intranet.example.org": {net.ParseIP("10.1.2.3")},
+		"mixed.example.org":    {net.ParseIP("93.184.216.34"), net.ParseIP("fd00::1")},
+		"public.example.org":   {net.ParseIP("93.184.216.34")},
+	}
+	srv := newTestService(time.Hour, Config{Resolver: resolver})
+	ctx := context.Background()
+
+	rejected := []string{
+		"ftp://example.org/file",
+		"javascript://example.org/%0Aalert(1)",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://localhost:5432",
+		"http://api.LOCALHOST./",
+		"http://127.0.0.1/",
+		"http://2130706433/",
+		"http://0x7f.1/",
+		"http://0177.0.0.1/",
+		"http://10.0.0.8/",
+		"http://[::1]:8080/",
+		"http://[::ffff:192.168.1.1]/",
+		"http://[fe80::1]/",
+		"http://224.0.0.251/",
+		"http://0.0.0.0/",
+		"http://intranet.example.org/",
+		"http://mixed.example.org/",
+		"http://unknown.example.org/",
+	}
+	for _, long := range rejected {
+		_, err := srv.CreateShortURL(ctx, long, LinkOptions{})
+		AssertError(t, err, BadParamsErrType, long)
+	}
+
+	_, err := srv.CreateShortURL(ctx, "https://public.example.org/", LinkOptions{Fallbacks: []string{"http://192.168.0.10/"}})
+	AssertError(t, err, BadParamsErrType, "internal fallback")
+
+	for _, long := range []string{"HTTPS://public.example.org/", "http://93.184.216.34/", "http://[2606:2800:220:1::]/"} {
+		_, err := srv.CreateShortURL(ctx, long, LinkOptions{})
+		AssertNoError(t, err, long)
+	}
+
+	internal := newTestService(time.Hour, Config{
+		AllowedSchemes: []string{"https", "ftp"},
+		AllowInternal:  true,
+		Resolver:       resolver,
+	})
+	for _, long := range []string{"ftp://10.0.0.8/file", "https://intranet.example.org/", "https://localhost/"} {
+		_, err := internal.CreateShortURL(ctx, long, LinkOptions{})
+		AssertNoError(t, err, long)
+	}
+	_, err = internal.CreateShortURL(ctx, "http://public.example.org/", LinkOptions{})
+	AssertError(t, err, BadParamsErrType, "scheme not in the configured list")
+}
+
+func TestService_ShortenerChains(t *testing.T) {
+	var hops int
+	mux := http.NewServeMux()
+	redirect := func(path, location string) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			hops++
+			http.Redirect(w, r, location, http.StatusMovedPermanently)
+		})
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	redirect("/a", server.URL+"/b")
+	redirect("/b", "https://example.org/final?id=1")
+	redirect("/relative", "/a")
+	redirect("/loop", "/loop-back")
+	redirect("/loop-back", server.URL+"/loop")
+	redirect("/us", "http://"+hostName+"/4bd1f2e8a6c3")
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	newService := func(maxHops int) *Service {
+		return newTestService(time.Hour, Config{
+			AllowInternal:    true,
+			ShortenerDomains: []string{"127.0.0.1", "bit.ly"},
+			MaxChainHops:     maxHops,
+		})
+	}
+	srv := newService(3)
+	ctx := context.Background()
+
+	for _, path := range []string{"/a", "/relative"} {
+		hops = 0
+		u, err := srv.CreateShortURL(ctx, server.URL+path, LinkOptions{})
+		AssertNoError(t, err, path)
+		if u.Long != "https://example.org/final?id=1" {
+			t.Errorf("[%s] want the final destination stored, got %s", path, u.Long)
+		}
+		if hops == 0 {
+			t.Errorf("[%s] want the chain followed", path)
+		}
+	}
+
+	for _, path := range []string{"/loop", "/us", "/page", "/missing"} {
+		_, err := srv.CreateShortURL(ctx, server.URL+path, LinkOptions{})
+		AssertError(t, err, BadParamsErrType, path)
+	}
+
+	_, err := newService(1).CreateShortURL(ctx, server.URL+"/a", LinkOptions{})
+	AssertError(t, err, BadParamsErrType, "too long chain")
+
+	rejected := []struct {
+		long string
+		opts LinkOptions
+	}{
+		{"http://" + hostName + "/4bd1f2e8a6c3", LinkOptions{}},
+		{"https://EXAMPLE.com./4bd1f2e8a6c3", LinkOptions{}},
+		{"https://bit.ly/abc", LinkOptions{}},
+		{"https://www.bit.ly/abc", LinkOptions{}},
+		{"https://example.org/", LinkOptions{Fallbacks: []string{"https://bit.ly/abc"}}},
+		{"https://example.org/", LinkOptions{Variants: []Variant{{Destination: "https://example.org/b", Weight: 1}, {Destination: "http://" + hostName + "/x", Weight: 1}}}},
+	}
+	for _, c := range rejected {
+		hops = 0
+		_, err := newService(0).CreateShortURL(ctx, c.long, c.opts)
+		AssertError(t, err, BadParamsErrType, c.long)
+	}
+	_, err = newService(0).CreateShortURL(ctx, server.URL+"/a", LinkOptions{})
+	AssertError(t, err, BadParamsErrType, "shortener without following")
+	if hops != 0 {
+		t.Errorf("want no requests without following, got %d", hops)
+	}
+
+	_, err = newService(0).CreateShortURL(ctx, "https://notbit.ly/abc", LinkOptions{})
+	AssertNoError(t, err, "domain that only ends like a shortener")
+
+	hops = 0
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/a", nil)
+	if _, err := newChainClient(false).Do(req); err == nil || !strings.Contains(err.Error(), ErrInternalAddress.Error()) {
+		t.Errorf("want the default client to refuse internal addresses, got %v", err)
+	}
+	if hops != 0 {
+		t.Errorf("want no requests to internal addresses, got %d", hops)
+	}
+}
+
+type testResolver map[string][]net.IP
+
+func (r testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	return addrs, nil
+}
+
+type testFilter map[string]bool
+
+func (f testFilter) Allowed(u *url.URL) bool {
+	return !f[u.Hostname()]
+}
+
+type testGeoLocator map[string]Location
+
+func (g testGeoLocator) Locate(ip net.IP) (Location, error) {
+	return g[ip.String()], nil
+}
+
+type testPublisher struct {
+	events []ClickEvent
+}
+
+func (p *testPublisher) Publish(e *ClickEvent) {
+	p.events = append(p.events, *e)
+}
+
+type testExportWriter struct {
+	events  []AccessEvent
+	rollups []DailyRollup
+	err     error
+}
+
+func (w *testExportWriter) WriteEvent(e *AccessEvent) error {
+	w.events = append(w.events, *e)
+	return w.err
+}
+
+func (w *testExportWriter) WriteRollup(r *DailyRollup) error {
+	w.rollups = append(w.rollups, *r)
+	return w.err
+}
+
+type inMemoryDB struct {
+	mu             sync.Mutex
+	store          map[string]row
+	shortStatStore []time.Time
+	longStatStore  []time.Time
+	linkAccess     map[string][]Access
+	misses         []Miss
+	conversions    map[string]time.Time
+	unhealthy      map[string]bool
+	utmTemplates   map[string]UTM
+}
+
+func newInMemoryDB() *inMemoryDB {
+	return &inMemoryDB{
+		store:        make(map[string]row),
+		linkAccess:   make(map[string][]Access),
+		conversions:  make(map[string]time.Time),
+		unhealthy:    make(map[string]bool),
+		utmTemplates: make(map[string]UTM),
+	}
+}
+
+type row struct {
+	longURL         string
+	rawLongURL      string
+	canonicalURL    string
+	lastAccess      *time.Time
+	createdAt       time.Time
+	ignoreBotAccess bool
+	tags            []string
+	domain          string
+	isExpired       bool
+	deduplicated    bool
+	options         LinkOptions
+}
+
+func (db *inMemoryDB) Save(ctx context.Context, url *NewURL) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.store[url.Short] = row{
+		longURL:         url.Long,
+		rawLongURL:      url.RawLong,
+		canonicalURL:    url.Canonical,
+		createdAt:       url.CreatedAt,
+		ignoreBotAccess: url.IgnoreBotAccess,
+		tags:            url.Tags,
+		domain:          url.Domain,
+		deduplicated:    url.Deduplicated,
+		options:         url.LinkOptions,
+	}
+	return nil
+}
+
+func (db *inMemoryDB) GetDuplicate(ctx context.Context, origin string, isExpired CheckExpiredFunc) (*URL, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for key, u := range db.store {
+		if !u.deduplicated || u.isExpired || u.longURL != origin {
+			continue
+		}
+		if isExpired(u.lastAccess, u.createdAt) {
+			u.isExpired = true
+			db.store[key] = u
+			continue
+		}
+		return &URL{Long: u.longURL, Short: key}, nil
+	}
+	return nil, NewNotFoundError("url not found")
+}
+
+func (db *inMemoryDB) UpdateAccess(ctx context.Context, shortURL string, at time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, exists := db.store[shortURL]
+	if !exists {
+		return NewNotFoundError("url not found")
+	}
+	u.lastAccess = &at
+	db.store[shortURL] = u
+	return nil
+}
+
+func (db *inMemoryDB) GetIfNotExpired(ctx context.Context, s *ShortURL, isExpired CheckExpiredFunc) (*URL, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, exists := db.store[s.URL]
+	if !exists {
+		return nil, NewNotFoundError("url not found")
+	}
+
+	if u.isExpired || isExpired(u.lastAccess, u.createdAt) {
+		u.isExpired = true
+		db.store[s.URL] = u
+		return nil, NewExpiredError("url not found")
+	}
+
+	unhealthy := make(map[string]bool)
+	for d := range db.unhealthy {
+		unhealthy[d] = true
+	}
+	return &URL{Long: u.longURL, Short: s.URL, Unhealthy: unhealthy, LinkOptions: u.options}, nil
+}
+
+func (db *inMemoryDB) WithoutCanonical(ctx context.Context, limit int) ([]URL, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var urls []URL
+	for key, u := range db.store {
+		if u.canonicalURL == "" && len(urls) < limit {
+			urls = append(urls, URL{Short: key, Long: u.longURL})
+		}
+	}
+	return urls, nil
+}
+
+func (db *inMemoryDB) SetCanonical(ctx context.Context, shortURL, canonical string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u := db.store[shortURL]
+	u.canonicalURL = canonical
+	db.store[shortURL] = u
+	return nil
+}
+
+func (db *inMemoryDB) FindLinks(ctx context.Context, q *TargetQuery) ([]TargetLink, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var links []TargetLink
+	for key, u := range db.store {
+		if q.Canonical != "" && u.canonicalURL == q.Canonical || q.URL != "" && (u.longURL == q.URL || u.rawLongURL == q.URL) {
+			links = append(links, TargetLink{Short: key, Long: u.longURL, CreatedAt: u.createdAt, LastAccess: u.lastAccess, Expired: u.isExpired})
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if !links[i].CreatedAt.Equal(links[j].CreatedAt) {
+			return links[i].CreatedAt.After(links[j].CreatedAt)
+		}
+		return links[i].Short < links[j].Short
+	})
+	if q.Offset >= len(links) {
+		return nil, nil
+	}
+	links = links[q.Offset:]
+	if len(links) > q.Limit {
+		links = links[:q.Limit]
+	}
+	return links, nil
+}
+
+func (db *inMemoryDB) IncShort(ctx context.Context) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.shortStatStore = append(db.shortStatStore, time.Now())
+	return nil
+}
+
+func (db *inMemoryDB) IncLong(ctx context.Context, access *Access) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if access.HitKind == HumanHit {
+		db.longStatStore = append(db.longStatStore, access.AccessAt)
+	}
+	db.linkAccess[access.ShortURL] = append(db.linkAccess[access.ShortURL], *access)
+	return nil
+}
+
+func (db *inMemoryDB) DailyStatistics(ctx context.Context, shortURL string, from time.Time) ([]DailyStatistics, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, exists := db.store[shortURL]; !exists {
+		return nil, NewNotFoundError("url not found")
+	}
+
+	byDay := make(map[time.Time]*DailyStatistics)
+	dayOf := func(t time.Time) *DailyStatistics {
+		day := truncateToDay(t.UTC())
+		d, ok := byDay[day]
+		if !ok {
+			d = &DailyStatistics{Day: day}
+			byDay[day] = d
+		}
+		return d
+	}
+	for _, a := range db.linkAccess[shortURL] {
+		// Conversions count on the day they come, like the repository does.
+		if at, ok := db.conversions[a.ClickID]; ok && a.ClickID != "" && !at.Before(from) {
+			dayOf(at).Conversions++
+		}
+		if a.AccessAt.Before(from) {
+			continue
+		}
+		d := dayOf(a.AccessAt)
+		if a.HitKind != HumanHit {
+			d.BotClicks++
+			continue
+		}
+		d.Clicks++
+		if d.Visitors == nil {
+			d.Visitors = hll.New()
+		}
+		d.Visitors.Add(a.VisitorHash)
+	}
+
+	daily := make([]DailyStatistics, 0, len(byDay))
+	for _, d := range byDay {
+		daily = append(daily, *d)
+	}
+	sort.Slice(daily, func(i, j int) bool { return daily[i].Day.Before(daily[j].Day) })
+
+	return daily, nil
+}
+
+func (db *inMemoryDB) VariantStatistics(ctx context.Context, shortURL string, from time.Time) ([]VariantStatistics, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stat := make([]VariantStatistics, 0, len(db.store[shortURL].options.Variants))
+	for i, v := range db.store[shortURL].options.Variants {
+		stat = append(stat, VariantStatistics{Variant: i + 1, Destination: v.Destination})
+	}
+	for _, a := range db.linkAccess[shortURL] {
+		if a.Variant > 0 && a.HitKind == HumanHit && !a.AccessAt.Before(from) {
+			stat[a.Variant-1].Clicks++
+		}
+	}
+	return stat, nil
+}
+
+func (db *inMemoryDB) setHealth(destination string, healthy bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if healthy {
+		delete(db.unhealthy, destination)
+	} else {
+		db.unhealthy[destination] = true
+	}
+}
+
+func (db *inMemoryDB) StatShortURL(ctx context.Context) (*Statistics, error) {
+	return stat(db.shortStatStore), nil
+}
+
+func (db *inMemoryDB) StatLongURL(ctx context.Context) (*Statistics, error) {
+	return stat(db.longStatStore), nil
+}
+
+func (db *inMemoryDB) ClickHistograms(ctx context.Context) (*ClickHistograms, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	times := make(map[[2]int]int)
+	ages, intervals := make(map[int]int), make(map[int]int)
+	for short, accesses := range db.linkAccess {
+		var prev *time.Time
+		for i := range accesses {
+			a := accesses[i]
+			if a.HitKind != HumanHit {
+				continue
+			}
+			times[[2]int{a.AccessAt.UTC().Hour(), int(a.AccessAt.UTC().Weekday())}]++
+			ages[DurationBucket(a.AccessAt.Sub(db.store[short].createdAt))]++
+			if prev != nil {
+				intervals[DurationBucket(a.AccessAt.Sub(*prev))]++
+			}
+			prev = &a.AccessAt
+		}
+	}
+
+	h := &ClickHistograms{}
+	for t, count := range times {
+		h.Times = append(h.Times, ClickTimeCount{Hour: t[0], Weekday: t[1], Count: count})
+	}
+	for bucket, count := range ages {
+		h.LinkAge = append(h.LinkAge, DurationCount{Bucket: bucket, Count: count})
+	}
+	for bucket, count := range intervals {
+		h.InterClick = append(h.InterClick, DurationCount{Bucket: bucket, Count: count})
+	}
+	return h, nil
+}
+
+func (db *inMemoryDB) TopLinks(ctx context.Context, f *TopFilter) ([]TopLink, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var top []TopLink
+	for short, accesses := range db.linkAccess {
+		r := db.store[short]
+		if f.Tag != "" && !containsString(r.tags, f.Tag) {
+			continue
+		}
+		if f.Domain != "" && r.domain != f.Domain && !strings.HasSuffix(r.domain, "."+f.Domain) {
+			continue
+		}
+
+		l := TopLink{Long: r.longURL, Short: short}
+		for _, a := range accesses {
+			switch {
+			case a.HitKind != HumanHit, a.AccessAt.Before(f.PreviousSince), !a.AccessAt.Before(f.Until):
+			case a.AccessAt.Before(f.Since):
+				l.PreviousClicks++
+			default:
+				l.Clicks++
+			}
+		}
+		if l.Clicks > 0 {
+			l.Growth = Growth(l.Clicks, l.PreviousClicks)
+			top = append(top, l)
+		}
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if f.Trending && top[i].Growth != top[j].Growth {
+			return top[i].Growth > top[j].Growth
+		}
+		if top[i].Clicks != top[j].Clicks {
+			return top[i].Clicks > top[j].Clicks
+		}
+		return top[i].Short < top[j].Short
+	})
+	if len(top) > f.Limit {
+		top = top[:f.Limit]
+	}
+
+	return top, nil
+}
+
+func (db *inMemoryDB) ExportEvents(ctx context.Context, from, until time.Time, fn func(*AccessEvent) error) error {
+	for _, a := range db.accessesInRange(from, until) {
+		if err := fn(&AccessEvent{ShortURL: a.ShortURL, AccessAt: a.AccessAt, HitKind: a.HitKind}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *inMemoryDB) ExportRollups(ctx context.Context, from, until time.Time, fn func(*DailyRollup) error) error {
+	var rollups []*DailyRollup
+	for _, a := range db.accessesInRange(from, until) {
+		var r *DailyRollup
+		for _, existing := range rollups {
+			if existing.ShortURL == a.ShortURL && existing.Day.Equal(truncateToDay(a.AccessAt.UTC())) {
+				r = existing
+			}
+		}
+		if r == nil {
+			r = &DailyRollup{ShortURL: a.ShortURL}
+			r.Day, r.Visitors = truncateToDay(a.AccessAt.UTC()), hll.New()
+			rollups = append(rollups, r)
+		}
+
+		if a.HitKind != HumanHit {
+			r.BotClicks++
+			continue
+		}
+		r.Clicks++
+		r.Visitors.Add(a.VisitorHash)
+	}
+
+	for _, r := range rollups {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *inMemoryDB) accessesInRange(from, until time.Time) []Access {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var accesses []Access
+	for _, arr := range db.linkAccess {
+		for _, a := range arr {
+			if !a.AccessAt.Before(from) && a.AccessAt.Before(until) {
+				accesses = append(accesses, a)
+			}
+		}
+	}
+	sort.Slice(accesses, func(i, j int) bool { return accesses[i].AccessAt.Before(accesses[j].AccessAt) })
+	return accesses
+}
+
+func (db *inMemoryDB) AddMiss(ctx context.Context, miss *Miss) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.misses = append(db.misses, *miss)
+	return nil
+}
+
+func (db *inMemoryDB) DeleteMisses(ctx context.Context, before time.Time) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	kept := db.misses[:0]
+	for _, m := range db.misses {
+		if !m.OccurredAt.Before(before) {
+			kept = append(kept, m)
+		}
+	}
+	deleted := int64(len(db.misses) - len(kept))
+	db.misses = kept
+	return deleted, nil
+}
+
+func (db *inMemoryDB) TopMisses(ctx context.Context, event string, since time.Time, limit int) ([]MissCount, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	counts := make(map[string]*MissCount)
+	for _, m := range db.misses {
+		if m.Event != event || m.OccurredAt.Before(since) {
+			continue
+		}
+		c, ok := counts[m.Key]
+		if !ok {
+			c = &MissCount{Key: m.Key}
+			counts[m.Key] = c
+		}
+		c.Count++
+		if m.OccurredAt.After(c.LastSeen) {
+			c.LastSeen = m.OccurredAt
+		}
+	}
+
+	top := make([]MissCount, 0, len(counts))
+	for _, c := range counts {
+		top = append(top, *c)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].LastSeen.After(top[j].LastSeen)
+	})
+	if len(top) > limit {
+		top = top[:limit]
+	}
+
+	return top, nil
+}
+
+func (db *inMemoryDB) AddConversion(ctx context.Context, clickID string, at time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, accesses := range db.linkAccess {
+		for _, a := range accesses {
+			if a.ClickID != clickID {
+				continue
+			}
+			if _, ok := db.conversions[clickID]; !ok {
+				db.conversions[clickID] = at
+			}
+			return nil
+		}
+	}
+
+	return NewNotFoundError("click not found")
+}
+
+func (db *inMemoryDB) Routes(ctx context.Context, shortURL string) ([]Route, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, exists := db.store[shortURL]
+	if !exists {
+		return nil, NewNotFoundError("url not found")
+	}
+	return u.options.Routes, nil
+}
+
+func (db *inMemoryDB) SetRoutes(ctx context.Context, shortURL string, routes []Route) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, exists := db.store[shortURL]
+	if !exists {
+		return NewNotFoundError("url not found")
+	}
+	u.options.Routes = routes
+	db.store[shortURL] = u
+	return nil
+}
+
+func (db *inMemoryDB) Languages(ctx context.Context, shortURL string) (*Localization, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, exists := db.store[shortURL]
+	if !exists {
+		return nil, NewNotFoundError("url not found")
+	}
+	return &Localization{Default: u.options.DefaultLanguage, Languages: u.options.Languages}, nil
+}
+
+func (db *inMemoryDB) SetLanguages(ctx context.Context, shortURL string, localization *Localization) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, exists := db.store[shortURL]
+	if !exists {
+		return NewNotFoundError("url not found")
+	}
+	u.options.DefaultLanguage, u.options.Languages = localization.Default, localization.Languages
+	db.store[shortURL] = u
+	return nil
+}
+
+func (db *inMemoryDB) UTMTemplates(ctx context.Context, tags []string) (map[string]UTM, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	templates := make(map[string]UTM)
+	for _, t := range tags {
+		if utm, ok := db.utmTemplates[t]; ok {
+			templates[t] = utm
+		}
+	}
+	return templates, nil
+}
+
+func (db *inMemoryDB) SetUTMTemplate(ctx context.Context, tag string, utm UTM) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if utm.IsZero() {
+		delete(db.utmTemplates, tag)
+	} else {
+		db.utmTemplates[tag] = utm
+	}
+	return nil
+}
+
+func (db *inMemoryDB) Campaigns(ctx context.Context, since, until time.Time, limit int) ([]CampaignStatistics, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	byCampaign := make(map[UTM]*CampaignStatistics)
+	for short, accesses := range db.linkAccess {
+		utm := db.store[short].options.UTM
+		if utm.Campaign == "" {
+			continue
+		}
+		group := UTM{Source: utm.Source, Medium: utm.Medium, Campaign: utm.Campaign}
+		counted := false
+		for _, a := range accesses {
+			if a.HitKind != HumanHit || a.AccessAt.Before(since) || !a.AccessAt.Before(until) {
+				continue
+			}
+			if byCampaign[group] == nil {
+				byCampaign[group] = &CampaignStatistics{Source: group.Source, Medium: group.Medium, Campaign: group.Campaign}
+			}
+			if !counted {
+				byCampaign[group].Links++
+				counted = true
+			}
+			byCampaign[group].Clicks++
+		}
+	}
+
+	var stat []CampaignStatistics
+	for _, c := range byCampaign {
+		stat = append(stat, *c)
+	}
+	sort.Slice(stat, func(i, j int) bool { return stat[i].Clicks > stat[j].Clicks })
+	if len(stat) > limit {
+		stat = stat[:limit]
+	}
+	return stat, nil
+}
+
+func (db *inMemoryDB) Schedule(ctx context.Context, shortURL string) ([]ScheduleEntry, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, exists := db.store[shortURL]
+	if !exists {
+		return nil, NewNotFoundError("url not found")
+	}
+	return u.options.Schedule, nil
+}
+
+func (db *inMemoryDB) SetSchedule(ctx context.Context, shortURL string, schedule []ScheduleEntry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, exists := db.store[shortURL]
+	if !exists {
+		return NewNotFoundError("url not found")
+	}
+	u.options.Schedule = schedule
+	db.store[shortURL] = u
+	return nil
+}
+
+func containsString(arr []string, s string) bool {
+	for _, v := range arr {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func stat(arr []time.Time) *Statistics {
+	var median *time.Time
+	count := len(arr)
+	if count > 0 {
+		median = &arr[count/2]
+	}
+	return &Statistics{
+		Count:  count,
+		Timing: median,
+	}
+}
+
+// newTestService returns a service of the test host over a new in-memory
+// repository, the rest of the settings are taken from cfg if it's given.
+func newTestService(expired time.Duration, cfg ...Config) *Service {
+	var c Config
+	if len(cfg) > 0 {
+		c = cfg[0]
+	}
+	c.HostName, c.Scheme, c.URLLifeTime = hostName, scheme, expired
+
 	repo := newInMemoryDB()
 	log := zerolog.New(nil).With().Logger()
-	return NewService(repo, hostName, scheme, expired, &log)
+	return NewService(repo, c, &log)
 }
 
 func AssertNoError(t *testing.T, got error, name string) {
@@ -0,0 +1,91 @@
+package shortener
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultAllowedSchemes are the schemes links may point at if no others are configured.
+var DefaultAllowedSchemes = []string{"http", "https"}
+
+// literalIP parses the host as an IP address, including the IPv4 forms browsers
+// accept besides the dotted decimal one, e.g. "2130706433" or "0x7f.1".
+func literalIP(host string) net.IP {
+	if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")); ip != nil {
+		return ip
+	}
+
+	parts := strings.Split(strings.TrimSuffix(host, "."), ".")
+	if len(parts) > 4 {
+		return nil
+	}
+	values := make([]uint64, len(parts))
+	for i, p := range parts {
+		v, err := strconv.ParseUint(p, 0, 32)
+		if err != nil {
+			return nil
+		}
+		values[i] = v
+	}
+
+	// The last part fills all the remaining bytes of the address.
+	var addr uint64
+	for i, v := range values[:len(values)-1] {
+		if v > 0xff {
+			return nil
+		}
+		addr |= v << (8 * uint(3-i))
+	}
+	last := values[len(values)-1]
+	if last >= 1<<(8*uint(5-len(values))) {
+		return nil
+	}
+	addr |= last
+	return net.IPv4(byte(addr>>24), byte(addr>>16), byte(addr>>8), byte(addr))
+}
+
+// checkSafeDestination keeps links from pointing at internal resources behind
+// the trusted domain of the service: only the allowed schemes pass, literal
+// internal IPs and localhost are rejected, and so are host names resolving
+// to internal IPs if there is a resolver.
+func (srv *Service) checkSafeDestination(ctx context.Context, u *url.URL) error {
+	if !srv.allowedSchemes[strings.ToLower(u.Scheme)] {
+		return NewBadParamsError(fmt.Sprintf("scheme %q is not allowed", u.Scheme), nil)
+	}
+	if srv.allowInternal {
+		return nil
+	}
+
+	host, _, err := normalizeHost(strings.ToLower(strings.TrimSuffix(u.Hostname(), ".")))
+	if err != nil {
+		return err
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return NewBadParamsError("links to localhost are not allowed", nil)
+	}
+
+	if ip := literalIP(host); ip != nil {
+		if InternalIP(ip) {
+			return NewBadParamsError(fmt.Sprintf("links to the internal address %s are not allowed", ip), nil)
+		}
+		return nil
+	}
+
+	if srv.resolver == nil {
+		return nil
+	}
+	addrs, err := srv.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return NewBadParamsError(fmt.Sprintf("can't resolve host %s", host), err)
+	}
+	for _, a := range addrs {
+		if InternalIP(a.IP) {
+			return NewBadParamsError(fmt.Sprintf("host %s resolves to the internal address %s", host, a.IP), nil)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package shortener
+
+import "strings"
+
+const (
+	IOS      = "ios"
+	Android  = "android"
+	Windows  = "windows"
+	MacOS    = "macos"
+	ChromeOS = "chromeos"
+	Linux    = "linux"
+
+	Mobile  = "mobile"
+	Tablet  = "tablet"
+	Desktop = "desktop"
+)
+
+// Client is the operating system and the device class of a visitor.
+type Client struct {
+	OS     string
+	Device string
+}
+
+// ParseUserAgent recognizes major platforms only, OS is empty for unknown ones.
+func ParseUserAgent(ua string) Client {
+	ua = strings.ToLower(ua)
+
+	var c Client
+	switch {
+	case strings.Contains(ua, "iphone"), strings.Contains(ua, "ipad"), strings.Contains(ua, "ipod"):
+		c.OS = IOS
+	case strings.Contains(ua, "android"):
+		c.OS = Android
+	case strings.Contains(ua, "windows"):
+		c.OS = Windows
+	case strings.Contains(ua, "; cros "):
+		c.OS = ChromeOS
+	case strings.Contains(ua, "macintosh"), strings.Contains(ua, "mac os x"):
+		c.OS = MacOS
+	case strings.Contains(ua, "linux"):
+		c.OS = Linux
+	}
+
+	switch {
+	case strings.Contains(ua, "ipad"), strings.Contains(ua, "tablet"),
+		c.OS == Android && !strings.Contains(ua, "mobile"):
+		c.Device = Tablet
+	case strings.Contains(ua, "mobi"), strings.Contains(ua, "iphone"), strings.Contains(ua, "ipod"),
+		strings.Contains(ua, "windows phone"):
+		c.Device = Mobile
+	default:
+		c.Device = Desktop
+	}
+
+	return c
+}
@@ -0,0 +1,122 @@
+package shortener
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const maxUTMLength = 200
+
+// UTM are campaign parameters appended to the long URL as utm_* query parameters.
+type UTM struct {
+	Source   string
+	Medium   string
+	Campaign string
+	Term     string
+	Content  string
+}
+
+// CampaignStatistics counts human clicks of links tagged with the same campaign.
+type CampaignStatistics struct {
+	Source   string
+	Medium   string
+	Campaign string
+	Links    int
+	Clicks   int
+}
+
+func (u UTM) IsZero() bool {
+	return u == UTM{}
+}
+
+func (u UTM) params() [][2]string {
+	return [][2]string{
+		{"utm_source", u.Source},
+		{"utm_medium", u.Medium},
+		{"utm_campaign", u.Campaign},
+		{"utm_term", u.Term},
+		{"utm_content", u.Content},
+	}
+}
+
+// withDefaults fills the empty parameters from d.
+func (u UTM) withDefaults(d UTM) UTM {
+	pick := func(v, def string) string {
+		if v != "" {
+			return v
+		}
+		return def
+	}
+	return UTM{
+		Source:   pick(u.Source, d.Source),
+		Medium:   pick(u.Medium, d.Medium),
+		Campaign: pick(u.Campaign, d.Campaign),
+		Term:     pick(u.Term, d.Term),
+		Content:  pick(u.Content, d.Content),
+	}
+}
+
+// utmFromQuery takes the utm_* parameters already present in the long URL.
+func utmFromQuery(q url.Values) UTM {
+	return UTM{
+		Source:   q.Get("utm_source"),
+		Medium:   q.Get("utm_medium"),
+		Campaign: q.Get("utm_campaign"),
+		Term:     q.Get("utm_term"),
+		Content:  q.Get("utm_content"),
+	}
+}
+
+func normalizeUTM(u UTM) (UTM, error) {
+	fields := []*string{&u.Source, &u.Medium, &u.Campaign, &u.Term, &u.Content}
+	for _, f := range fields {
+		*f = strings.TrimSpace(*f)
+		if len(*f) > maxUTMLength {
+			return UTM{}, NewBadParamsError(fmt.Sprintf("utm parameters are limited to %d characters", maxUTMLength), nil)
+		}
+	}
+	return u, nil
+}
+
+// tagURL sets the non-empty parameters in the query of the long URL. The first
+// parameter with the same name is replaced in place and the repeated ones are
+// dropped, the rest of the query is kept as given like appendQueryParam does.
+func tagURL(u *url.URL, utm UTM) string {
+	if utm.IsZero() {
+		return u.String()
+	}
+
+	values := make(map[string]string)
+	for _, p := range utm.params() {
+		if p[1] != "" {
+			values[p[0]] = url.QueryEscape(p[0]) + "=" + url.QueryEscape(p[1])
+		}
+	}
+
+	var pairs []string
+	set := make(map[string]bool, len(values))
+	if u.RawQuery != "" {
+		for _, pair := range strings.Split(u.RawQuery, "&") {
+			key, err := url.QueryUnescape(strings.SplitN(pair, "=", 2)[0])
+			if value, ok := values[key]; ok && err == nil {
+				if !set[key] {
+					pairs = append(pairs, value)
+					set[key] = true
+				}
+				continue
+			}
+			pairs = append(pairs, pair)
+		}
+	}
+	for _, p := range utm.params() {
+		if value, ok := values[p[0]]; ok && !set[p[0]] {
+			pairs = append(pairs, value)
+		}
+	}
+
+	tagged := *u
+	tagged.RawQuery = strings.Join(pairs, "&")
+	tagged.ForceQuery = false
+	return tagged.String()
+}
@@ -0,0 +1,92 @@
+package shortener
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+)
+
+const (
+	minVariants      = 2
+	maxVariants      = 10
+	maxVariantWeight = 1000
+)
+
+// Variant is a destination of an A/B rotation, visitors are split across
+// variants in proportion to their weights.
+type Variant struct {
+	Destination string
+	Weight      int
+}
+
+// VariantStatistics counts human clicks of a variant, Variant is its number starting from 1.
+type VariantStatistics struct {
+	Variant     int
+	Destination string
+	Clicks      int
+}
+
+// chooseVariant returns the number of the variant the visitor is sent to,
+// starting from 1. A variant assigned before is kept while it exists.
+func chooseVariant(u *URL, visitor *Visitor) int {
+	if len(u.Variants) == 0 {
+		return 0
+	}
+
+	if visitor != nil {
+		if n, ok := visitor.Variants[u.Short]; ok && n >= 1 && n <= len(u.Variants) {
+			return n
+		}
+	}
+
+	total := 0
+	for _, v := range u.Variants {
+		total += v.Weight
+	}
+	if total <= 0 {
+		return 1
+	}
+
+	r, err := rand.Int(rand.Reader, big.NewInt(int64(total)))
+	if err != nil {
+		return 1
+	}
+
+	point := int(r.Int64())
+	for i, v := range u.Variants {
+		if point < v.Weight {
+			return i + 1
+		}
+		point -= v.Weight
+	}
+
+	return len(u.Variants)
+}
+
+func normalizeVariants(variants []Variant) ([]Variant, error) {
+	if len(variants) == 0 {
+		return nil, nil
+	}
+	if len(variants) < minVariants || len(variants) > maxVariants {
+		return nil, NewBadParamsError(fmt.Sprintf("a rotation needs from %d to %d variants", minVariants, maxVariants), nil)
+	}
+
+	normalized := make([]Variant, 0, len(variants))
+	for i, v := range variants {
+		if v.Weight < 1 || v.Weight > maxVariantWeight {
+			return nil, NewBadParamsError(fmt.Sprintf("variant #%d: weight must be between 1 and %d", i, maxVariantWeight), nil)
+		}
+
+		parsed, err := parseURL(v.Destination)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateURL(parsed); err != nil {
+			return nil, NewBadParamsError(fmt.Sprintf("variant #%d: %s", i, err), nil)
+		}
+
+		normalized = append(normalized, v)
+	}
+
+	return normalized, nil
+}
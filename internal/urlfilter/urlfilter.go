@@ -0,0 +1,259 @@
+// Package urlfilter decides which destinations links may point at by allow
+// and deny lists kept in files, the files are reloaded when they change.
+package urlfilter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/kalinink/simple-url-shortener/internal/shortener"
+	"github.com/rs/zerolog"
+	"golang.org/x/net/idna"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// Rules is a parsed list. Every line is a rule, empty lines and lines
+// starting with "#" are skipped:
+//
+//	example.com            the domain itself
+//	*.example.com          any subdomain of the domain, but not the domain itself
+//	example.com/private/*  URLs without the scheme matching the pattern, "*" matches anything
+//
+// Hosts are compared in the ASCII form, patterns see the port only if it isn't
+// the default one of the scheme and the path as servers resolve it.
+type Rules struct {
+	domains    map[string]bool
+	subdomains []string
+	patterns   []*regexp.Regexp
+}
+
+func ParseRules(r io.Reader) (*Rules, error) {
+	rules := &Rules{domains: make(map[string]bool)}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := rules.add(line); err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err.Error())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func (r *Rules) add(rule string) error {
+	if i := strings.Index(rule, "://"); i >= 0 {
+		rule = rule[i+len("://"):]
+	}
+
+	host, rest := rule, ""
+	if i := strings.IndexAny(rule, "/?"); i >= 0 {
+		host, rest = rule[:i], rule[i:]
+	}
+
+	if rest != "" {
+		host = strings.ToLower(host)
+		if !strings.Contains(host, "*") {
+			if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+				host = ascii
+			}
+		}
+		parts := strings.Split(host+rest, "*")
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+		pattern, err := regexp.Compile("^" + strings.Join(parts, ".*") + "$")
+		if err != nil {
+			return err
+		}
+		r.patterns = append(r.patterns, pattern)
+		return nil
+	}
+
+	wildcard := strings.HasPrefix(host, "*.")
+	domain, err := idna.Lookup.ToASCII(strings.TrimPrefix(host, "*."))
+	if err != nil || domain == "" || strings.Contains(domain, "*") {
+		return fmt.Errorf("invalid domain %q", host)
+	}
+	if wildcard {
+		r.subdomains = append(r.subdomains, "."+domain)
+	} else {
+		r.domains[domain] = true
+	}
+	return nil
+}
+
+// Match tells if any rule matches the URL.
+func (r *Rules) Match(u *url.URL) bool {
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		host = ascii
+	}
+	if r.domains[host] {
+		return true
+	}
+	for _, s := range r.subdomains {
+		if strings.HasSuffix(host, s) {
+			return true
+		}
+	}
+
+	if len(r.patterns) == 0 {
+		return false
+	}
+	target := host
+	if port := u.Port(); port != "" && port != defaultPorts[strings.ToLower(u.Scheme)] {
+		target += ":" + port
+	}
+	target += shortener.CleanPath(u.EscapedPath())
+	if u.RawQuery != "" {
+		target += "?" + u.RawQuery
+	}
+	for _, p := range r.patterns {
+		if p.MatchString(target) {
+			return true
+		}
+	}
+	return false
+}
+
+type Config struct {
+	// AllowList and DenyList are paths to the list files, either may be empty.
+	// If there is an allow list, only the destinations it matches are allowed.
+	AllowList string
+	DenyList  string
+	// ReloadInterval is how often the files are checked for changes.
+	ReloadInterval time.Duration
+}
+
+// Filter denies destinations matched by the deny list or, if there is an
+// allow list, not matched by it. It is safe for concurrent use.
+type Filter struct {
+	cfg Config
+	log *zerolog.Logger
+
+	mu     sync.RWMutex
+	allow  *Rules
+	deny   *Rules
+	stamps [2]fileStamp
+}
+
+// fileStamp tells apart versions of a file without reading it.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// New loads the lists, it fails if any of them can't be loaded.
+func New(cfg Config, log *zerolog.Logger) (*Filter, error) {
+	f := &Filter{cfg: cfg, log: log}
+	if _, err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *Filter) Allowed(u *url.URL) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.deny != nil && f.deny.Match(u) {
+		return false
+	}
+	return f.allow == nil || f.allow.Match(u)
+}
+
+// Run reloads the lists every ReloadInterval if the files changed until ctx
+// is canceled. Lists that fail to load are kept in their previous version.
+func (f *Filter) Run(ctx context.Context) {
+	ticker := time.NewTicker(f.cfg.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := f.Reload()
+			if err != nil {
+				f.log.Err(err).Msg("destination lists reload")
+			} else if reloaded {
+				f.log.Info().Msg("destination lists are reloaded")
+			}
+		}
+	}
+}
+
+// Reload loads the lists whose files changed since the last load.
+func (f *Filter) Reload() (bool, error) {
+	paths := [2]string{f.cfg.AllowList, f.cfg.DenyList}
+
+	f.mu.RLock()
+	stamps := f.stamps
+	f.mu.RUnlock()
+
+	var lists [2]*Rules
+	changed := false
+	for i, path := range paths {
+		if path == "" {
+			continue
+		}
+
+		stat, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		stamp := fileStamp{modTime: stat.ModTime(), size: stat.Size()}
+		if stamp == stamps[i] {
+			continue
+		}
+
+		if lists[i], err = load(path); err != nil {
+			return false, err
+		}
+		stamps[i] = stamp
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if lists[0] != nil {
+		f.allow = lists[0]
+	}
+	if lists[1] != nil {
+		f.deny = lists[1]
+	}
+	f.stamps = stamps
+	return true, nil
+}
+
+func load(path string) (*Rules, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rules, err := ParseRules(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return rules, nil
+}
@@ -0,0 +1,125 @@
+package urlfilter
+
+import (
+	"github.com/rs/zerolog"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRules_Match(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`
+# blocked
+example.com
+*.Tracker.org
+пример.рф
+https://files.net/private/*
+*/download?id=*
+файлы.рф/private/*
+internal.net:8080/*
+`))
+	if err != nil {
+		t.Fatalf("parsing rules: %v", err)
+	}
+
+	cases := []struct {
+		url  string
+		want bool
+	}{
+		{"https://example.com/page", true},
+		{"https://EXAMPLE.com./page", true},
+		{"https://www.example.com/page", false},
+		{"https://notexample.com/", false},
+		{"https://a.b.tracker.org/", true},
+		{"https://tracker.org/", false},
+		{"https://xn--e1afmkfd.xn--p1ai/", true},
+		{"https://ПРИМЕР.рф/", true},
+		{"https://sub.TRACKER.org./", true},
+		{"https://files.net/private/report.pdf", true},
+		{"https://files.net/public/report.pdf", false},
+		{"https://files.net/public/../private/report.pdf", true},
+		{"https://files.net/%70rivate/report.pdf", true},
+		{"https://files.net//private/report.pdf", true},
+		{"https://files.net/./private//report.pdf", true},
+		{"https://files.net/public/%2E%2E/private/report.pdf", true},
+		{"https://files.net:443/private/report.pdf", true},
+		{"http://files.net:80/private/report.pdf", true},
+		{"https://files.net:8443/private/report.pdf", false},
+		{"https://xn--80asg7a0b.xn--p1ai/private/a", true},
+		{"https://файлы.рф/private/a", true},
+		{"http://internal.net:8080/admin", true},
+		{"http://internal.net/admin", false},
+		{"http://mirror.io/download?id=7", true},
+		{"http://mirror.io/download", false},
+	}
+	for _, c := range cases {
+		u, _ := url.Parse(c.url)
+		if got := rules.Match(u); got != c.want {
+			t.Errorf("[%s] want %v, got %v", c.url, c.want, got)
+		}
+	}
+
+	if _, err := ParseRules(strings.NewReader("exa mple.com")); err == nil {
+		t.Errorf("want an error for an invalid domain")
+	}
+}
+
+func TestFilter_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "urlfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	allow, deny := filepath.Join(dir, "allow"), filepath.Join(dir, "deny")
+	write := func(path, content string, at time.Time) {
+		t.Helper()
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write(allow, "*.corp.local\n", now)
+	write(deny, "secret.corp.local\n", now)
+
+	log := zerolog.New(nil).With().Logger()
+	f, err := New(Config{AllowList: allow, DenyList: deny, ReloadInterval: time.Second}, &log)
+	if err != nil {
+		t.Fatalf("loading lists: %v", err)
+	}
+
+	allowed := func(rawURL string) bool {
+		u, _ := url.Parse(rawURL)
+		return f.Allowed(u)
+	}
+	if !allowed("https://wiki.corp.local/") || allowed("https://secret.corp.local/") || allowed("https://example.com/") {
+		t.Errorf("want only allowed and not denied domains")
+	}
+
+	if reloaded, err := f.Reload(); err != nil || reloaded {
+		t.Errorf("want unchanged lists kept, got %v and %v", reloaded, err)
+	}
+
+	write(deny, "secret.corp.local\nwiki.corp.local\n", now.Add(time.Minute))
+	if reloaded, err := f.Reload(); err != nil || !reloaded {
+		t.Fatalf("want changed lists reloaded, got %v and %v", reloaded, err)
+	}
+	if allowed("https://wiki.corp.local/") {
+		t.Errorf("want a newly denied domain denied")
+	}
+
+	write(allow, "*.corp.local\n*\n", now.Add(2*time.Minute))
+	if _, err := f.Reload(); err == nil {
+		t.Errorf("want an error for an invalid list")
+	}
+	if !allowed("https://docs.corp.local/") || allowed("https://example.com/") {
+		t.Errorf("want the previous lists kept after a failed reload")
+	}
+}